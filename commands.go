@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/niusmallnan/kube-rdns/controller"
+	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/controller/watch"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"k8s.io/client-go/kubernetes"
+)
+
+var domainFlag = cli.StringFlag{
+	Name:  "domain",
+	Usage: "Name of the configured domain, the primary domain by default",
+}
+
+func commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "domain",
+			Usage: "Inspect and operate the rdns domain of this cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "Show the fqdn, hosts and expiration of the domain",
+					Flags:  []cli.Flag{domainFlag},
+					Action: withKubeClient(domainShow),
+				},
+				{
+					Name:   "renew",
+					Usage:  "Renew the domain",
+					Flags:  []cli.Flag{domainFlag},
+					Action: withKubeClient(domainRenew),
+				},
+				{
+					Name:      "set-hosts",
+					Usage:     "Set the hosts of the domain",
+					ArgsUsage: "HOST [HOST...]",
+					Flags:     []cli.Flag{domainFlag},
+					Action:    withKubeClient(domainSetHosts),
+				},
+				{
+					Name:   "delete",
+					Usage:  "Delete the domain and the saved token",
+					Flags:  []cli.Flag{domainFlag},
+					Action: withKubeClient(domainDelete),
+				},
+			},
+		},
+		{
+			Name:  "token",
+			Usage: "Inspect the saved rdns token",
+			Subcommands: []cli.Command{
+				{
+					Name:   "export",
+					Usage:  "Print the saved token and fqdn as json",
+					Flags:  []cli.Flag{domainFlag},
+					Action: withKubeClient(tokenExport),
+				},
+			},
+		},
+		{
+			Name:  "ingress",
+			Usage: "Inspect the ingresses managed by kube-rdns",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List the managed ingresses with their generated hostnames",
+					Action: withKubeClient(ingressList),
+				},
+			},
+		},
+	}
+}
+
+func withKubeClient(f func(*cli.Context, kubernetes.Interface) error) func(*cli.Context) error {
+	return func(ctx *cli.Context) error {
+		kubeClient, err := createApiserverClient()
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if err := f(ctx, kubeClient); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		return nil
+	}
+}
+
+func newDomainClient(ctx *cli.Context, kubeClient kubernetes.Interface) (rdns.Provider, error) {
+	domain, err := setting.GetDomain(ctx.String("domain"))
+	if err != nil {
+		return nil, err
+	}
+	return controller.NewProvider(kubeClient, domain), nil
+}
+
+func domainShow(ctx *cli.Context, kubeClient kubernetes.Interface) error {
+	c, err := newDomainClient(ctx, kubeClient)
+	if err != nil {
+		return err
+	}
+	d, err := c.GetDomain()
+	if err != nil {
+		return err
+	}
+
+	expiration := ""
+	if d.Expiration != nil {
+		expiration = d.Expiration.String()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "FQDN:\t%s\n", d.Fqdn)
+	fmt.Fprintf(w, "HOSTS:\t%s\n", strings.Join(d.Hosts, ","))
+	fmt.Fprintf(w, "EXPIRATION:\t%s\n", expiration)
+	return w.Flush()
+}
+
+func domainRenew(ctx *cli.Context, kubeClient kubernetes.Interface) error {
+	c, err := newDomainClient(ctx, kubeClient)
+	if err != nil {
+		return err
+	}
+	return c.RenewDomain()
+}
+
+func domainSetHosts(ctx *cli.Context, kubeClient kubernetes.Interface) error {
+	if ctx.NArg() == 0 {
+		return errors.New("set-hosts: at least one host is required")
+	}
+	c, err := newDomainClient(ctx, kubeClient)
+	if err != nil {
+		return err
+	}
+	return c.ApplyDomain(selector.FromAddresses(ctx.Args()))
+}
+
+func domainDelete(ctx *cli.Context, kubeClient kubernetes.Interface) error {
+	c, err := newDomainClient(ctx, kubeClient)
+	if err != nil {
+		return err
+	}
+	return c.DeleteDomain()
+}
+
+func tokenExport(ctx *cli.Context, kubeClient kubernetes.Interface) error {
+	domain, err := setting.GetDomain(ctx.String("domain"))
+	if err != nil {
+		return err
+	}
+	token, fqdn := k8s.GetTokenAndRootFqdn(kubeClient, domain.Secret)
+	if token == "" || fqdn == "" {
+		return errors.New("token export: failed to get token and fqdn")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]string{
+		"token":   token,
+		"fqdn":    fqdn,
+		"backend": k8s.GetBackend(kubeClient, domain.Secret),
+	})
+}
+
+func ingressList(ctx *cli.Context, kubeClient kubernetes.Interface) error {
+	ings, err := watch.ListManagedIngresses(kubeClient)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tHOSTNAME")
+	for i := range ings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ings[i].Namespace, ings[i].Name, watch.GetIngressHostname(&ings[i]))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,240 @@
+// Package acme is a cert-manager DNS-01 webhook solver. cert-manager calls the solvers through
+// the kube-apiserver, which proxies the requests of a registered APIService to the webhook with
+// its front proxy client certificate.
+//
+// The challenge records are only published by the rfc2136 and responder providers. The rdns
+// server has no txt records, so the webhook cannot be used with the default rdns provider.
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var log = logging.For("acme")
+
+const (
+	ActionPresent = "Present"
+	ActionCleanUp = "CleanUp"
+
+	// Version is the version of the cert-manager webhook solver api
+	Version = "v1alpha1"
+	// SolverName is the solverName issuers reference the webhook with
+	SolverName = "rdns"
+
+	challengePrefix = "_acme-challenge."
+)
+
+// ChallengeRequest follows the request of the cert-manager ChallengePayload
+type ChallengeRequest struct {
+	UID                     types.UID       `json:"uid"`
+	Action                  string          `json:"action"`
+	Type                    string          `json:"type"`
+	DNSName                 string          `json:"dnsName"`
+	Key                     string          `json:"key"`
+	ResourceNamespace       string          `json:"resourceNamespace"`
+	ResolvedFQDN            string          `json:"resolvedFQDN"`
+	ResolvedZone            string          `json:"resolvedZone"`
+	AllowAmbientCredentials bool            `json:"allowAmbientCredentials"`
+	Config                  json.RawMessage `json:"config,omitempty"`
+}
+
+// ChallengeResponse follows the response of the cert-manager ChallengePayload
+type ChallengeResponse struct {
+	UID     types.UID      `json:"uid"`
+	Success bool           `json:"success"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+// ChallengePayload is the body cert-manager posts to the solver and receives back
+type ChallengePayload struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *ChallengeRequest  `json:"request,omitempty"`
+	Response        *ChallengeResponse `json:"response,omitempty"`
+}
+
+// Config is how the webhook is served
+type Config struct {
+	Listen       string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	GroupName    string
+}
+
+// ConfigFromSettings returns the config of the acme webhook flags
+func ConfigFromSettings() Config {
+	return Config{
+		Listen:       setting.GetACMEWebhookListen(),
+		CertFile:     setting.GetACMEWebhookCertFile(),
+		KeyFile:      setting.GetACMEWebhookKeyFile(),
+		ClientCAFile: setting.GetACMEWebhookClientCAFile(),
+		GroupName:    setting.GetACMEWebhookGroupName(),
+	}
+}
+
+// Validate checks the webhook can be served, it only accepts the clients the kube-apiserver
+// proxies for so the serving and client ca certificates are required
+func Validate(cfg Config) error {
+	if cfg.Listen == "" {
+		return errors.New("acme webhook listen address should not be empty")
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return errors.New("the acme webhook requires a serving certificate and key")
+	}
+	if cfg.ClientCAFile == "" {
+		return errors.New("the acme webhook requires the ca of the kube-apiserver front proxy client certificate")
+	}
+	if !strings.Contains(cfg.GroupName, ".") {
+		return errors.Errorf("invalid acme webhook group name %q, must be a domain name", cfg.GroupName)
+	}
+	_, err := tlsConfig(cfg.ClientCAFile)
+	return err
+}
+
+// tlsConfig requires client certificates signed by the ca in clientCAFile
+func tlsConfig(clientCAFile string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the acme webhook client ca")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificates found in %s", clientCAFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// Webhook creates and deletes the _acme-challenge txt records for DNS-01 challenges
+type Webhook struct {
+	rdnsClient rdns.Provider
+	groupName  string
+}
+
+func NewWebhook(rdnsClient rdns.Provider, groupName string) *Webhook {
+	return &Webhook{rdnsClient: rdnsClient, groupName: groupName}
+}
+
+// ListenAndServe serves the webhook over tls to the clients with a certificate of the client ca
+func (h *Webhook) ListenAndServe(cfg Config) error {
+	tlsConfig, err := tlsConfig(cfg.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      60 * time.Second,
+	}
+	return server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+}
+
+func (h *Webhook) groupVersion() string {
+	return h.groupName + "/" + Version
+}
+
+func (h *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/healthz":
+		w.Write([]byte("ok"))
+	case r.Method == http.MethodGet && path == "/apis":
+		version := metav1.GroupVersionForDiscovery{GroupVersion: h.groupVersion(), Version: Version}
+		writeJSON(w, http.StatusOK, metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+			Groups:   []metav1.APIGroup{{Name: h.groupName, Versions: []metav1.GroupVersionForDiscovery{version}, PreferredVersion: version}},
+		})
+	case r.Method == http.MethodGet && path == "/apis/"+h.groupName:
+		version := metav1.GroupVersionForDiscovery{GroupVersion: h.groupVersion(), Version: Version}
+		writeJSON(w, http.StatusOK, metav1.APIGroup{
+			TypeMeta:         metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"},
+			Name:             h.groupName,
+			Versions:         []metav1.GroupVersionForDiscovery{version},
+			PreferredVersion: version,
+		})
+	case r.Method == http.MethodGet && path == "/apis/"+h.groupVersion():
+		writeJSON(w, http.StatusOK, metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: h.groupVersion(),
+			APIResources: []metav1.APIResource{{
+				Name:         SolverName,
+				SingularName: SolverName,
+				Kind:         "ChallengePayload",
+				Verbs:        metav1.Verbs{"create"},
+			}},
+		})
+	case path == "/apis/"+h.groupVersion()+"/"+SolverName:
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.solve(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Webhook) solve(w http.ResponseWriter, r *http.Request) {
+	var payload ChallengePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Request == nil {
+		http.Error(w, fmt.Sprintf("failed to decode challenge payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req := payload.Request
+	resp := &ChallengeResponse{UID: req.UID, Success: true}
+	if err := h.handle(req); err != nil {
+		log.WithFields(logrus.Fields{logging.FieldFqdn: req.ResolvedFQDN, logging.FieldOperation: req.Action}).Errorf("Failed to handle acme challenge: %v", err)
+		resp.Success = false
+		resp.Result = &metav1.Status{Status: metav1.StatusFailure, Message: err.Error(), Reason: metav1.StatusReasonInternalError, Code: http.StatusInternalServerError}
+	}
+	writeJSON(w, http.StatusCreated, ChallengePayload{TypeMeta: payload.TypeMeta, Request: req, Response: resp})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to encode acme webhook response: %v", err)
+	}
+}
+
+func (h *Webhook) handle(req *ChallengeRequest) error {
+	name := strings.TrimSuffix(req.ResolvedFQDN, ".")
+	if !strings.HasPrefix(name, challengePrefix) {
+		return errors.Errorf("%s is not an acme challenge record", req.ResolvedFQDN)
+	}
+	if req.Key == "" {
+		return errors.New("challenge key should not be empty")
+	}
+
+	switch req.Action {
+	case ActionPresent:
+		log.Infof("Presenting acme challenge record %s", name)
+		return h.rdnsClient.SetTXTRecord(name, req.Key)
+	case ActionCleanUp:
+		log.Infof("Cleaning up acme challenge record %s", name)
+		return h.rdnsClient.DeleteTXTRecord(name, req.Key)
+	}
+	return errors.Errorf("unknown challenge action %q", req.Action)
+}
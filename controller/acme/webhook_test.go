@@ -0,0 +1,297 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/responder"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/niusmallnan/kube-rdns/setting"
+)
+
+const (
+	zoneFqdn  = "acme.example.test"
+	groupName = "acme.rdns.cattle.io"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authority{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// client returns a client certificate signed by the authority
+func (a *authority) client(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newServer serves the webhook like ListenAndServe, to the clients of the front proxy authority
+func newServer(t *testing.T, provider rdns.Provider, frontProxy *authority) *httptest.Server {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := ioutil.WriteFile(caFile, frontProxy.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := tlsConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(NewWebhook(provider, groupName))
+	server.TLS = config
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// httpClient trusts the server and presents certs, the clients of a server do not share a transport
+func httpClient(server *httptest.Server, certs ...tls.Certificate) *http.Client {
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certs
+	return &http.Client{Transport: transport}
+}
+
+func solve(t *testing.T, client *http.Client, url string, req ChallengeRequest) *ChallengeResponse {
+	t.Helper()
+	body, err := json.Marshal(ChallengePayload{Request: &req})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(url+"/apis/"+groupName+"/"+Version+"/"+SolverName, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	var payload ChallengePayload
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Response == nil || payload.Response.UID != req.UID {
+		t.Fatalf("response = %+v, want the uid %s", payload.Response, req.UID)
+	}
+	return payload.Response
+}
+
+// serveDNS answers the zones of the responder on a loopback port and returns a resolver
+// which queries it over tcp
+func serveDNS(t *testing.T) *net.Resolver {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go responder.ListenAndServe(addr, stop)
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("dns responder is not listening on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		},
+	}
+}
+
+func TestWebhookPresentAndCleanUp(t *testing.T) {
+	if err := testutil.InitSettings(map[string]string{"provider": "responder", "desired-fqdn": zoneFqdn}); err != nil {
+		t.Fatal(err)
+	}
+	zone := responder.New(responder.ConfigFromSettings(), setting.GetDomains()[0])
+	resolver := serveDNS(t)
+	frontProxy := newAuthority(t, "front-proxy-ca")
+	server := newServer(t, zone, frontProxy)
+	client := httpClient(server, frontProxy.client(t, "front-proxy-client"))
+
+	name := challengePrefix + "www." + zoneFqdn
+	lookup := func() []string {
+		texts, err := resolver.LookupTXT(context.Background(), name+".")
+		if err != nil && !strings.Contains(err.Error(), "no such host") {
+			t.Fatal(err)
+		}
+		return texts
+	}
+
+	req := ChallengeRequest{UID: "1", Action: ActionPresent, Type: "dns-01", DNSName: "www." + zoneFqdn, Key: "token-1", ResolvedFQDN: name + ".", ResolvedZone: zoneFqdn + "."}
+	if resp := solve(t, client, server.URL, req); !resp.Success {
+		t.Fatalf("present failed: %+v", resp.Result)
+	}
+	req.UID, req.Key = "2", "token-2"
+	if resp := solve(t, client, server.URL, req); !resp.Success {
+		t.Fatalf("present failed: %+v", resp.Result)
+	}
+	if got := lookup(); strings.Join(got, ",") != "token-1,token-2" {
+		t.Fatalf("txt %s = %v, want [token-1 token-2]", name, got)
+	}
+
+	req.UID, req.Action = "3", ActionCleanUp
+	if resp := solve(t, client, server.URL, req); !resp.Success {
+		t.Fatalf("clean up failed: %+v", resp.Result)
+	}
+	if got := lookup(); strings.Join(got, ",") != "token-1" {
+		t.Fatalf("txt %s = %v after clean up, want [token-1]", name, got)
+	}
+
+	for _, bad := range []ChallengeRequest{
+		{UID: "4", Action: ActionPresent, Key: "token", ResolvedFQDN: "www." + zoneFqdn + "."},
+		{UID: "5", Action: ActionPresent, Key: "token", ResolvedFQDN: challengePrefix + "other.test."},
+		{UID: "6", Action: ActionPresent, ResolvedFQDN: name + "."},
+		{UID: "7", Action: "Renew", Key: "token", ResolvedFQDN: name + "."},
+	} {
+		if resp := solve(t, client, server.URL, bad); resp.Success || resp.Result == nil || resp.Result.Message == "" {
+			t.Fatalf("request %+v: response = %+v, want a failure", bad, resp)
+		}
+	}
+}
+
+func TestWebhookRdnsProvider(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	frontProxy := newAuthority(t, "front-proxy-ca")
+	server := newServer(t, rdns.NewClient(nil, setting.GetDomains()[0]), frontProxy)
+	client := httpClient(server, frontProxy.client(t, "front-proxy-client"))
+
+	resp := solve(t, client, server.URL, ChallengeRequest{UID: "1", Action: ActionPresent, Key: "token", ResolvedFQDN: challengePrefix + "abcd.lb.rancher.cloud."})
+	if resp.Success || !strings.Contains(resp.Result.Message, rdns.ErrNotSupported.Error()) {
+		t.Fatalf("response = %+v, want the txt records to be unsupported", resp)
+	}
+}
+
+func TestWebhookAuthentication(t *testing.T) {
+	if err := testutil.InitSettings(map[string]string{"provider": "responder", "desired-fqdn": zoneFqdn}); err != nil {
+		t.Fatal(err)
+	}
+	zone := responder.New(responder.ConfigFromSettings(), setting.GetDomains()[0])
+	frontProxy := newAuthority(t, "front-proxy-ca")
+	server := newServer(t, zone, frontProxy)
+
+	tests := []struct {
+		name    string
+		client  *http.Client
+		wantErr bool
+	}{
+		{name: "front proxy client", client: httpClient(server, frontProxy.client(t, "front-proxy-client"))},
+		{name: "no client certificate", client: httpClient(server), wantErr: true},
+		{name: "client of another ca", client: httpClient(server, newAuthority(t, "other-ca").client(t, "front-proxy-client")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(server.URL + "/apis/" + groupName + "/" + Version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discovery error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"name":"`+SolverName+`"`) {
+				t.Fatalf("discovery = %d %s, want the %s resource", resp.StatusCode, body, SolverName)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := ioutil.WriteFile(caFile, newAuthority(t, "front-proxy-ca").pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	valid := Config{Listen: ":8443", CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: caFile, GroupName: groupName}
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "no serving certificate", modify: func(c *Config) { c.CertFile = "" }, wantErr: true},
+		{name: "no client ca", modify: func(c *Config) { c.ClientCAFile = "" }, wantErr: true},
+		{name: "missing client ca", modify: func(c *Config) { c.ClientCAFile = caFile + ".missing" }, wantErr: true},
+		{name: "invalid group name", modify: func(c *Config) { c.GroupName = "acme" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			if err := Validate(config); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package address
+
+import (
+	"net"
+	"strings"
+
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	SourceType       = "type"
+	SourceAnnotation = "annotation"
+	SourceLabel      = "label"
+
+	rkeInternalAddressAnnotation = "rke.cattle.io/internal-ip"
+	rkeExternalAddressAnnotation = "rke.cattle.io/external-ip"
+)
+
+// DefaultSources follows the order of the historical lookup: ExternalIP, the rke external
+// and internal annotations, then InternalIP. Unlike that lookup, which used the last
+// InternalIP of a node, the first address found in a source is used, so a node with
+// several InternalIPs and no other address is published with its first InternalIP.
+var DefaultSources = strings.Join([]string{
+	SourceType + ":" + string(v1.NodeExternalIP),
+	SourceAnnotation + ":" + rkeExternalAddressAnnotation,
+	SourceAnnotation + ":" + rkeInternalAddressAnnotation,
+	SourceType + ":" + string(v1.NodeInternalIP),
+}, ",")
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, ipNet)
+	}
+}
+
+// Source is one place a node address can be read from, e.g. type:ExternalIP,
+// annotation:rke.cattle.io/external-ip or label:example.com/public-ip
+type Source struct {
+	Kind string
+	Key  string
+}
+
+// ParseSources parses a comma separated, ordered list of address sources
+func ParseSources(value string) ([]Source, error) {
+	var sources []Source
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("invalid node address source %q, must be <kind>:<key>", s)
+		}
+		switch parts[0] {
+		case SourceType, SourceAnnotation, SourceLabel:
+		default:
+			return nil, errors.Errorf("invalid node address source kind %q, must be one of %s, %s, %s", parts[0], SourceType, SourceAnnotation, SourceLabel)
+		}
+		sources = append(sources, Source{Kind: parts[0], Key: parts[1]})
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("at least one node address source is required")
+	}
+	return sources, nil
+}
+
+// IsPrivate returns true for RFC1918 and unique local ipv6 addresses
+func IsPrivate(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver picks the public address of a node from the ordered sources
+type Resolver struct {
+	Sources        []Source
+	ExcludePrivate bool
+}
+
+// NodeAddresses returns the public address of the node for every enabled address family
+func (r *Resolver) NodeAddresses(node *v1.Node, family string) []string {
+	var ips []string
+	for _, f := range selector.Families(family) {
+		if ip := r.NodeAddress(node, f); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// NodeAddress returns the first address of the family found in the sources, in order
+func (r *Resolver) NodeAddress(node *v1.Node, family string) string {
+	for _, source := range r.Sources {
+		for _, ip := range source.values(node) {
+			if !selector.MatchFamily(ip, family) {
+				continue
+			}
+			if r.ExcludePrivate && IsPrivate(ip) {
+				continue
+			}
+			return ip
+		}
+	}
+	return ""
+}
+
+func (s Source) values(node *v1.Node) []string {
+	switch s.Kind {
+	case SourceType:
+		var values []string
+		for _, address := range node.Status.Addresses {
+			if string(address.Type) == s.Key {
+				values = append(values, address.Address)
+			}
+		}
+		return values
+	case SourceAnnotation:
+		if v := node.Annotations[s.Key]; v != "" {
+			return []string{v}
+		}
+	case SourceLabel:
+		if v := node.Labels[s.Key]; v != "" {
+			return []string{v}
+		}
+	}
+	return nil
+}
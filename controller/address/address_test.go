@@ -0,0 +1,82 @@
+package address
+
+import (
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		sources        string
+		excludePrivate bool
+		annotations    map[string]string
+		labels         map[string]string
+		addresses      []v1.NodeAddress
+		want           string
+	}{
+		{
+			name:      "external ip first",
+			addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeExternalIP, Address: "1.1.1.1"}},
+			want:      "1.1.1.1",
+		},
+		{
+			name:        "annotations before internal ip",
+			annotations: map[string]string{rkeInternalAddressAnnotation: "2.2.2.2"},
+			addresses:   []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			want:        "2.2.2.2",
+		},
+		{
+			name:        "external annotation before internal annotation",
+			annotations: map[string]string{rkeInternalAddressAnnotation: "2.2.2.2", rkeExternalAddressAnnotation: "3.3.3.3"},
+			want:        "3.3.3.3",
+		},
+		{
+			// the historical lookup used the last InternalIP
+			name:      "first internal ip",
+			addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeInternalIP, Address: "10.0.0.2"}},
+			want:      "10.0.0.1",
+		},
+		{
+			name:           "private addresses excluded",
+			excludePrivate: true,
+			addresses:      []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeInternalIP, Address: "4.4.4.4"}},
+			want:           "4.4.4.4",
+		},
+		{
+			name:      "label source",
+			sources:   "label:example.com/public-ip,type:InternalIP",
+			labels:    map[string]string{"example.com/public-ip": "5.5.5.5"},
+			addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			want:      "5.5.5.5",
+		},
+		{
+			name:      "no address",
+			sources:   "type:ExternalIP",
+			addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := tt.sources
+			if value == "" {
+				value = DefaultSources
+			}
+			sources, err := ParseSources(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			node := &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "n1", Annotations: tt.annotations, Labels: tt.labels},
+				Status:     v1.NodeStatus{Addresses: tt.addresses},
+			}
+			r := &Resolver{Sources: sources, ExcludePrivate: tt.excludePrivate}
+			if got := r.NodeAddress(node, selector.FamilyIPv4); got != tt.want {
+				t.Fatalf("NodeAddress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
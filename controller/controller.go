@@ -3,121 +3,291 @@ package controller
 import (
 	"time"
 
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/prober"
 	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/responder"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
 	"github.com/niusmallnan/kube-rdns/controller/watch"
 	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/client-go/kubernetes"
 )
 
+var log = logging.For("controller")
+
 const (
 	podNginxControllerLabel      = "ingress-nginx"
 	defaultNginxIngressNamespace = "ingress-nginx"
-	rkeInternalAddressAnnotation = "rke.cattle.io/internal-ip"
-	rkeExternalAddressAnnotation = "rke.cattle.io/external-ip"
+	zoneLabel                    = "failure-domain.beta.kubernetes.io/zone"
+	topologyZoneLabel            = "topology.kubernetes.io/zone"
 )
 
 type RDNSController struct {
-	rdnsClient *rdns.Client
-	kubeClient *kubernetes.Clientset
-	ingRes     *watch.IngressResource
+	kubeClient kubernetes.Interface
+	domains    []*domainController
+	svcRes     *watch.ServiceResource
+	gwRes      *watch.GatewayResource
+	recRes     *watch.RecordResource
+	prober     *prober.Prober
+
+	republishCh chan struct{}
+	stop        chan struct{}
 }
 
-func NewRDNSController(kubeClient *kubernetes.Clientset) *RDNSController {
-	rdnsClient := rdns.NewClient(kubeClient)
-	ingRes := watch.NewIngressResource(kubeClient, rdnsClient)
-	return &RDNSController{
-		rdnsClient: rdnsClient,
+func NewRDNSController(kubeClient kubernetes.Interface) *RDNSController {
+	c := &RDNSController{
 		kubeClient: kubeClient,
-		ingRes:     ingRes,
+		prober:     prober.New(prober.ConfigFromSettings()),
+
+		republishCh: make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	for _, config := range setting.GetDomains() {
+		c.domains = append(c.domains, c.newDomainController(config))
+	}
+	// services, routes and records are published on the primary domain
+	primary := c.domains[0]
+	c.svcRes = watch.NewServiceResource(kubeClient, primary.rdnsClient, primary.addresses, primary.owners)
+	c.gwRes = watch.NewGatewayResource(kubeClient, primary.rdnsClient, primary.owners)
+	c.recRes = watch.NewRecordResource(kubeClient, primary.rdnsClient, primary.addresses, primary.owners)
+	return c
+}
+
+// RDNSClient returns the client of the primary domain
+func (c *RDNSController) RDNSClient() rdns.Provider {
+	return c.domains[0].rdnsClient
+}
+
+// HealthChecks returns a health check for every configured domain
+func (c *RDNSController) HealthChecks() []healthz.HealthzChecker {
+	var checks []healthz.HealthzChecker
+	for _, d := range c.domains {
+		checks = append(checks, d.healthCheck())
 	}
+	return checks
 }
 
 func (c *RDNSController) Stop() error {
+	close(c.stop)
 	return nil
 }
 
 func (c *RDNSController) Start() {
-	ips, err := c.getNginxControllerIPs()
-	if err != nil {
-		logrus.Fatalf("Fail to get nginx controller ips on start(), err: %s", err)
+	for _, d := range c.domains {
+		hosts, err := c.getNginxControllerHosts(d)
+		if err != nil {
+			log.Fatalf("Fail to get nginx controller ips on start(), err: %s", err)
+		}
+
+		log.WithField(logging.FieldDomain, d.config.Name).Infof("Got the host ips: %+v", hosts)
+		if err = c.publish(d, hosts); err != nil {
+			log.WithField(logging.FieldDomain, d.config.Name).Errorf("Failed to apply domain: %v", err)
+		}
+
+		log.WithField(logging.FieldDomain, d.config.Name).Info("Running watch the ingress resources")
+		go d.ingRes.WatchResources()
+	}
+
+	if responder.Enabled() {
+		log.Infof("Running dns responder on %s", setting.GetDNSListen())
+		go func() {
+			if err := responder.ListenAndServe(setting.GetDNSListen(), c.stop); err != nil {
+				log.Fatalf("Failed to run dns responder: %v", err)
+			}
+		}()
 	}
 
-	logrus.Infof("Got the host ips: %s", ips)
-	if err = c.rdnsClient.ApplyDomain(ips); err != nil {
-		logrus.Error(err)
+	// services, routes and rdnsrecords get records of their own name, which the rdns server cannot
+	// publish. They are watched anyway and report it with an event or in their status.
+	if primary := c.domains[0].config; !SupportsRecords(primary) {
+		log.WithField(logging.FieldDomain, primary.Name).Infof("The %s provider cannot publish the records of services, routes and rdnsrecords", primary.GetProvider())
 	}
+	log.Info("Running watch the service resources")
+	go c.svcRes.WatchResources()
 
-	logrus.Info("Running watch the ingress resources")
-	go c.ingRes.WatchResources()
+	log.Info("Running watch the gateway api routes")
+	go c.gwRes.WatchResources()
+
+	log.Info("Running reconcile the rdnsrecord resources")
+	go c.recRes.WatchResources()
+
+	log.Info("Running watch the nginx controller pods and nodes readiness")
+	go c.republishLoop()
+	c.watchReadiness()
+
+	go c.prober.Run(c.getCandidateHosts, c.triggerRepublish, c.stop)
 
 	c.renewLoop()
 	select {}
 }
 
 func (c *RDNSController) renewLoop() {
-	logrus.Infof("Running renew loop with duration: %s", setting.GetRenewDuration().String())
+	log.Infof("Running renew loop with duration: %s", setting.GetRenewDuration().String())
 	ticker := time.NewTicker(setting.GetRenewDuration())
 	for t := range ticker.C {
-		logrus.Infof("Tick at %s", t.String())
-		if err := c.rdnsClient.RenewDomain(); err != nil {
-			logrus.Errorf("Failed to renew domain: %v", err)
-			continue
+		log.Infof("Tick at %s", t.String())
+		rotated := false
+		for _, d := range c.domains {
+			if d.rdnsClient.Rotate() {
+				rotated = true
+			}
+			d.renew()
+		}
+		if rotated {
+			c.triggerRepublish()
 		}
 	}
 }
 
-func (c *RDNSController) getNginxControllerIPs() ([]string, error) {
-	var ips []string
-
-	options := metav1.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": podNginxControllerLabel}).String()}
-	pods, err := c.kubeClient.CoreV1().Pods(defaultNginxIngressNamespace).List(options)
-
-	if err != nil {
-		logrus.WithError(err).Error("syncing ingress rules to rdns server error")
-		return nil, err
-	}
-	for _, pod := range pods.Items {
-		ip, err := c.getNodePublicIP(pod.Spec.NodeName)
+// republish applies the current nginx controller hosts to every domain
+func (c *RDNSController) republish() {
+	for _, d := range c.domains {
+		hosts, err := c.getNginxControllerHosts(d)
 		if err != nil {
-			logrus.WithError(err).Errorf("get node %s public ip error", pod.Spec.NodeName)
+			log.Errorf("Failed to get nginx controller hosts: %v", err)
+			continue
+		}
+		if err := c.publish(d, hosts); err != nil {
+			log.WithFields(logrus.Fields{logging.FieldDomain: d.config.Name, logging.FieldOperation: "republish"}).Errorf("Failed to republish hosts: %v", err)
+		}
+	}
+}
+
+// publish applies the hosts to the domain, it is the only writer of the domain hosts. The
+// hosts which failed their probes and, when they are excluded, the private addresses are
+// dropped whichever watcher the hosts come from.
+func (c *RDNSController) publish(d *domainController, hosts []selector.Host) error {
+	var allowed []selector.Host
+	for _, h := range c.prober.Filter(hosts) {
+		if d.addresses.ExcludePrivate && address.IsPrivate(h.Address) {
+			log.WithField(logging.FieldDomain, d.config.Name).Debugf("Skip private address %s", h.Address)
 			continue
 		}
-		ips = append(ips, ip)
+		allowed = append(allowed, h)
 	}
-	return ips, nil
+	if len(allowed) == 0 {
+		return errors.Errorf("none of the %d candidate hosts can be published", len(hosts))
+	}
+	return d.rdnsClient.ApplyDomain(allowed)
 }
 
-func (c *RDNSController) getNodePublicIP(nodeName string) (string, error) {
-	node, err := c.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+// publishAddresses publishes the load balancer addresses of an ingress on the domain. An
+// address of a node is only kept while the node is schedulable, selected by the domain and
+// runs a ready nginx controller pod, the same as for the hosts published by republish.
+// Addresses which belong to no node, e.g. of a cloud load balancer, are kept.
+func (c *RDNSController) publishAddresses(d *domainController, addresses []string) error {
+	ready, err := c.getNginxControllerHosts(d)
 	if err != nil {
-		return "", err
+		return err
+	}
+	readyNodes := make(map[string]selector.Host, len(ready))
+	for _, h := range ready {
+		readyNodes[h.Node] = h
 	}
 
-	var ip string
-	for _, address := range node.Status.Addresses {
-		if address.Type == "ExternalIP" {
-			return address.Address, nil
+	nodes, err := c.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list the nodes")
+	}
+	owners := make(map[string]string)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		for _, a := range node.Status.Addresses {
+			owners[a.Address] = node.Name
 		}
-		if address.Type == "InternalIP" {
-			ip = address.Address
+		for _, ip := range d.addresses.NodeAddresses(node, selector.FamilyDual) {
+			owners[ip] = node.Name
 		}
 	}
 
-	//from annotation
-	if node.Annotations == nil {
-		node.Annotations = make(map[string]string)
+	var hosts []selector.Host
+	for _, a := range addresses {
+		node, ok := owners[a]
+		if !ok {
+			hosts = append(hosts, selector.Host{Address: a, Ready: true})
+			continue
+		}
+		h, ok := readyNodes[node]
+		if !ok {
+			log.WithField(logging.FieldDomain, d.config.Name).Debugf("Skip address %s of node %s which is not ready or runs no ready nginx controller", a, node)
+			continue
+		}
+		hosts = append(hosts, selector.Host{Address: a, Node: node, Zone: h.Zone, Ready: h.Ready})
 	}
+	return c.publish(d, hosts)
+}
+
+func (c *RDNSController) getCandidateHosts() []selector.Host {
+	var hosts []selector.Host
+	for _, d := range c.domains {
+		dh, err := c.getNginxControllerHosts(d)
+		if err != nil {
+			log.Errorf("Failed to get nginx controller hosts for probing: %v", err)
+		}
+		hosts = append(hosts, dh...)
+	}
+	return hosts
+}
+
+func (c *RDNSController) getNginxControllerHosts(d *domainController) ([]selector.Host, error) {
+	var hosts []selector.Host
+
+	options := metav1.ListOptions{LabelSelector: nginxControllerSelector()}
+	pods, err := c.kubeClient.CoreV1().Pods(defaultNginxIngressNamespace).List(options)
 
-	if ip, ok := node.Annotations[rkeExternalAddressAnnotation]; ok {
-		return ip, nil
+	if err != nil {
+		log.WithError(err).Error("Failed to list the nginx controller pods")
+		return nil, err
 	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isPodReady(pod) {
+			log.WithField(logging.FieldNamespace, pod.Namespace).Debugf("Skip nginx controller pod %s which is not ready", pod.Name)
+			continue
+		}
+		node, err := c.kubeClient.CoreV1().Nodes().Get(pod.Spec.NodeName, metav1.GetOptions{})
+		if err != nil {
+			log.WithError(err).Errorf("Failed to get node %s of nginx controller pod %s", pod.Spec.NodeName, pod.Name)
+			continue
+		}
+		if !isNodeSchedulable(node) {
+			log.Debugf("Skip node %s which is not ready or cordoned", node.Name)
+			continue
+		}
+		if !d.nodeSelector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		for _, ip := range d.addresses.NodeAddresses(node, setting.GetIPFamily()) {
+			hosts = append(hosts, selector.Host{
+				Address: ip,
+				Node:    node.Name,
+				Zone:    getNodeZone(node),
+				Ready:   isNodeReady(node),
+			})
+		}
+	}
+	return hosts, nil
+}
 
-	if ip, ok := node.Annotations[rkeInternalAddressAnnotation]; ok {
-		return ip, nil
+func getNodeZone(node *v1.Node) string {
+	if zone := node.Labels[topologyZoneLabel]; zone != "" {
+		return zone
 	}
+	return node.Labels[zoneLabel]
+}
 
-	return ip, nil
+func isNodeReady(node *v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
 }
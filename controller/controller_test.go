@@ -0,0 +1,305 @@
+package controller
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/rdns/fake"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newEnv(t *testing.T, values map[string]string) (*kubefake.Clientset, *fake.Server) {
+	t.Helper()
+	server := fake.NewServer()
+	base, err := server.Start("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	if values == nil {
+		values = map[string]string{}
+	}
+	// the fake server serves plain http on loopback
+	if _, ok := values["allow-insecure-token"]; !ok {
+		values["allow-insecure-token"] = "true"
+	}
+	values["base-rdns-url"] = base
+	if err := testutil.InitSettings(values); err != nil {
+		t.Fatal(err)
+	}
+	return testutil.NewClientset(), server
+}
+
+type testNode struct {
+	name        string
+	labels      map[string]string
+	annotations map[string]string
+	addresses   map[v1.NodeAddressType]string
+	notReady    bool
+	cordoned    bool
+	podNotReady bool
+}
+
+func (n testNode) add(t *testing.T, kube *kubefake.Clientset) {
+	t.Helper()
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: n.name, Labels: n.labels, Annotations: n.annotations},
+		Spec:       v1.NodeSpec{Unschedulable: n.cordoned},
+	}
+	ready := v1.ConditionTrue
+	if n.notReady {
+		ready = v1.ConditionFalse
+	}
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}}
+	for typ, address := range n.addresses {
+		node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: typ, Address: address})
+	}
+
+	podReady := v1.ConditionTrue
+	if n.podNotReady {
+		podReady = v1.ConditionFalse
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nginx-ingress-controller-" + n.name,
+			Namespace: defaultNginxIngressNamespace,
+			Labels:    map[string]string{"app": podNginxControllerLabel},
+		},
+		Spec: v1.PodSpec{NodeName: n.name},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: podReady}},
+		},
+	}
+	if _, err := kube.CoreV1().Nodes().Create(node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kube.CoreV1().Pods(pod.Namespace).Create(pod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetNginxControllerHosts(t *testing.T) {
+	tests := []struct {
+		name         string
+		values       map[string]string
+		nodeSelector map[string]string
+		nodes        []testNode
+		want         []string
+	}{
+		{
+			name: "external ip",
+			nodes: []testNode{{name: "n1", addresses: map[v1.NodeAddressType]string{
+				v1.NodeExternalIP: "1.1.1.1",
+				v1.NodeInternalIP: "10.0.0.1",
+			}}},
+			want: []string{"1.1.1.1"},
+		},
+		{
+			name:  "internal ip only",
+			nodes: []testNode{{name: "n1", addresses: map[v1.NodeAddressType]string{v1.NodeInternalIP: "10.0.0.1"}}},
+			want:  []string{"10.0.0.1"},
+		},
+		{
+			name: "rke annotation",
+			nodes: []testNode{{
+				name:        "n1",
+				annotations: map[string]string{"rke.cattle.io/external-ip": "2.2.2.2"},
+				addresses:   map[v1.NodeAddressType]string{v1.NodeInternalIP: "10.0.0.1"},
+			}},
+			want: []string{"2.2.2.2"},
+		},
+		{
+			name: "unready pods and nodes are skipped",
+			nodes: []testNode{
+				{name: "n1", addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "1.1.1.1"}},
+				{name: "n2", podNotReady: true, addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "2.2.2.2"}},
+				{name: "n3", notReady: true, addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "3.3.3.3"}},
+				{name: "n4", cordoned: true, addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "4.4.4.4"}},
+			},
+			want: []string{"1.1.1.1"},
+		},
+		{
+			name:         "node selector",
+			nodeSelector: map[string]string{"edge": "true"},
+			nodes: []testNode{
+				{name: "n1", labels: map[string]string{"edge": "true"}, addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "1.1.1.1"}},
+				{name: "n2", addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "2.2.2.2"}},
+			},
+			want: []string{"1.1.1.1"},
+		},
+		{
+			name:   "exclude private addresses",
+			values: map[string]string{"exclude-private-addresses": "true"},
+			nodes: []testNode{
+				{name: "n1", addresses: map[v1.NodeAddressType]string{v1.NodeInternalIP: "10.0.0.1"}},
+				{name: "n2", addresses: map[v1.NodeAddressType]string{v1.NodeInternalIP: "10.0.0.2", v1.NodeExternalIP: "2.2.2.2"}},
+			},
+			want: []string{"2.2.2.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube, _ := newEnv(t, tt.values)
+			for _, n := range tt.nodes {
+				n.add(t, kube)
+			}
+
+			c := NewRDNSController(kube)
+			d := c.domains[0]
+			if tt.nodeSelector != nil {
+				config := d.config
+				config.NodeSelector = tt.nodeSelector
+				d = c.newDomainController(config)
+			}
+			hosts, err := c.getNginxControllerHosts(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, h := range hosts {
+				got = append(got, h.Address)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartupCreatesDomain(t *testing.T) {
+	kube, server := newEnv(t, nil)
+	testNode{name: "n1", addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "1.1.1.1"}}.add(t, kube)
+
+	c := NewRDNSController(kube)
+	c.republish()
+
+	fqdn := c.RDNSClient().RootFqdn()
+	if fqdn == "" {
+		t.Fatal("no fqdn was saved after the domain was created")
+	}
+	d, ok := server.Domain(fqdn)
+	if !ok || len(d.Hosts) != 1 || d.Hosts[0] != "1.1.1.1" {
+		t.Fatalf("domain %s = %+v, want hosts [1.1.1.1]", fqdn, d)
+	}
+
+	// a restarted controller picks up the saved domain instead of creating another one
+	NewRDNSController(kube).republish()
+	if n := server.Requests(fake.OpCreate); n != 1 {
+		t.Fatalf("create requests = %d, want 1", n)
+	}
+}
+
+func TestRenewHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    int
+		wantErr bool
+	}{
+		{name: "renewed"},
+		{name: "renew failed", fail: http.StatusInternalServerError, wantErr: true},
+		{name: "token rejected", fail: http.StatusForbidden, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube, server := newEnv(t, nil)
+			testNode{name: "n1", addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "1.1.1.1"}}.add(t, kube)
+			c := NewRDNSController(kube)
+			c.republish()
+			if tt.fail != 0 {
+				server.Fail(fake.OpRenew, tt.fail, "renew failed", 1)
+			}
+
+			d := c.domains[0]
+			d.renew()
+			check := c.HealthChecks()[0]
+			if check.Name() != "rdns-domain-"+setting.GetDomains()[0].Name {
+				t.Fatalf("health check name = %s", check.Name())
+			}
+			if err := check.Check(nil); (err != nil) != tt.wantErr {
+				t.Fatalf("health check error = %v, want error %t", err, tt.wantErr)
+			}
+
+			// the next successful renewal clears the failure
+			d.renew()
+			if err := check.Check(nil); err != nil {
+				t.Fatalf("health check error = %v after a successful renewal", err)
+			}
+		})
+	}
+}
+
+func TestPublishAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    map[string]string
+		addresses []string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "ready node",
+			addresses: []string{"1.1.1.1"},
+			want:      []string{"1.1.1.1"},
+		},
+		{
+			name:      "internal address of a ready node",
+			addresses: []string{"10.0.0.1"},
+			want:      []string{"10.0.0.1"},
+		},
+		{
+			name:      "unready node and pod",
+			addresses: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+			want:      []string{"1.1.1.1"},
+		},
+		{
+			name:      "address of no node",
+			addresses: []string{"1.1.1.1", "8.8.8.8"},
+			want:      []string{"1.1.1.1", "8.8.8.8"},
+		},
+		{
+			name:      "private addresses",
+			values:    map[string]string{"exclude-private-addresses": "true"},
+			addresses: []string{"10.0.0.1", "1.1.1.1", "192.168.1.1"},
+			want:      []string{"1.1.1.1"},
+		},
+		{
+			name:      "nothing publishable",
+			addresses: []string{"2.2.2.2", "3.3.3.3"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube, server := newEnv(t, tt.values)
+			testNode{name: "n1", addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "1.1.1.1", v1.NodeInternalIP: "10.0.0.1"}}.add(t, kube)
+			testNode{name: "n2", notReady: true, addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "2.2.2.2"}}.add(t, kube)
+			testNode{name: "n3", podNotReady: true, addresses: map[v1.NodeAddressType]string{v1.NodeExternalIP: "3.3.3.3"}}.add(t, kube)
+
+			c := NewRDNSController(kube)
+			err := c.publishAddresses(c.domains[0], tt.addresses)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publishAddresses() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if n := server.Requests(fake.OpCreate); n != 0 {
+					t.Fatalf("%d domains were created without publishable hosts", n)
+				}
+				return
+			}
+			d, _ := server.Domain(c.RDNSClient().RootFqdn())
+			got := append([]string(nil), d.Hosts...)
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("domain hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
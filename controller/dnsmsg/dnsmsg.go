@@ -0,0 +1,169 @@
+package dnsmsg
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TypeA    = 1
+	TypeNS   = 2
+	TypeSOA  = 6
+	TypeTXT  = 16
+	TypeAAAA = 28
+	TypeOPT  = 41
+	TypeTSIG = 250
+	TypeANY  = 255
+
+	ClassIN   = 1
+	ClassNONE = 254
+	ClassANY  = 255
+
+	RcodeSuccess  = 0
+	RcodeFormErr  = 1
+	RcodeNXDomain = 3
+	RcodeNotImp   = 4
+	RcodeRefused  = 5
+	RcodeNotAuth  = 9
+
+	HeaderLen = 12
+)
+
+var rcodes = map[int]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+func RcodeName(rcode int) string {
+	if name, ok := rcodes[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// RR is a resource record with its rdata already encoded
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Rdata []byte
+}
+
+// Normalize returns the name lower cased and without the trailing dot
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// PackName encodes a domain name in the uncompressed wire format, names are lower cased
+// so they are in the canonical form required for the TSIG variables
+func PackName(name string) ([]byte, error) {
+	name = Normalize(name)
+	var buf []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.Errorf("invalid label in name %q", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	buf = append(buf, 0)
+	if len(buf) > 255 {
+		return nil, errors.Errorf("name %q is too long", name)
+	}
+	return buf, nil
+}
+
+// ReadName decodes the name at off, following compression pointers, and returns the offset after it
+func ReadName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errors.New("invalid name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("invalid name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = (l&0x3f)<<8 | int(msg[off+1])
+		case l&0xc0 != 0:
+			return "", 0, errors.New("invalid label type")
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("label overflows the message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func AppendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func AppendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func AppendRR(buf []byte, r RR) ([]byte, error) {
+	name, err := PackName(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, name...)
+	buf = AppendUint16(buf, r.Type)
+	buf = AppendUint16(buf, r.Class)
+	buf = AppendUint32(buf, r.TTL)
+	buf = AppendUint16(buf, uint16(len(r.Rdata)))
+	return append(buf, r.Rdata...), nil
+}
+
+// AddressRR returns an A or AAAA record depending on the family of the address
+func AddressRR(name, address string, ttl uint32) (RR, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return RR{}, errors.Errorf("invalid address %q", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return RR{Name: name, Type: TypeA, Class: ClassIN, TTL: ttl, Rdata: []byte(ip4)}, nil
+	}
+	return RR{Name: name, Type: TypeAAAA, Class: ClassIN, TTL: ttl, Rdata: []byte(ip.To16())}, nil
+}
+
+// TXTRdata splits the text in character strings of at most 255 bytes
+func TXTRdata(text string) []byte {
+	var rdata []byte
+	for len(text) > 255 {
+		rdata = append(rdata, 255)
+		rdata = append(rdata, text[:255]...)
+		text = text[255:]
+	}
+	rdata = append(rdata, byte(len(text)))
+	return append(rdata, text...)
+}
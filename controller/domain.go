@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/watch"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/server/healthz"
+)
+
+// domainController publishes the nginx controller hosts and the ingresses of one configured domain
+type domainController struct {
+	config       setting.DomainConfig
+	rdnsClient   rdns.Provider
+	ingRes       *watch.IngressResource
+	owners       *watch.HostnameOwners
+	addresses    *address.Resolver
+	nodeSelector labels.Selector
+
+	lock     sync.RWMutex
+	renewErr error
+}
+
+func (c *RDNSController) newDomainController(config setting.DomainConfig) *domainController {
+	// the sources have been validated when the settings were loaded
+	sources, _ := address.ParseSources(config.GetAddressSources())
+	d := &domainController{
+		config:     config,
+		rdnsClient: NewProvider(c.kubeClient, config),
+		addresses: &address.Resolver{
+			Sources:        sources,
+			ExcludePrivate: setting.IsExcludePrivateAddresses(),
+		},
+		nodeSelector: labels.SelectorFromSet(config.NodeSelector),
+		owners:       watch.NewHostnameOwners(),
+	}
+	publish := func(addresses []string) error {
+		return c.publishAddresses(d, addresses)
+	}
+	d.ingRes = watch.NewIngressResource(c.kubeClient, d.rdnsClient, publish, labels.SelectorFromSet(config.IngressSelector), d.owners)
+	// an empty selector matches every ingress, the domain only gets those no other domain selects
+	if len(config.IngressSelector) == 0 {
+		for _, other := range setting.GetDomains() {
+			if other.Name != config.Name && len(other.IngressSelector) > 0 {
+				d.ingRes.Exclude(labels.SelectorFromSet(other.IngressSelector))
+			}
+		}
+	}
+	return d
+}
+
+func (d *domainController) renew() {
+	start := time.Now()
+	err := d.rdnsClient.RenewDomain()
+	entry := log.WithFields(logrus.Fields{
+		logging.FieldDomain:    d.config.Name,
+		logging.FieldFqdn:      d.rdnsClient.RootFqdn(),
+		logging.FieldOperation: "renew",
+		logging.FieldDuration:  time.Since(start).String(),
+	})
+	if err != nil {
+		entry.WithField(logging.FieldStatus, "error").Errorf("Failed to renew domain: %v", err)
+	} else {
+		entry.WithField(logging.FieldStatus, "success").Info("Renewed domain")
+	}
+	d.lock.Lock()
+	d.renewErr = err
+	d.lock.Unlock()
+}
+
+// healthCheck fails while the last renewal of the domain has failed
+func (d *domainController) healthCheck() healthz.HealthzChecker {
+	return healthz.NamedCheck("rdns-domain-"+d.config.Name, func(_ *http.Request) error {
+		d.lock.RLock()
+		defer d.lock.RUnlock()
+		if d.renewErr != nil {
+			return errors.Wrapf(d.renewErr, "domain %s", d.config.Name)
+		}
+		return nil
+	})
+}
+
+// DomainState is the desired and observed state of one configured domain
+type DomainState struct {
+	Name     string             `json:"name"`
+	RootFqdn string             `json:"rootFqdn"`
+	Rdns     rdns.State         `json:"rdns"`
+	Ingress  watch.IngressState `json:"ingress"`
+}
+
+func (d *domainController) state() DomainState {
+	return DomainState{
+		Name:     d.config.Name,
+		RootFqdn: d.rdnsClient.RootFqdn(),
+		Rdns:     d.rdnsClient.State(),
+		Ingress:  d.ingRes.State(),
+	}
+}
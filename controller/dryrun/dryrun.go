@@ -0,0 +1,92 @@
+package dryrun
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.For("dryrun")
+
+const (
+	maxActions = 100
+)
+
+// Action is a mutating operation that was skipped because of dry-run mode
+type Action struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Target    string    `json:"target"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+var (
+	lock    sync.Mutex
+	actions []Action
+)
+
+// Record logs the action and keeps it for the dry-run HTTP endpoint
+func Record(a Action) {
+	a.Time = time.Now()
+	log.WithFields(logrus.Fields{
+		"target":  a.Target,
+		"added":   a.Added,
+		"removed": a.Removed,
+	}).Infof("[dry-run] would %s: %s", a.Operation, a.Message)
+
+	lock.Lock()
+	defer lock.Unlock()
+	actions = append(actions, a)
+	if len(actions) > maxActions {
+		actions = actions[len(actions)-maxActions:]
+	}
+}
+
+// Actions returns a copy of the recorded actions, oldest first
+func Actions() []Action {
+	lock.Lock()
+	defer lock.Unlock()
+	return append([]Action(nil), actions...)
+}
+
+// Handler serves the recorded actions as json
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Actions()); err != nil {
+			log.Errorf("Failed to encode dry-run actions: %v", err)
+		}
+	})
+}
+
+// Diff returns the entries which are only in after and only in before
+func Diff(before, after []string) (added, removed []string) {
+	in := func(list []string, s string) bool {
+		for _, l := range list {
+			if l == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range after {
+		if !in(before, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range before {
+		if !in(after, s) {
+			removed = append(removed, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
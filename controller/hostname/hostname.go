@@ -0,0 +1,136 @@
+package hostname
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	DefaultTemplate = "{{.Name}}.{{.Namespace}}"
+	// DefaultServiceTemplate keeps the services off the hostnames of the ingresses
+	DefaultServiceTemplate = "{{.Name}}.svc.{{.Namespace}}"
+	// DefaultRouteTemplate keeps the routes off the hostnames of the ingresses and services
+	DefaultRouteTemplate = "{{.Name}}.route.{{.Namespace}}"
+
+	maxLabelLength    = 63
+	maxHostnameLength = 253
+	hashLength        = 8
+)
+
+// Data is the input of the hostname template
+type Data struct {
+	Name      string
+	Namespace string
+	// Hash is a short hash of namespace/name which is stable for the object
+	Hash string
+}
+
+func NewData(name, namespace string) Data {
+	return Data{
+		Name:      name,
+		Namespace: namespace,
+		Hash:      shortHash(namespace + "/" + name),
+	}
+}
+
+// Validate returns an error if the template can not be parsed or does not render a name,
+// unknown fields are only reported when the template is executed
+func Validate(tmpl string) error {
+	_, err := Render(tmpl, NewData("name", "namespace"), "")
+	return err
+}
+
+// Render executes the template, sanitises the result into legal dns labels and
+// appends the root fqdn
+func Render(tmpl string, data Data, rootFqdn string) (string, error) {
+	t, err := template.New("hostname").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid hostname template %q", tmpl)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return "", errors.Wrapf(err, "failed to render hostname template %q", tmpl)
+	}
+
+	prefix := Sanitize(buf.String())
+	if prefix == "" {
+		return "", errors.Errorf("hostname template %q rendered an empty name for %s/%s", tmpl, data.Namespace, data.Name)
+	}
+	return Join(prefix, rootFqdn)
+}
+
+// Join appends the root fqdn to a sanitized name. A name which does not fit in 253 characters
+// under the root fqdn is truncated, like a long label, with a hash of the whole name appended.
+func Join(name, rootFqdn string) (string, error) {
+	max := maxHostnameLength
+	if rootFqdn != "" {
+		max -= len(rootFqdn) + 1
+	}
+	prefix := truncate(name, max)
+	if prefix == "" {
+		return "", errors.Errorf("root fqdn %s leaves no room for the hostname %s", rootFqdn, name)
+	}
+
+	hostname := prefix
+	if rootFqdn != "" {
+		hostname = prefix + "." + rootFqdn
+	}
+	if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+		return "", errors.Errorf("hostname %s is invalid: %s", hostname, strings.Join(errs, ", "))
+	}
+	return hostname, nil
+}
+
+// Sanitize lowercases the name, replaces illegal characters with '-' and truncates
+// every label longer than 63 characters, appending a hash of the original label. A name
+// longer than 253 characters is truncated the same way, with the hash as its last label.
+func Sanitize(name string) string {
+	var labels []string
+	for _, label := range strings.Split(strings.ToLower(name), ".") {
+		label = strings.Trim(strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+				return r
+			}
+			return '-'
+		}, label), "-")
+		if label == "" {
+			continue
+		}
+		if len(label) > maxLabelLength {
+			label = strings.TrimRight(label[:maxLabelLength-hashLength-1], "-") + "-" + shortHash(label)
+		}
+		labels = append(labels, label)
+	}
+	return truncate(strings.Join(labels, "."), maxHostnameLength)
+}
+
+// truncate shortens a name longer than max characters and appends a hash of the whole name
+// as a label, it returns an empty string if max leaves no room for the hash
+func truncate(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	if max < hashLength {
+		return ""
+	}
+	prefix := ""
+	if max > hashLength+1 {
+		prefix = strings.TrimRight(name[:max-hashLength-1], "-.")
+	}
+	if prefix == "" {
+		return shortHash(name)
+	}
+	return prefix + "." + shortHash(name)
+}
+
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:hashLength]
+}
@@ -0,0 +1,117 @@
+package hostname
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	// names of 305 and 304 characters, the second one has a dot where it is cut
+	longName := strings.TrimSuffix(strings.Repeat(strings.Repeat("n", 50)+".", 6), ".")
+	dotName := strings.TrimSuffix(strings.Repeat(strings.Repeat("d", 60)+".", 5), ".")
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "legal", in: "web.default", want: "web.default"},
+		{name: "uppercase", in: "Web.Default", want: "web.default"},
+		{name: "invalid characters", in: "my_app@v1.default", want: "my-app-v1.default"},
+		{name: "leading and trailing dashes", in: "-web-.default", want: "web.default"},
+		{name: "empty labels", in: "web..default.", want: "web.default"},
+		{name: "only invalid characters", in: "__", want: ""},
+		{name: "long label", in: long + ".default", want: strings.Repeat("a", 54) + "-" + shortHash(long) + ".default"},
+		{name: "long label ending with a dash", in: strings.Repeat("a", 53) + "-" + strings.Repeat("b", 20), want: strings.Repeat("a", 53) + "-" + shortHash(strings.Repeat("a", 53)+"-"+strings.Repeat("b", 20))},
+		{name: "long name", in: longName, want: longName[:244] + "." + shortHash(longName)},
+		{name: "long name cut after a dot", in: dotName, want: dotName[:243] + "." + shortHash(dotName)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sanitize(tt.in)
+			if got != tt.want {
+				t.Fatalf("Sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(got) > maxHostnameLength {
+				t.Fatalf("Sanitize(%q) = %q is longer than %d characters", tt.in, got, maxHostnameLength)
+			}
+			for _, label := range strings.Split(got, ".") {
+				if len(label) > maxLabelLength {
+					t.Fatalf("Sanitize(%q) label %q is longer than %d characters", tt.in, label, maxLabelLength)
+				}
+			}
+		})
+	}
+
+	// truncated labels of different names do not collide
+	if a, b := Sanitize(long+"x"), Sanitize(long+"y"); a == b {
+		t.Fatalf("Sanitize() = %q for two different long labels", a)
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := NewData("web", "default")
+	tests := []struct {
+		name     string
+		tmpl     string
+		data     Data
+		rootFqdn string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default template", tmpl: DefaultTemplate, data: data, rootFqdn: "abcd.lb.rancher.cloud", want: "web.default.abcd.lb.rancher.cloud"},
+		{name: "no root fqdn", tmpl: DefaultTemplate, data: data, want: "web.default"},
+		{name: "hash", tmpl: "{{.Hash}}", data: data, rootFqdn: "abcd.lb.rancher.cloud", want: shortHash("default/web") + ".abcd.lb.rancher.cloud"},
+		{name: "sanitized", tmpl: "{{.Name}}_{{.Namespace}}", data: NewData("Web", "kube_system"), want: "web-kube-system"},
+		{name: "long name", tmpl: DefaultTemplate, data: NewData(strings.Repeat("x", 100), "default"), want: strings.Repeat("x", 54) + "-" + shortHash(strings.Repeat("x", 100)) + ".default"},
+		{
+			name:     "long hostname",
+			tmpl:     "{{.Name}}.a.{{.Name}}.b.{{.Name}}",
+			data:     NewData(strings.Repeat("x", 60), "default"),
+			rootFqdn: strings.Repeat("r", 60) + "." + strings.Repeat("s", 20) + ".cloud",
+			want: strings.Repeat("x", 60) + ".a." + strings.Repeat("x", 60) + ".b." + strings.Repeat("x", 30) + "." +
+				shortHash(strings.Repeat("x", 60)+".a."+strings.Repeat("x", 60)+".b."+strings.Repeat("x", 60)) + "." +
+				strings.Repeat("r", 60) + "." + strings.Repeat("s", 20) + ".cloud",
+		},
+		{name: "root fqdn too long for a hostname", tmpl: DefaultTemplate, data: data, rootFqdn: strings.Repeat(strings.Repeat("r", 60)+".", 4) + "cloud", wantErr: true},
+		{name: "empty name", tmpl: "{{.Name}}", data: NewData("__", "default"), wantErr: true},
+		{name: "parse error", tmpl: "{{.Name", data: data, wantErr: true},
+		{name: "unknown field", tmpl: "{{.Namespce}}", data: data, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(tt.tmpl, tt.data, tt.rootFqdn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Render() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Render() = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxHostnameLength {
+				t.Fatalf("Render() = %q is longer than %d characters", got, maxHostnameLength)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		tmpl    string
+		wantErr bool
+	}{
+		{tmpl: DefaultTemplate},
+		{tmpl: "{{.Hash}}-{{.Name}}"},
+		{tmpl: "{{.Name", wantErr: true},
+		{tmpl: "{{.Namespce}}", wantErr: true},
+		{tmpl: "{{if}}", wantErr: true},
+		{tmpl: "", wantErr: true},
+		{tmpl: "__", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			if err := Validate(tt.tmpl); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate(%q) error = %v, want error %t", tt.tmpl, err, tt.wantErr)
+			}
+		})
+	}
+}
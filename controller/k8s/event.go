@@ -0,0 +1,47 @@
+package k8s
+
+import (
+	"fmt"
+	"time"
+
+	k8scorev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	eventComponent = "kube-rdns"
+)
+
+// RecordDomainEvent records an event against the secret which holds the rdns token and fqdn
+func RecordDomainEvent(client kubernetes.Interface, secretName, eventType, reason, messageFmt string, args ...interface{}) {
+	RecordEvent(client, k8scorev1.ObjectReference{
+		Kind:       "Secret",
+		APIVersion: "v1",
+		Name:       secretName,
+		Namespace:  metav1.NamespaceSystem,
+	}, eventType, reason, messageFmt, args...)
+}
+
+// RecordEvent records an event against the referenced object
+func RecordEvent(client kubernetes.Interface, ref k8scorev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	now := metav1.NewTime(time.Now())
+	message := fmt.Sprintf(messageFmt, args...)
+	_, err := client.CoreV1().Events(ref.Namespace).Create(&k8scorev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    ref.Namespace,
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         k8scorev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+	if err != nil {
+		log.Warnf("Warning: failed to record event %s on %s/%s: %s, err: %v", reason, ref.Namespace, ref.Name, message, err)
+	}
+}
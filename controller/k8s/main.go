@@ -1,42 +1,62 @@
 package k8s
 
 import (
+	"github.com/niusmallnan/kube-rdns/controller/logging"
 	"github.com/sirupsen/logrus"
 	k8scorev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
-const (
-	secretKey = "rdns-token"
-)
+var log = logging.For("k8s")
 
-func GetTokenAndRootFqdn(client *kubernetes.Clientset) (string, string) {
-	secret, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Get(secretKey, metav1.GetOptions{})
+func GetTokenAndRootFqdn(client kubernetes.Interface, secretName string) (string, string) {
+	secret, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Get(secretName, metav1.GetOptions{})
 	if err != nil {
-		logrus.Warnf("Warning: failed to get token and fqdn from secret, err: %v", err)
+		log.Warnf("Warning: failed to get token and fqdn from secret, err: %v", err)
 		return "", ""
 	}
 
 	return string(secret.Data["token"]), string(secret.Data["fqdn"])
 }
 
-func SaveTokenAndRootFqdn(client *kubernetes.Clientset, token, fqdn string) error {
+// GetBackend returns the rdns server endpoint which owns the domain saved in the secret
+func GetBackend(client kubernetes.Interface, secretName string) string {
+	secret, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+
+	return string(secret.Data["backend"])
+}
+
+func SaveTokenAndRootFqdn(client kubernetes.Interface, secretName, token, fqdn, backend string) error {
 	_, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Create(&k8scorev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretKey,
+			Name:      secretName,
 			Namespace: metav1.NamespaceSystem,
 		},
 		Type: k8scorev1.SecretTypeOpaque,
 		StringData: map[string]string{
-			"token": token,
-			"fqdn":  fqdn,
+			"token":   token,
+			"fqdn":    fqdn,
+			"backend": backend,
 		},
 	})
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"token": token,
-			"fqdn":  fqdn}).Fatal("Failed to save token and fqdn to secret, err: %v", err)
+		log.WithFields(logrus.Fields{
+			logging.FieldFqdn:    fqdn,
+			logging.FieldBackend: backend,
+		}).Fatalf("Failed to save token and fqdn to secret, err: %v", err)
+	}
+
+	return err
+}
+
+func DeleteTokenAndRootFqdn(client kubernetes.Interface, secretName string) error {
+	err := client.CoreV1().Secrets(metav1.NamespaceSystem).Delete(secretName, &metav1.DeleteOptions{})
+	if err != nil {
+		log.Errorf("Failed to delete token and fqdn secret, err: %v", err)
 	}
 
 	return err
@@ -0,0 +1,236 @@
+// Package logging keeps a logger per component whose level can be changed at runtime,
+// and redacts the secrets from every log entry.
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// the field names shared by the components, so entries can be filtered the same way everywhere
+	FieldComponent = "component"
+	FieldDomain    = "domain"
+	FieldFqdn      = "fqdn"
+	FieldIngress   = "ingress"
+	FieldService   = "service"
+	FieldNamespace = "namespace"
+	FieldOperation = "operation"
+	FieldDuration  = "duration"
+	FieldStatus    = "status"
+	FieldBackend   = "backend"
+	FieldHosts     = "hosts"
+
+	redacted = "[redacted]"
+)
+
+var (
+	lock      sync.RWMutex
+	loggers   = map[string]*logrus.Logger{}
+	overrides = map[string]bool{}
+
+	sensitiveKeys = []string{"token", "secret", "password", "authorization"}
+	sensitiveText = regexp.MustCompile(`(?i)((?:bearer\s+|token["']?\s*[:=]\s*["']?))[^\s"',}]+`)
+)
+
+func init() {
+	logrus.AddHook(redactHook{})
+}
+
+// For returns the logger of the component, it starts with the level and format of the standard logger
+func For(component string) *logrus.Logger {
+	lock.Lock()
+	defer lock.Unlock()
+	if l, ok := loggers[component]; ok {
+		return l
+	}
+	std := logrus.StandardLogger()
+	l := &logrus.Logger{
+		Out:       std.Out,
+		Formatter: std.Formatter,
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.GetLevel(),
+	}
+	l.AddHook(redactHook{})
+	l.AddHook(componentHook(component))
+	loggers[component] = l
+	return l
+}
+
+// SetFormat switches every logger to the text or json format
+func SetFormat(format string) error {
+	var formatter logrus.Formatter
+	switch format {
+	case FormatText:
+		formatter = &logrus.TextFormatter{}
+	case FormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return errors.Errorf("invalid log format %q, must be %s or %s", format, FormatText, FormatJSON)
+	}
+	logrus.SetFormatter(formatter)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, l := range loggers {
+		l.Formatter = formatter
+	}
+	return nil
+}
+
+// SetLevel sets the level of the standard logger and of the components without a level of their own
+func SetLevel(level logrus.Level) {
+	logrus.SetLevel(level)
+	lock.RLock()
+	defer lock.RUnlock()
+	for component, l := range loggers {
+		if !overrides[component] {
+			l.SetLevel(level)
+		}
+	}
+}
+
+// SetComponentLevel sets the level of one component, an empty level reverts it to the default level
+func SetComponentLevel(component, level string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	l, ok := loggers[component]
+	if !ok {
+		return errors.Errorf("unknown log component %q", component)
+	}
+	if level == "" {
+		delete(overrides, component)
+		l.SetLevel(logrus.GetLevel())
+		return nil
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	overrides[component] = true
+	l.SetLevel(lvl)
+	return nil
+}
+
+// Levels returns the level of every component, and the default level
+func Levels() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+	levels := map[string]string{"default": logrus.GetLevel().String()}
+	for component, l := range loggers {
+		levels[component] = level(l).String()
+	}
+	return levels
+}
+
+// level reads the level of l, which is set atomically by logrus
+func level(l *logrus.Logger) logrus.Level {
+	return logrus.Level(atomic.LoadUint32((*uint32)(&l.Level)))
+}
+
+// Handler returns the levels on GET, and sets a level on PUT with the level and the
+// component query parameters, the default level is set when the component is empty
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			component, level := r.URL.Query().Get("component"), r.URL.Query().Get("level")
+			var err error
+			if component == "" || component == "default" {
+				var lvl logrus.Level
+				if lvl, err = logrus.ParseLevel(level); err == nil {
+					SetLevel(lvl)
+				}
+			} else {
+				err = SetComponentLevel(component, level)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logrus.WithFields(logrus.Fields{FieldComponent: component, "level": level}).Info("Changed log level")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Levels()); err != nil {
+			logrus.Errorf("Failed to encode log levels: %v", err)
+		}
+	})
+}
+
+// Redact masks the bearer tokens and the token values in text
+func Redact(text string) string {
+	return sensitiveText.ReplaceAllString(text, "${1}"+redacted)
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHook masks the values of the sensitive fields and the secrets in the message
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	// the fields may be shared with other entries, they are copied rather than changed in place
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			if isSensitive(key) {
+				data[key] = redacted
+			} else {
+				data[key] = Redact(v)
+			}
+		case error:
+			data[key] = Redact(v.Error())
+		default:
+			if isSensitive(key) {
+				data[key] = redacted
+			} else {
+				data[key] = value
+			}
+		}
+	}
+	entry.Data = data
+	return nil
+}
+
+// componentHook adds the component field to the entries of a component logger
+type componentHook string
+
+func (componentHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h componentHook) Fire(entry *logrus.Entry) error {
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	data[FieldComponent] = string(h)
+	entry.Data = data
+	return nil
+}
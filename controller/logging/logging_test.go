@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "bearer", text: "Authorization: Bearer abc123", want: "Authorization: Bearer [redacted]"},
+		{name: "struct", text: "{Token:abc123 Fqdn:a.example.com}", want: "{Token:[redacted] Fqdn:a.example.com}"},
+		{name: "json", text: `{"token":"abc123","fqdn":"a.example.com"}`, want: `{"token":"[redacted]","fqdn":"a.example.com"}`},
+		{name: "assignment", text: "token=abc123 fqdn=a.example.com", want: "token=[redacted] fqdn=a.example.com"},
+		{name: "no secret", text: "failed to get token and fqdn", want: "failed to get token and fqdn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.text); got != tt.want {
+				t.Fatalf("Redact() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComponentLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := For("test")
+	l.Out = &out
+	if err := SetFormat(FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFormat(FormatText)
+
+	l.WithFields(logrus.Fields{
+		"token":   "abc123",
+		FieldFqdn: "a.example.com",
+		"error":   errors.New("request with Bearer abc123 failed"),
+	}).Info("Saved token=abc123")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry is not json: %v: %s", err, out.String())
+	}
+	if strings.Contains(out.String(), "abc123") {
+		t.Fatalf("log entry leaks the token: %s", out.String())
+	}
+	if entry[FieldComponent] != "test" || entry[FieldFqdn] != "a.example.com" {
+		t.Fatalf("log entry fields = %v", entry)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	For("test")
+	defer SetComponentLevel("test", "")
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+		want   string
+	}{
+		{name: "get", method: http.MethodGet, status: http.StatusOK, want: "info"},
+		{name: "set component", method: http.MethodPut, query: "?component=test&level=debug", status: http.StatusOK, want: "debug"},
+		{name: "unknown component", method: http.MethodPut, query: "?component=other&level=debug", status: http.StatusBadRequest},
+		{name: "invalid level", method: http.MethodPut, query: "?component=test&level=loud", status: http.StatusBadRequest},
+		{name: "reset component", method: http.MethodPut, query: "?component=test", status: http.StatusOK, want: "info"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Handler().ServeHTTP(w, httptest.NewRequest(tt.method, "/loglevel"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.want == "" {
+				return
+			}
+			var levels map[string]string
+			if err := json.NewDecoder(w.Body).Decode(&levels); err != nil {
+				t.Fatal(err)
+			}
+			if levels["test"] != tt.want {
+				t.Fatalf("level = %s, want %s", levels["test"], tt.want)
+			}
+		})
+	}
+}
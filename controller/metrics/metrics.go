@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	typeGauge   = "gauge"
+	typeCounter = "counter"
+)
+
+type family struct {
+	help    string
+	kind    string
+	samples map[string]float64
+}
+
+var (
+	lock     sync.Mutex
+	families = make(map[string]*family)
+)
+
+// SetGauge sets the value of the gauge with the given labels
+func SetGauge(name, help string, labels map[string]string, value float64) {
+	lock.Lock()
+	defer lock.Unlock()
+	getFamily(name, help, typeGauge).samples[formatLabels(labels)] = value
+}
+
+// AddCounter adds delta to the counter with the given labels
+func AddCounter(name, help string, labels map[string]string, delta float64) {
+	lock.Lock()
+	defer lock.Unlock()
+	getFamily(name, help, typeCounter).samples[formatLabels(labels)] += delta
+}
+
+// Delete removes the sample with the given labels
+func Delete(name string, labels map[string]string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if f, ok := families[name]; ok {
+		delete(f.samples, formatLabels(labels))
+	}
+}
+
+func getFamily(name, help, kind string) *family {
+	f, ok := families[name]
+	if !ok {
+		f = &family{help: help, kind: kind, samples: make(map[string]float64)}
+		families[name] = f
+	}
+	return f
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		names := make([]string, 0, len(families))
+		for name := range families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := families[name]
+			fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+			labels := make([]string, 0, len(f.samples))
+			for l := range f.samples {
+				labels = append(labels, l)
+			}
+			sort.Strings(labels)
+			for _, l := range labels {
+				fmt.Fprintf(w, "%s%s %g\n", name, l, f.samples[l])
+			}
+		}
+	})
+}
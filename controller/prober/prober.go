@@ -0,0 +1,268 @@
+package prober
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/metrics"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+)
+
+var log = logging.For("prober")
+
+const (
+	ModeNone = ""
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+
+	metricHealthy  = "kube_rdns_probe_healthy"
+	metricFailures = "kube_rdns_probe_consecutive_failures"
+)
+
+// Config controls how the candidate addresses are probed
+type Config struct {
+	Mode             string
+	Port             int
+	Path             string
+	HostHeader       string
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+}
+
+// Result is the outcome of the probes against one address
+type Result struct {
+	Address             string    `json:"address"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastProbe           time.Time `json:"lastProbe"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+// Prober periodically probes the candidate addresses and withholds the failing ones
+type Prober struct {
+	config     Config
+	httpClient *http.Client
+
+	lock    sync.RWMutex
+	results map[string]*Result
+}
+
+// ConfigFromSettings returns the config of the probe flags
+func ConfigFromSettings() Config {
+	return Config{
+		Mode:             setting.GetProbeMode(),
+		Port:             setting.GetProbePort(),
+		Path:             setting.GetProbePath(),
+		HostHeader:       setting.GetProbeHostHeader(),
+		Interval:         setting.GetProbeInterval(),
+		Timeout:          setting.GetProbeTimeout(),
+		FailureThreshold: setting.GetProbeFailureThreshold(),
+	}
+}
+
+// Validate returns an error if the probe mode is not supported, or if probing is enabled
+// with an interval, timeout, threshold or port the probes can not run with
+func Validate(cfg Config) error {
+	switch cfg.Mode {
+	case ModeNone:
+		return nil
+	case ModeTCP, ModeHTTP:
+	default:
+		return errors.Errorf("unknown probe mode %q, must be one of %s, %s", cfg.Mode, ModeTCP, ModeHTTP)
+	}
+	if cfg.Interval <= 0 {
+		return errors.Errorf("invalid probe interval %s, must be positive", cfg.Interval)
+	}
+	if cfg.Timeout <= 0 {
+		return errors.Errorf("invalid probe timeout %s, must be positive", cfg.Timeout)
+	}
+	if cfg.FailureThreshold < 1 {
+		return errors.Errorf("invalid probe failure threshold %d, must be at least 1", cfg.FailureThreshold)
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return errors.Errorf("invalid probe port %d", cfg.Port)
+	}
+	return nil
+}
+
+func New(config Config) *Prober {
+	return &Prober{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: config.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		results: make(map[string]*Result),
+	}
+}
+
+func (p *Prober) Enabled() bool {
+	return p.config.Mode != ModeNone
+}
+
+// Filter drops the hosts which have failed the configured number of consecutive probes,
+// hosts which have not been probed yet are kept
+func (p *Prober) Filter(hosts []selector.Host) []selector.Host {
+	if !p.Enabled() {
+		return hosts
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var healthy []selector.Host
+	for _, h := range hosts {
+		if r, ok := p.results[h.Address]; ok && !r.Healthy {
+			log.Debugf("Withhold host %s which failed %d probes: %s", h.Address, r.ConsecutiveFailures, r.LastError)
+			continue
+		}
+		healthy = append(healthy, h)
+	}
+	return healthy
+}
+
+// Results returns the latest probe result of every address, sorted by address
+func (p *Prober) Results() []Result {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	results := make([]Result, 0, len(p.results))
+	for _, r := range p.results {
+		results = append(results, *r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Address < results[j].Address })
+	return results
+}
+
+// Run probes the candidates every interval and calls onChange when an address changes health
+func (p *Prober) Run(candidates func() []selector.Host, onChange func(), stop <-chan struct{}) {
+	if !p.Enabled() {
+		return
+	}
+	log.Infof("Running %s prober with interval: %s", p.config.Mode, p.config.Interval)
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		if p.probeAll(candidates()) {
+			onChange()
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probeAll probes the hosts concurrently, so a slow host only delays the round by the
+// probe timeout, and returns whether any address changed health
+func (p *Prober) probeAll(hosts []selector.Host) bool {
+	current := make(map[string]bool, len(hosts))
+	var (
+		wg      sync.WaitGroup
+		changed int32
+	)
+	for _, h := range hosts {
+		if h.Address == "" || current[h.Address] {
+			continue
+		}
+		current[h.Address] = true
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if p.record(address, p.probe(address)) {
+				atomic.StoreInt32(&changed, 1)
+			}
+		}(h.Address)
+	}
+	wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for address := range p.results {
+		if !current[address] {
+			delete(p.results, address)
+			metrics.Delete(metricHealthy, map[string]string{"address": address})
+			metrics.Delete(metricFailures, map[string]string{"address": address})
+		}
+	}
+	return atomic.LoadInt32(&changed) == 1
+}
+
+func (p *Prober) record(address string, err error) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	r, ok := p.results[address]
+	if !ok {
+		r = &Result{Address: address, Healthy: true}
+		p.results[address] = r
+	}
+	wasHealthy := r.Healthy
+	r.LastProbe = time.Now()
+	if err != nil {
+		r.ConsecutiveFailures++
+		r.LastError = err.Error()
+		if r.ConsecutiveFailures >= p.config.FailureThreshold {
+			r.Healthy = false
+		}
+	} else {
+		r.ConsecutiveFailures = 0
+		r.LastError = ""
+		r.Healthy = true
+	}
+
+	healthy := 0.0
+	if r.Healthy {
+		healthy = 1
+	}
+	labels := map[string]string{"address": address}
+	metrics.SetGauge(metricHealthy, "Whether the address passes the probes.", labels, healthy)
+	metrics.SetGauge(metricFailures, "Consecutive failed probes of the address.", labels, float64(r.ConsecutiveFailures))
+
+	if wasHealthy != r.Healthy {
+		log.Infof("Probed address %s changed health to %t", address, r.Healthy)
+		return true
+	}
+	return false
+}
+
+func (p *Prober) probe(address string) error {
+	hostPort := net.JoinHostPort(address, strconv.Itoa(p.config.Port))
+	switch p.config.Mode {
+	case ModeTCP:
+		conn, err := net.DialTimeout("tcp", hostPort, p.config.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case ModeHTTP:
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", hostPort, p.config.Path), nil)
+		if err != nil {
+			return err
+		}
+		if p.config.HostHeader != "" {
+			req.Host = p.config.HostHeader
+		}
+		resp, err := p.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return errors.Errorf("got status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return nil
+}
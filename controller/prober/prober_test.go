@@ -0,0 +1,204 @@
+package prober
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+)
+
+const loopback = "127.0.0.1"
+
+func port(t *testing.T, addr string) int {
+	t.Helper()
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// closedPort returns a loopback port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", loopback+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := port(t, l.Addr().String())
+	l.Close()
+	return p
+}
+
+func newConfig(mode string, port int) Config {
+	return Config{
+		Mode:             mode,
+		Port:             port,
+		Path:             "/healthz",
+		Interval:         time.Second,
+		Timeout:          time.Second,
+		FailureThreshold: 2,
+	}
+}
+
+func TestProbe(t *testing.T) {
+	l, err := net.Listen("tcp", loopback+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		switch r.URL.Path {
+		case "/healthz":
+		case "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		mode       string
+		port       int
+		path       string
+		hostHeader string
+		wantErr    bool
+	}{
+		{name: "tcp open", mode: ModeTCP, port: port(t, l.Addr().String())},
+		{name: "tcp closed", mode: ModeTCP, port: closedPort(t), wantErr: true},
+		{name: "http ok", mode: ModeHTTP, port: port(t, server.Listener.Addr().String()), path: "/healthz"},
+		{name: "http host header", mode: ModeHTTP, port: port(t, server.Listener.Addr().String()), path: "/healthz", hostHeader: "web.example.com"},
+		// the backend answers, only server errors mean the host is unhealthy
+		{name: "http redirect", mode: ModeHTTP, port: port(t, server.Listener.Addr().String()), path: "/redirect"},
+		{name: "http not found", mode: ModeHTTP, port: port(t, server.Listener.Addr().String()), path: "/missing"},
+		{name: "http server error", mode: ModeHTTP, port: port(t, server.Listener.Addr().String()), path: "/unavailable", wantErr: true},
+		{name: "http closed", mode: ModeHTTP, port: closedPort(t), path: "/healthz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newConfig(tt.mode, tt.port)
+			config.Path = tt.path
+			config.HostHeader = tt.hostHeader
+			err := New(config).probe(loopback)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probe() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.hostHeader != "" && host != tt.hostHeader {
+				t.Fatalf("host header = %q, want %q", host, tt.hostHeader)
+			}
+		})
+	}
+}
+
+func TestWithholdAndRestore(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	p := New(newConfig(ModeHTTP, port(t, server.Listener.Addr().String())))
+	hosts := []selector.Host{{Address: loopback, Ready: true}}
+	published := func() bool {
+		return len(p.Filter(hosts)) == 1
+	}
+
+	if !published() {
+		t.Fatal("a host which has not been probed yet is withheld")
+	}
+	if changed := p.probeAll(hosts); changed || !published() {
+		t.Fatalf("healthy host: changed = %t, published = %t", changed, published())
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	if changed := p.probeAll(hosts); changed || !published() {
+		t.Fatalf("host below the failure threshold: changed = %t, published = %t", changed, published())
+	}
+	if changed := p.probeAll(hosts); !changed || published() {
+		t.Fatalf("host at the failure threshold: changed = %t, published = %t", changed, published())
+	}
+	if r := p.Results(); len(r) != 1 || r[0].Healthy || r[0].ConsecutiveFailures != 2 || r[0].LastError == "" {
+		t.Fatalf("results = %+v", r)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	if changed := p.probeAll(hosts); !changed || !published() {
+		t.Fatalf("recovered host: changed = %t, published = %t", changed, published())
+	}
+
+	// hosts which are no longer candidates are forgotten
+	p.probeAll(nil)
+	if r := p.Results(); len(r) != 0 {
+		t.Fatalf("results = %+v, want none", r)
+	}
+}
+
+func TestProbeAllConcurrently(t *testing.T) {
+	// a listener which never accepts keeps the http probes waiting until the timeout
+	l, err := net.Listen("tcp", loopback+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := newConfig(ModeHTTP, port(t, l.Addr().String()))
+	config.Timeout = 200 * time.Millisecond
+	p := New(config)
+	var hosts []selector.Host
+	for i := 1; i <= 5; i++ {
+		hosts = append(hosts, selector.Host{Address: "127.0.0." + strconv.Itoa(i)})
+	}
+
+	start := time.Now()
+	p.probeAll(hosts)
+	if elapsed := time.Since(start); elapsed > 3*config.Timeout {
+		t.Fatalf("probing %d slow hosts took %s, want about one timeout of %s", len(hosts), elapsed, config.Timeout)
+	}
+	if r := p.Results(); len(r) != len(hosts) {
+		t.Fatalf("results = %+v", r)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "disabled", modify: func(c *Config) { *c = Config{} }},
+		{name: "unknown mode", modify: func(c *Config) { c.Mode = "icmp" }, wantErr: true},
+		{name: "zero interval", modify: func(c *Config) { c.Interval = 0 }, wantErr: true},
+		{name: "negative interval", modify: func(c *Config) { c.Interval = -time.Second }, wantErr: true},
+		{name: "zero timeout", modify: func(c *Config) { c.Timeout = 0 }, wantErr: true},
+		{name: "zero threshold", modify: func(c *Config) { c.FailureThreshold = 0 }, wantErr: true},
+		{name: "invalid port", modify: func(c *Config) { c.Port = 70000 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newConfig(ModeTCP, 80)
+			tt.modify(&config)
+			if err := Validate(config); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
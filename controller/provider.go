@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/responder"
+	"github.com/niusmallnan/kube-rdns/controller/rfc2136"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	ProviderRdns      = "rdns"
+	ProviderRFC2136   = "rfc2136"
+	ProviderResponder = "responder"
+)
+
+// ValidateProvider checks the provider of the domain can be built
+func ValidateProvider(config setting.DomainConfig) error {
+	switch config.GetProvider() {
+	case ProviderRdns:
+		return nil
+	case ProviderRFC2136:
+		return rfc2136.Validate(rfc2136.ConfigFromSettings(), config.DesiredFqdn)
+	case ProviderResponder:
+		return responder.Validate(responder.ConfigFromSettings(), config.DesiredFqdn)
+	}
+	return errors.Errorf("invalid provider %q, must be %s, %s or %s", config.GetProvider(), ProviderRdns, ProviderRFC2136, ProviderResponder)
+}
+
+// SupportsRecords reports whether the provider of the domain publishes records by name, the
+// rdns server only publishes the hosts of the domain and its wildcard
+func SupportsRecords(config setting.DomainConfig) bool {
+	return config.GetProvider() != ProviderRdns
+}
+
+// NewProvider returns the provider which publishes the domain
+func NewProvider(kubeClient kubernetes.Interface, config setting.DomainConfig) rdns.Provider {
+	switch config.GetProvider() {
+	case ProviderRFC2136:
+		return rfc2136.New(rfc2136.ConfigFromSettings(), config)
+	case ProviderResponder:
+		return responder.New(responder.ConfigFromSettings(), config)
+	}
+	return rdns.NewClient(kubeClient, config)
+}
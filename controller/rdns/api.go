@@ -9,20 +9,34 @@ import (
 	"net/http"
 	"reflect"
 	"sort"
+	"sync"
 	"time"
 
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
 	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/metrics"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
 	"github.com/niusmallnan/kube-rdns/setting"
 	"github.com/niusmallnan/rdns-server/model"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	k8scorev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+var log = logging.For("rdns")
+
 const (
 	contentType     = "Content-Type"
 	jsonContentType = "application/json"
-	maxHost         = 10
+
+	metricHosts      = "kube_rdns_domain_hosts"
+	metricExpiration = "kube_rdns_domain_expiration_timestamp_seconds"
+	metricRenew      = "kube_rdns_domain_renew_total"
+
+	// dryRunPrefix names the placeholder root fqdn of a domain which dry-run did not create
+	dryRunPrefix = "dry-run"
 )
 
 func jsonBody(payload interface{}) (io.Reader, error) {
@@ -36,8 +50,85 @@ func jsonBody(payload interface{}) (io.Reader, error) {
 
 type Client struct {
 	httpClient *http.Client
-	kubeClient *kubernetes.Clientset
-	base       string
+	kubeClient kubernetes.Interface
+	backends   *backends
+	selector   *selector.Selector
+	domain     setting.DomainConfig
+
+	lock       sync.RWMutex
+	lastHosts  []string
+	lastDomain *model.Domain
+}
+
+// State is the last state pushed to and observed from the rdns server
+type State struct {
+	LastHosts  []string       `json:"lastHosts"`
+	LastDomain *model.Domain  `json:"lastDomain"`
+	Backend    string         `json:"backend"`
+	Backends   []BackendState `json:"backends"`
+}
+
+func (c *Client) State() State {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return State{
+		LastHosts:  append([]string(nil), c.lastHosts...),
+		LastDomain: c.lastDomain,
+		Backend:    c.owner(),
+		Backends:   c.backends.state(),
+	}
+}
+
+// Name returns the name of the configured domain the client operates on
+func (c *Client) Name() string {
+	return c.domain.Name
+}
+
+// RootFqdn returns the saved fqdn of the domain, empty until the domain is created.
+// In dry-run the domain is never created, the desired fqdn or a placeholder under the
+// root domain is returned so the hostnames can still be rendered.
+func (c *Client) RootFqdn() string {
+	_, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient, c.domain.Secret)
+	if fqdn == "" && setting.IsDryRun() {
+		if c.domain.DesiredFqdn != "" {
+			return c.domain.DesiredFqdn
+		}
+		return fmt.Sprintf("%s.%s", dryRunPrefix, setting.GetRootDomain())
+	}
+	return fqdn
+}
+
+// owner returns the rdns server endpoint which owns the domain, updates and renewals
+// must go to it because the other endpoints do not know the domain
+func (c *Client) owner() string {
+	if base := k8s.GetBackend(c.kubeClient, c.domain.Secret); base != "" {
+		return base
+	}
+	return c.backends.primary()
+}
+
+func (c *Client) observe(d model.Domain, pushed []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	labels := map[string]string{"domain": c.domain.Name}
+	if d.Fqdn != "" {
+		c.lastDomain = &d
+		if d.Expiration != nil {
+			metrics.SetGauge(metricExpiration, "Expiration of the domain as a unix timestamp.", labels, float64(d.Expiration.Unix()))
+		}
+	}
+	if pushed != nil {
+		c.lastHosts = append([]string(nil), pushed...)
+		metrics.SetGauge(metricHosts, "Number of hosts published for the domain.", labels, float64(len(pushed)))
+	}
+}
+
+func (c *Client) countRenew(err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.AddCounter(metricRenew, "Domain renewals by result.", map[string]string{"domain": c.domain.Name, "result": result}, 1)
 }
 
 func (c *Client) request(method string, url string, body io.Reader) (*http.Request, error) {
@@ -50,47 +141,81 @@ func (c *Client) request(method string, url string, body io.Reader) (*http.Reque
 	return req, nil
 }
 
-func (c *Client) do(req *http.Request) (model.Response, error) {
+// do executes a request of the operation on the domain fqdn, the response is not logged
+// because it carries the token of created domains
+func (c *Client) do(op, fqdn string, req *http.Request) (model.Response, error) {
 	var data model.Response
+	base := c.backends.match(req.URL.String())
+	fields := logrus.Fields{
+		logging.FieldOperation: op,
+		logging.FieldFqdn:      fqdn,
+		logging.FieldBackend:   base,
+	}
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
+	fields[logging.FieldDuration] = time.Since(start).String()
 	if err != nil {
-		return data, err
+		log.WithFields(fields).Debugf("Rdns request failed: %v", err)
+		c.backends.markFailed(base, err)
+		return data, &unavailableError{base: base, err: err}
 	}
 	// when err is nil, resp contains a non-nil resp.Body which must be closed
 	defer resp.Body.Close()
+	fields[logging.FieldStatus] = resp.StatusCode
+	log.WithFields(fields).Debug("Rdns request completed")
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return data, errors.Wrap(err, "Read response body error")
+		c.backends.markFailed(base, err)
+		return data, &unavailableError{base: base, err: errors.Wrap(err, "Read response body error")}
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		err = errors.Errorf("Got server error: %s", resp.Status)
+		c.backends.markFailed(base, err)
+		return data, &unavailableError{base: base, err: err}
+	}
+	c.backends.markOK(base)
+
+	if code := resp.StatusCode; code < 200 || code >= 300 {
+		// the body of an error is not necessarily a response, the status is enough to fail
+		if json.Unmarshal(body, &data) == nil && data.Message != "" {
+			return data, errors.Errorf("Got request error: %s: %s", resp.Status, data.Message)
+		}
+		return data, errors.Errorf("Got request error: %s", resp.Status)
 	}
 
 	err = json.Unmarshal(body, &data)
 	if err != nil {
 		return data, errors.Wrap(err, "Decode response error")
 	}
-	logrus.Infof("Got response entry: %+v", data)
-	if code := resp.StatusCode; code < 200 || code > 300 {
-		if data.Message != "" {
-			return data, errors.Errorf("Got request error: %s", data.Message)
-		}
-	}
-
 	return data, nil
 }
 
-func (c *Client) ApplyDomain(hosts []string) error {
-	if len(hosts) == 0 {
-		return errors.New("ApplyDomain: hosts should not be empty")
+// Rotate advances the host selection for policies which rotate across renewals
+func (c *Client) Rotate() bool {
+	return c.selector.Rotate()
+}
+
+// seed keeps the hash selection stable across the creation of the domain, unlike the saved
+// fqdn which is empty until then
+func (c *Client) seed() string {
+	if c.domain.DesiredFqdn != "" {
+		return c.domain.DesiredFqdn
 	}
+	return setting.GetRootDomain()
+}
 
-	if len(hosts) > maxHost {
-		logrus.Debugf("hosts number is %d, over %d", len(hosts), maxHost)
-		hosts = hosts[:maxHost]
+func (c *Client) ApplyDomain(candidates []selector.Host) error {
+	if len(candidates) == 0 {
+		return errors.New("ApplyDomain: hosts should not be empty")
 	}
 
-	token, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient)
+	token, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient, c.domain.Secret)
+	hosts := c.selector.Select(candidates, c.seed())
+	log.WithFields(logrus.Fields{logging.FieldFqdn: fqdn, logging.FieldHosts: hosts}).Debugf("Selected hosts out of %d candidates with policy %s", len(candidates), setting.GetHostPolicy())
+
 	if fqdn == "" || token == "" {
-		logrus.Debugf("Fqdn for %s has not been exist, need to create a new one", hosts)
+		log.WithField(logging.FieldHosts, hosts).Debug("Domain does not exist yet, create a new one")
 		return c.createDomain(hosts)
 
 	}
@@ -102,53 +227,101 @@ func (c *Client) ApplyDomain(hosts []string) error {
 	sort.Strings(d.Hosts)
 	sort.Strings(hosts)
 	if !reflect.DeepEqual(d.Hosts, hosts) {
-		logrus.Debugf("Fqdn %s has some changes, need to update", fqdn)
+		log.WithField(logging.FieldFqdn, fqdn).Debug("Domain hosts changed, update the domain")
+		if setting.IsDryRun() {
+			added, removed := dryrun.Diff(d.Hosts, hosts)
+			dryrun.Record(dryrun.Action{Operation: "update domain", Target: fqdn, Added: added, Removed: removed, Message: fmt.Sprintf("set hosts to %s", hosts)})
+			return nil
+		}
 		return c.updateDomain(token, fqdn, hosts)
 	}
-	logrus.Debugf("Fqdn %s has no changes, no need to update", fqdn)
+	log.WithField(logging.FieldFqdn, fqdn).Debug("Domain hosts unchanged")
 
 	return nil
 }
 
 func (c *Client) getDomain(fqdn string) (d model.Domain, err error) {
-	url := fmt.Sprintf("%s/domain/%s", c.base, fqdn)
+	url := fmt.Sprintf("%s/domain/%s", c.owner(), fqdn)
 	req, err := c.request(http.MethodGet, url, nil)
 	if err != nil {
 		return d, errors.Wrap(err, "getDomain: failed to build a request")
 	}
 
-	o, err := c.do(req)
+	o, err := c.do("get", fqdn, req)
 	if err != nil {
 		return d, errors.Wrap(err, "getDomain: failed to execute a request")
 	}
+	c.observe(o.Data, nil)
 
 	return o.Data, nil
 }
 
 func (c *Client) createDomain(hosts []string) error {
-	url := fmt.Sprintf("%s/domain", c.base)
-	body, err := jsonBody(&model.DomainOptions{Hosts: hosts})
-	if err != nil {
-		return err
+	desired := c.domain.DesiredFqdn
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: "create domain", Target: desired, Added: hosts, Message: fmt.Sprintf("create domain with hosts %s", hosts)})
+		return nil
 	}
 
-	req, err := c.request(http.MethodPost, url, body)
-	if err != nil {
-		return errors.Wrap(err, "createDomain: failed to build a request")
-	}
+	var (
+		base string
+		rep  model.Response
+		err  error
+	)
+	// a new domain can be created on any endpoint, move on to the next one while they are unavailable
+	for _, base = range c.backends.candidates() {
+		var body io.Reader
+		body, err = jsonBody(&model.DomainOptions{Fqdn: desired, Hosts: hosts})
+		if err != nil {
+			return err
+		}
+
+		var req *http.Request
+		req, err = c.request(http.MethodPost, fmt.Sprintf("%s/domain", base), body)
+		if err != nil {
+			return errors.Wrap(err, "createDomain: failed to build a request")
+		}
 
-	rep, err := c.do(req)
+		rep, err = c.do("create", desired, req)
+		if !isUnavailable(err) {
+			break
+		}
+	}
 	if err != nil {
+		if desired != "" {
+			k8s.RecordDomainEvent(c.kubeClient, c.domain.Secret, k8scorev1.EventTypeWarning, "DomainCreateFailed", "Failed to create domain %s: %v", desired, err)
+			return errors.Wrapf(err, "createDomain: server rejected desired fqdn %s", desired)
+		}
+		k8s.RecordDomainEvent(c.kubeClient, c.domain.Secret, k8scorev1.EventTypeWarning, "DomainCreateFailed", "Failed to create domain: %v", err)
 		return errors.Wrap(err, "createDomain: failed to execute a request")
 	}
+	if rep.Data.Fqdn == "" {
+		return errors.New("createDomain: server returned an empty fqdn")
+	}
 
-	k8s.SaveTokenAndRootFqdn(c.kubeClient, rep.Token, rep.Data.Fqdn)
+	c.observe(rep.Data, hosts)
 
-	return err
+	// the server has created the domain even if it reassigned the name, keep the token so it is not orphaned
+	k8s.SaveTokenAndRootFqdn(c.kubeClient, c.domain.Secret, rep.Token, rep.Data.Fqdn, base)
+
+	if desired != "" && rep.Data.Fqdn != desired {
+		log.WithField(logging.FieldFqdn, rep.Data.Fqdn).Warnf("Requested fqdn %s but the server assigned another one", desired)
+		k8s.RecordDomainEvent(c.kubeClient, c.domain.Secret, k8scorev1.EventTypeWarning, "FqdnReassigned", "Requested fqdn %s but the server assigned %s", desired, rep.Data.Fqdn)
+		return errors.Errorf("createDomain: requested fqdn %s but the server assigned %s", desired, rep.Data.Fqdn)
+	}
+
+	log.WithFields(logrus.Fields{
+		logging.FieldFqdn:    rep.Data.Fqdn,
+		logging.FieldHosts:   hosts,
+		logging.FieldBackend: base,
+	}).Info("Created domain")
+	k8s.RecordDomainEvent(c.kubeClient, c.domain.Secret, k8scorev1.EventTypeNormal, "DomainCreated", "Created domain %s", rep.Data.Fqdn)
+
+	return nil
 }
 
 func (c *Client) updateDomain(token, fqdn string, hosts []string) error {
-	url := fmt.Sprintf("%s/domain/%s", c.base, fqdn)
+	url := fmt.Sprintf("%s/domain/%s", c.owner(), fqdn)
 	body, err := jsonBody(&model.DomainOptions{Hosts: hosts})
 	if err != nil {
 		return err
@@ -159,44 +332,105 @@ func (c *Client) updateDomain(token, fqdn string, hosts []string) error {
 		return errors.Wrap(err, "updateDomain: failed to build a request")
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if err := authorize(req, token); err != nil {
+		return errors.Wrap(err, "updateDomain")
+	}
 
-	_, err = c.do(req)
+	rep, err := c.do("update", fqdn, req)
 	if err != nil {
 		return errors.Wrap(err, "updateDomain: failed to execute a request")
 	}
+	c.observe(rep.Data, hosts)
 
 	return err
 }
 
 func (c *Client) RenewDomain() error {
-	token, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient)
+	token, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient, c.domain.Secret)
 	if token == "" || fqdn == "" {
 		return errors.New("RenewDomain: failed to get token and fqdn")
 	}
 
-	url := fmt.Sprintf("%s/domain/%s/renew", c.base, fqdn)
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: "renew domain", Target: fqdn})
+		return nil
+	}
+
+	url := fmt.Sprintf("%s/domain/%s/renew", c.owner(), fqdn)
 
 	req, err := c.request(http.MethodPut, url, nil)
 	if err != nil {
 		return errors.Wrap(err, "RenewDomain: failed to build a request")
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if err := authorize(req, token); err != nil {
+		c.countRenew(err)
+		return errors.Wrap(err, "RenewDomain")
+	}
 
-	_, err = c.do(req)
+	rep, err := c.do("renew", fqdn, req)
+	c.countRenew(err)
 	if err != nil {
 		return errors.Wrap(err, "RenewDomain: failed to execute a request")
 	}
+	c.observe(rep.Data, nil)
 
 	return err
 }
 
-func NewClient(kubeClient *kubernetes.Clientset) *Client {
-	httpClient := &http.Client{Timeout: 5 * time.Second}
+// GetDomain returns the domain of this cluster as recorded by the rdns server
+func (c *Client) GetDomain() (model.Domain, error) {
+	_, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient, c.domain.Secret)
+	if fqdn == "" {
+		return model.Domain{}, errors.New("GetDomain: failed to get fqdn")
+	}
+
+	return c.getDomain(fqdn)
+}
+
+// DeleteDomain deletes the domain from the rdns server and removes the saved token and fqdn
+func (c *Client) DeleteDomain() error {
+	token, fqdn := k8s.GetTokenAndRootFqdn(c.kubeClient, c.domain.Secret)
+	if token == "" || fqdn == "" {
+		return errors.New("DeleteDomain: failed to get token and fqdn")
+	}
+
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: "delete domain", Target: fqdn})
+		return nil
+	}
+
+	url := fmt.Sprintf("%s/domain/%s", c.owner(), fqdn)
+
+	req, err := c.request(http.MethodDelete, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "DeleteDomain: failed to build a request")
+	}
+
+	if err := authorize(req, token); err != nil {
+		return errors.Wrap(err, "DeleteDomain")
+	}
+
+	_, err = c.do("delete", fqdn, req)
+	if err != nil {
+		return errors.Wrap(err, "DeleteDomain: failed to execute a request")
+	}
+
+	return k8s.DeleteTokenAndRootFqdn(c.kubeClient, c.domain.Secret)
+}
+
+func NewClient(kubeClient kubernetes.Interface, domain setting.DomainConfig) *Client {
+	httpClient, err := newHTTPClient()
+	if err != nil {
+		// the transport has been validated when the settings were loaded
+		log.Errorf("Failed to configure the rdns client transport: %v", err)
+		httpClient = &http.Client{Timeout: setting.GetRdnsTimeout()}
+	}
 	return &Client{
 		httpClient: httpClient,
 		kubeClient: kubeClient,
-		base:       setting.GetBaseRdnsURL(),
+		backends:   newBackends(setting.GetBaseRdnsURLs(), setting.GetBackendPolicy(), setting.GetBackendRetryInterval()),
+		selector:   selector.New(setting.GetHostPolicy(), setting.GetMaxHosts()),
+		domain:     domain,
 	}
 }
@@ -0,0 +1,299 @@
+package rdns_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/rdns/fake"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// unreachable is a loopback endpoint nothing listens on
+const unreachable = "http://127.0.0.1:1/v1"
+
+type env struct {
+	kube   *kubefake.Clientset
+	server *fake.Server
+	client *rdns.Client
+}
+
+func newEnv(t *testing.T, urls func(server string) string, values map[string]string) *env {
+	t.Helper()
+	server := fake.NewServer()
+	base, err := server.Start("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	if values == nil {
+		values = map[string]string{}
+	}
+	// the fake server serves plain http on loopback
+	if _, ok := values["allow-insecure-token"]; !ok {
+		values["allow-insecure-token"] = "true"
+	}
+	values["base-rdns-url"] = base
+	if urls != nil {
+		values["base-rdns-url"] = urls(base)
+	}
+	if err := testutil.InitSettings(values); err != nil {
+		t.Fatal(err)
+	}
+
+	kube := testutil.NewClientset()
+	domain, err := setting.GetDomain("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &env{kube: kube, server: server, client: rdns.NewClient(kube, domain)}
+}
+
+func (e *env) secret(t *testing.T) map[string]string {
+	t.Helper()
+	secret, err := e.kube.CoreV1().Secrets(metav1.NamespaceSystem).Get(setting.DefaultDomainSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	data := map[string]string{}
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data
+}
+
+func (e *env) saveDomain(t *testing.T, fqdn, token, base string, hosts []string) {
+	t.Helper()
+	e.server.AddDomain(fqdn, token, hosts)
+	_, err := e.kube.CoreV1().Secrets(metav1.NamespaceSystem).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: setting.DefaultDomainSecret, Namespace: metav1.NamespaceSystem},
+		Data: map[string][]byte{
+			"token":   []byte(token),
+			"fqdn":    []byte(fqdn),
+			"backend": []byte(base),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyDomainCreate(t *testing.T) {
+	tests := []struct {
+		name      string
+		desired   string
+		existing  string
+		fail      int
+		wantErr   bool
+		wantFqdn  string
+		wantSaved bool
+	}{
+		{name: "generated fqdn", wantSaved: true},
+		{name: "desired fqdn", desired: "cluster.lb.rancher.cloud", wantFqdn: "cluster.lb.rancher.cloud", wantSaved: true},
+		// the server created a domain under another name, its token must still be kept
+		{name: "reassigned fqdn", desired: "cluster.lb.rancher.cloud", existing: "cluster.lb.rancher.cloud", wantErr: true, wantSaved: true},
+		{name: "rejected", fail: http.StatusBadRequest, wantErr: true},
+		{name: "rejected desired fqdn", desired: "cluster.lb.rancher.cloud", fail: http.StatusForbidden, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnv(t, nil, map[string]string{"desired-fqdn": tt.desired})
+			if tt.existing != "" {
+				e.server.AddDomain(tt.existing, "other", []string{"9.9.9.9"})
+			}
+			if tt.fail != 0 {
+				e.server.Fail(fake.OpCreate, tt.fail, "rejected", -1)
+			}
+
+			err := e.client.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1", "2.2.2.2"}))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyDomain() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			saved := e.secret(t)
+			if !tt.wantSaved {
+				if saved != nil {
+					t.Fatalf("secret was saved: %v", saved)
+				}
+				return
+			}
+			if saved == nil {
+				t.Fatal("secret was not saved")
+			}
+			if tt.wantFqdn != "" && saved["fqdn"] != tt.wantFqdn {
+				t.Fatalf("saved fqdn = %s, want %s", saved["fqdn"], tt.wantFqdn)
+			}
+			if saved["token"] == "" || saved["token"] != e.server.Token(saved["fqdn"]) {
+				t.Fatalf("saved token %q does not match the server token of %s", saved["token"], saved["fqdn"])
+			}
+			if !strings.HasPrefix(saved["backend"], "http://127.0.0.1:") {
+				t.Fatalf("saved backend = %q", saved["backend"])
+			}
+			if got := e.client.RootFqdn(); got != saved["fqdn"] {
+				t.Fatalf("RootFqdn() = %s, want %s", got, saved["fqdn"])
+			}
+		})
+	}
+}
+
+func TestApplyDomainUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		hosts       []string
+		wantUpdates int
+		wantHosts   []string
+	}{
+		{name: "changed hosts", hosts: []string{"2.2.2.2", "3.3.3.3"}, wantUpdates: 1, wantHosts: []string{"2.2.2.2", "3.3.3.3"}},
+		{name: "unchanged hosts", hosts: []string{"1.1.1.1"}, wantUpdates: 0, wantHosts: []string{"1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnv(t, nil, nil)
+			e.saveDomain(t, "abcd.lb.rancher.cloud", "secret", setting.GetBaseRdnsURLs()[0], []string{"1.1.1.1"})
+
+			if err := e.client.ApplyDomain(selector.FromAddresses(tt.hosts)); err != nil {
+				t.Fatalf("ApplyDomain() error = %v", err)
+			}
+			if n := e.server.Requests(fake.OpCreate); n != 0 {
+				t.Fatalf("%d domains were created for a saved domain", n)
+			}
+			if n := e.server.Requests(fake.OpUpdate); n != tt.wantUpdates {
+				t.Fatalf("updates = %d, want %d", n, tt.wantUpdates)
+			}
+			d, _ := e.server.Domain("abcd.lb.rancher.cloud")
+			if strings.Join(d.Hosts, ",") != strings.Join(tt.wantHosts, ",") {
+				t.Fatalf("hosts = %v, want %v", d.Hosts, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestApplyDomainHashSelection(t *testing.T) {
+	candidates := selector.FromAddresses([]string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5", "6.6.6.6"})
+	for _, desired := range []string{"", "cluster.lb.rancher.cloud"} {
+		e := newEnv(t, nil, map[string]string{"desired-fqdn": desired, "host-policy": selector.PolicyHash, "max-hosts": "2"})
+		if err := e.client.ApplyDomain(candidates); err != nil {
+			t.Fatalf("ApplyDomain() error = %v", err)
+		}
+		// the hosts selected before the domain existed are kept once its fqdn is saved
+		if err := e.client.ApplyDomain(candidates); err != nil {
+			t.Fatalf("ApplyDomain() error = %v", err)
+		}
+		if n := e.server.Requests(fake.OpUpdate); n != 0 {
+			t.Fatalf("the hosts of the domain desired as %q were updated %d times after its creation", desired, n)
+		}
+	}
+}
+
+func TestRenewDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		saved   bool
+		fail    int
+		message string
+		wantErr bool
+	}{
+		{name: "renewed", saved: true},
+		{name: "server error", saved: true, fail: http.StatusInternalServerError, message: "renew failed", wantErr: true},
+		{name: "invalid token", saved: true, fail: http.StatusForbidden, message: "renew failed", wantErr: true},
+		{name: "error without a message", saved: true, fail: http.StatusForbidden, wantErr: true},
+		{name: "status 300", saved: true, fail: http.StatusMultipleChoices, wantErr: true},
+		{name: "no saved domain", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnv(t, nil, nil)
+			if tt.saved {
+				e.saveDomain(t, "abcd.lb.rancher.cloud", "secret", setting.GetBaseRdnsURLs()[0], []string{"1.1.1.1"})
+			}
+			if tt.fail != 0 {
+				e.server.Fail(fake.OpRenew, tt.fail, tt.message, 1)
+			}
+
+			err := e.client.RenewDomain()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenewDomain() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.saved && e.server.Requests(fake.OpRenew) != 1 {
+				t.Fatalf("renew requests = %d, want 1", e.server.Requests(fake.OpRenew))
+			}
+		})
+	}
+}
+
+func TestCreateFailover(t *testing.T) {
+	e := newEnv(t, func(server string) string { return unreachable + "," + server }, nil)
+
+	if err := e.client.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1"})); err != nil {
+		t.Fatalf("ApplyDomain() error = %v", err)
+	}
+	saved := e.secret(t)
+	if saved["backend"] == unreachable || saved["backend"] == "" {
+		t.Fatalf("saved backend = %q, want the reachable endpoint", saved["backend"])
+	}
+	if got := k8s.GetBackend(e.kube, setting.DefaultDomainSecret); got != e.client.State().Backend {
+		t.Fatalf("state backend = %s, want %s", e.client.State().Backend, got)
+	}
+}
+
+func TestInsecureToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   string
+		wantErr bool
+	}{
+		{name: "refused over http", allow: "false", wantErr: true},
+		{name: "allowed over http", allow: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnv(t, nil, map[string]string{"allow-insecure-token": tt.allow})
+			e.saveDomain(t, "abcd.lb.rancher.cloud", "secret", setting.GetBaseRdnsURLs()[0], []string{"1.1.1.1"})
+
+			if err := rdns.ValidateTransport(setting.GetBaseRdnsURLs()); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateTransport() error = %v, want error %t", err, tt.wantErr)
+			}
+			err := e.client.RenewDomain()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenewDomain() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr && e.server.Requests(fake.OpRenew) != 0 {
+				t.Fatal("the token was sent over http")
+			}
+		})
+	}
+}
+
+func TestDryRunRootFqdn(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired string
+		want    string
+	}{
+		{name: "desired fqdn", desired: "cluster.lb.rancher.cloud", want: "cluster.lb.rancher.cloud"},
+		{name: "placeholder", want: "dry-run.lb.rancher.cloud"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnv(t, nil, map[string]string{"desired-fqdn": tt.desired, "dry-run": "true"})
+
+			if err := e.client.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1"})); err != nil {
+				t.Fatalf("ApplyDomain() error = %v", err)
+			}
+			if n := e.server.Requests(fake.OpCreate); n != 0 {
+				t.Fatalf("%d domains were created in dry-run", n)
+			}
+			if got := e.client.RootFqdn(); got != tt.want {
+				t.Fatalf("RootFqdn() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package rdns
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	BackendPolicyPriority   = "priority"
+	BackendPolicyRoundRobin = "round-robin"
+
+	metricBackendUp = "kube_rdns_backend_up"
+)
+
+// ValidateBackends checks the rdns server endpoints and the policy used to pick one
+func ValidateBackends(urls []string, policy string) error {
+	if len(urls) == 0 {
+		return errors.New("at least one rdns server endpoint is required")
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return errors.Errorf("invalid rdns server endpoint %q", u)
+		}
+	}
+	if policy != BackendPolicyPriority && policy != BackendPolicyRoundRobin {
+		return errors.Errorf("invalid backend policy %q, must be %s or %s", policy, BackendPolicyPriority, BackendPolicyRoundRobin)
+	}
+	return nil
+}
+
+// unavailableError is returned when a backend could not serve a request at all,
+// as opposed to the backend rejecting the request
+type unavailableError struct {
+	base string
+	err  error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func isUnavailable(err error) bool {
+	_, ok := errors.Cause(err).(*unavailableError)
+	return ok
+}
+
+type backend struct {
+	base      string
+	failures  int
+	downUntil time.Time
+}
+
+// backends tracks the health of the rdns server endpoints
+type backends struct {
+	lock          sync.Mutex
+	list          []*backend
+	policy        string
+	retryInterval time.Duration
+	next          int
+}
+
+func newBackends(urls []string, policy string, retryInterval time.Duration) *backends {
+	b := &backends{policy: policy, retryInterval: retryInterval}
+	for _, u := range urls {
+		b.list = append(b.list, &backend{base: u})
+		metrics.SetGauge(metricBackendUp, "Whether the rdns server endpoint is considered healthy.", map[string]string{"backend": u}, 1)
+	}
+	return b
+}
+
+// primary returns the endpoint used for domains which have no recorded backend
+func (b *backends) primary() string {
+	if len(b.list) == 0 {
+		return ""
+	}
+	return b.list[0].base
+}
+
+// candidates returns the endpoints to try in order, the healthy ones first
+func (b *backends) candidates() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := len(b.list)
+	start := 0
+	if b.policy == BackendPolicyRoundRobin && n > 0 {
+		start = b.next % n
+		b.next++
+	}
+
+	now := time.Now()
+	var healthy, down []string
+	for i := 0; i < n; i++ {
+		be := b.list[(start+i)%n]
+		if now.Before(be.downUntil) {
+			down = append(down, be.base)
+			continue
+		}
+		healthy = append(healthy, be.base)
+	}
+	return append(healthy, down...)
+}
+
+// match returns the endpoint a request url was built from
+func (b *backends) match(rawurl string) string {
+	for _, be := range b.list {
+		if strings.HasPrefix(rawurl, be.base+"/") {
+			return be.base
+		}
+	}
+	return ""
+}
+
+func (b *backends) get(base string) *backend {
+	for _, be := range b.list {
+		if be.base == base {
+			return be
+		}
+	}
+	return nil
+}
+
+func (b *backends) markFailed(base string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	be := b.get(base)
+	if be == nil {
+		return
+	}
+	be.failures++
+	be.downUntil = time.Now().Add(b.retryInterval)
+	log.WithField(logging.FieldBackend, base).Warnf("Rdns server is unavailable (%d consecutive failures): %v", be.failures, err)
+	metrics.SetGauge(metricBackendUp, "Whether the rdns server endpoint is considered healthy.", map[string]string{"backend": base}, 0)
+}
+
+func (b *backends) markOK(base string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	be := b.get(base)
+	if be == nil || be.failures == 0 {
+		return
+	}
+	log.WithField(logging.FieldBackend, base).Info("Rdns server is available again")
+	be.failures = 0
+	be.downUntil = time.Time{}
+	metrics.SetGauge(metricBackendUp, "Whether the rdns server endpoint is considered healthy.", map[string]string{"backend": base}, 1)
+}
+
+// BackendState is the observed health of a rdns server endpoint
+type BackendState struct {
+	Base      string    `json:"base"`
+	Failures  int       `json:"failures"`
+	DownUntil time.Time `json:"downUntil,omitempty"`
+}
+
+func (b *backends) state() []BackendState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var states []BackendState
+	for _, be := range b.list {
+		states = append(states, BackendState{Base: be.base, Failures: be.failures, DownUntil: be.downUntil})
+	}
+	return states
+}
@@ -0,0 +1,287 @@
+// Package fake is an in-process rdns server implementing the v1 endpoints used by the
+// rdns client, for tests and for running the controller without the public api.
+package fake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/rdns-server/model"
+)
+
+const (
+	DefaultRootDomain = "lb.rancher.cloud"
+	DefaultTTL        = 240 * time.Hour
+
+	OpCreate = "create"
+	OpGet    = "get"
+	OpUpdate = "update"
+	OpRenew  = "renew"
+	OpDelete = "delete"
+)
+
+type record struct {
+	domain model.Domain
+	token  string
+}
+
+type failure struct {
+	status  int
+	message string
+	times   int
+}
+
+// Server keeps the domains in memory, the zero value is not usable, use NewServer
+type Server struct {
+	// RootDomain is the domain the generated fqdns are created under
+	RootDomain string
+	// TTL is how long a domain lives without being renewed
+	TTL time.Duration
+	// Now returns the current time, it can be replaced to expire domains in tests
+	Now func() time.Time
+
+	lock     sync.Mutex
+	records  map[string]*record
+	failures map[string]*failure
+	requests map[string]int
+	listener net.Listener
+}
+
+func NewServer() *Server {
+	return &Server{
+		RootDomain: DefaultRootDomain,
+		TTL:        DefaultTTL,
+		Now:        time.Now,
+		records:    make(map[string]*record),
+		failures:   make(map[string]*failure),
+		requests:   make(map[string]int),
+	}
+}
+
+// Start serves on addr, a random loopback port when addr is empty, and returns the base url
+// to configure the rdns client with
+func (s *Server) Start(addr string) (string, error) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+	go http.Serve(l, s)
+	return fmt.Sprintf("http://%s/v1", l.Addr().String()), nil
+}
+
+// Close stops serving
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.listener = nil
+	return err
+}
+
+// Fail makes the next times requests of the operation fail with the status and message,
+// times below zero fails every request until ClearFailures is called
+func (s *Server) Fail(op string, status int, message string, times int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures[op] = &failure{status: status, message: message, times: times}
+}
+
+func (s *Server) ClearFailures() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = make(map[string]*failure)
+}
+
+// Requests returns how many requests of the operation have been received
+func (s *Server) Requests(op string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[op]
+}
+
+// Domain returns the domain with fqdn, expired domains are not returned
+func (s *Server) Domain(fqdn string) (model.Domain, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := s.get(fqdn)
+	if r == nil {
+		return model.Domain{}, false
+	}
+	return copyDomain(r.domain), true
+}
+
+// Token returns the token of the domain with fqdn
+func (s *Server) Token(fqdn string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r := s.get(fqdn); r != nil {
+		return r.token
+	}
+	return ""
+}
+
+// AddDomain creates a domain directly, as if it had been created by another client
+func (s *Server) AddDomain(fqdn, token string, hosts []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expiration := s.Now().Add(s.TTL)
+	s.records[fqdn] = &record{
+		domain: model.Domain{Fqdn: fqdn, Hosts: append([]string(nil), hosts...), Expiration: &expiration},
+		token:  token,
+	}
+}
+
+func copyDomain(d model.Domain) model.Domain {
+	d.Hosts = append([]string(nil), d.Hosts...)
+	if d.Expiration != nil {
+		expiration := *d.Expiration
+		d.Expiration = &expiration
+	}
+	return d
+}
+
+// get returns the record of fqdn and drops it once expired, the lock must be held
+func (s *Server) get(fqdn string) *record {
+	r := s.records[fqdn]
+	if r == nil {
+		return nil
+	}
+	if r.domain.Expiration != nil && s.Now().After(*r.domain.Expiration) {
+		delete(s.records, fqdn)
+		return nil
+	}
+	return r
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func reply(w http.ResponseWriter, status int, resp model.Response) {
+	resp.Status = status
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func replyError(w http.ResponseWriter, status int, message string) {
+	reply(w, status, model.Response{Message: message})
+}
+
+// route returns the operation and the fqdn of a request path
+func route(method, path string) (string, string) {
+	path = strings.TrimPrefix(path, "/v1")
+	if path == "/domain" {
+		if method == http.MethodPost {
+			return OpCreate, ""
+		}
+		return "", ""
+	}
+	if !strings.HasPrefix(path, "/domain/") {
+		return "", ""
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/domain/"), "/")
+	switch {
+	case len(parts) == 1 && method == http.MethodGet:
+		return OpGet, parts[0]
+	case len(parts) == 1 && method == http.MethodPut:
+		return OpUpdate, parts[0]
+	case len(parts) == 1 && method == http.MethodDelete:
+		return OpDelete, parts[0]
+	case len(parts) == 2 && parts[1] == "renew" && method == http.MethodPut:
+		return OpRenew, parts[0]
+	}
+	return "", ""
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op, fqdn := route(r.Method, r.URL.Path)
+	if op == "" {
+		replyError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests[op]++
+
+	if f := s.failures[op]; f != nil && f.times != 0 {
+		f.times--
+		replyError(w, f.status, f.message)
+		return
+	}
+
+	if op == OpCreate {
+		s.create(w, r)
+		return
+	}
+
+	rec := s.get(fqdn)
+	if rec == nil {
+		replyError(w, http.StatusNotFound, fmt.Sprintf("domain %s not found", fqdn))
+		return
+	}
+	if op == OpGet {
+		reply(w, http.StatusOK, model.Response{Data: copyDomain(rec.domain)})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+rec.token {
+		replyError(w, http.StatusForbidden, "invalid token")
+		return
+	}
+
+	switch op {
+	case OpUpdate:
+		opts, err := model.ParseDomainOptions(r)
+		if err != nil || len(opts.Hosts) == 0 {
+			replyError(w, http.StatusBadRequest, "hosts are required")
+			return
+		}
+		rec.domain.Hosts = append([]string(nil), opts.Hosts...)
+	case OpRenew:
+		expiration := s.Now().Add(s.TTL)
+		rec.domain.Expiration = &expiration
+	case OpDelete:
+		delete(s.records, fqdn)
+	}
+	reply(w, http.StatusOK, model.Response{Data: copyDomain(rec.domain)})
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	opts, err := model.ParseDomainOptions(r)
+	if err != nil || len(opts.Hosts) == 0 {
+		replyError(w, http.StatusBadRequest, "hosts are required")
+		return
+	}
+
+	fqdn := opts.Fqdn
+	if fqdn == "" || s.get(fqdn) != nil {
+		// a taken name is replaced by a generated one so clients see the name reassigned
+		fqdn = fmt.Sprintf("%s.%s", randomHex(4), s.RootDomain)
+	}
+	expiration := s.Now().Add(s.TTL)
+	rec := &record{
+		domain: model.Domain{Fqdn: fqdn, Hosts: append([]string(nil), opts.Hosts...), Expiration: &expiration},
+		token:  randomHex(16),
+	}
+	s.records[fqdn] = rec
+	reply(w, http.StatusOK, model.Response{Data: copyDomain(rec.domain), Token: rec.token})
+}
@@ -0,0 +1,157 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/niusmallnan/rdns-server/model"
+)
+
+func do(t *testing.T, s *Server, method, path, token string, payload interface{}) (int, model.Response) {
+	t.Helper()
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	var resp model.Response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+	}
+	return w.Code, resp
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		opts     model.DomainOptions
+		status   int
+		fqdn     string
+	}{
+		{name: "generated", opts: model.DomainOptions{Hosts: []string{"1.1.1.1"}}, status: http.StatusOK},
+		{name: "desired", opts: model.DomainOptions{Fqdn: "a.example.com", Hosts: []string{"1.1.1.1"}}, status: http.StatusOK, fqdn: "a.example.com"},
+		{name: "taken", existing: "a.example.com", opts: model.DomainOptions{Fqdn: "a.example.com", Hosts: []string{"1.1.1.1"}}, status: http.StatusOK},
+		{name: "no hosts", opts: model.DomainOptions{Fqdn: "a.example.com"}, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			if tt.existing != "" {
+				s.AddDomain(tt.existing, "other", []string{"2.2.2.2"})
+			}
+			status, resp := do(t, s, http.MethodPost, "/v1/domain", "", tt.opts)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d: %s", status, tt.status, resp.Message)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if resp.Token == "" || resp.Data.Expiration == nil {
+				t.Fatalf("response has no token or expiration: %+v", resp)
+			}
+			if tt.fqdn != "" && resp.Data.Fqdn != tt.fqdn {
+				t.Fatalf("fqdn = %s, want %s", resp.Data.Fqdn, tt.fqdn)
+			}
+			if tt.existing != "" && resp.Data.Fqdn == tt.existing {
+				t.Fatalf("taken fqdn %s was assigned twice", tt.existing)
+			}
+			if _, ok := s.Domain(resp.Data.Fqdn); !ok {
+				t.Fatalf("domain %s was not stored", resp.Data.Fqdn)
+			}
+		})
+	}
+}
+
+func TestAuthenticatedOperations(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{name: "get without token", method: http.MethodGet, path: "/v1/domain/a.example.com", status: http.StatusOK},
+		{name: "get unknown", method: http.MethodGet, path: "/v1/domain/b.example.com", status: http.StatusNotFound},
+		{name: "update", method: http.MethodPut, path: "/v1/domain/a.example.com", token: "secret", body: model.DomainOptions{Hosts: []string{"3.3.3.3"}}, status: http.StatusOK},
+		{name: "update with wrong token", method: http.MethodPut, path: "/v1/domain/a.example.com", token: "wrong", body: model.DomainOptions{Hosts: []string{"3.3.3.3"}}, status: http.StatusForbidden},
+		{name: "renew", method: http.MethodPut, path: "/v1/domain/a.example.com/renew", token: "secret", status: http.StatusOK},
+		{name: "renew without token", method: http.MethodPut, path: "/v1/domain/a.example.com/renew", status: http.StatusForbidden},
+		{name: "delete", method: http.MethodDelete, path: "/v1/domain/a.example.com", token: "secret", status: http.StatusOK},
+		// the rdns server api has no txt records
+		{name: "txt", method: http.MethodPost, path: "/v1/domain/a.example.com/txt", token: "secret", body: map[string]string{"text": "key"}, status: http.StatusNotFound},
+		{name: "unknown path", method: http.MethodGet, path: "/v1/other", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			s.AddDomain("a.example.com", "secret", []string{"1.1.1.1"})
+			status, resp := do(t, s, tt.method, tt.path, tt.token, tt.body)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d: %s", status, tt.status, resp.Message)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s := NewServer()
+	s.AddDomain("a.example.com", "secret", []string{"1.1.1.1"})
+
+	do(t, s, http.MethodPut, "/v1/domain/a.example.com", "secret", model.DomainOptions{Hosts: []string{"2.2.2.2", "3.3.3.3"}})
+	d, _ := s.Domain("a.example.com")
+	if len(d.Hosts) != 2 || d.Hosts[0] != "2.2.2.2" {
+		t.Fatalf("hosts = %v, want [2.2.2.2 3.3.3.3]", d.Hosts)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	now := time.Now()
+	s := NewServer()
+	s.TTL = time.Hour
+	s.Now = func() time.Time { return now }
+	s.AddDomain("a.example.com", "secret", []string{"1.1.1.1"})
+
+	now = now.Add(30 * time.Minute)
+	if status, _ := do(t, s, http.MethodPut, "/v1/domain/a.example.com/renew", "secret", nil); status != http.StatusOK {
+		t.Fatalf("renew status = %d", status)
+	}
+	now = now.Add(45 * time.Minute)
+	if _, ok := s.Domain("a.example.com"); !ok {
+		t.Fatal("renewed domain expired")
+	}
+	now = now.Add(time.Hour)
+	if status, _ := do(t, s, http.MethodGet, "/v1/domain/a.example.com", "", nil); status != http.StatusNotFound {
+		t.Fatalf("get status = %d for an expired domain, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := NewServer()
+	s.AddDomain("a.example.com", "secret", []string{"1.1.1.1"})
+	s.Fail(OpRenew, http.StatusInternalServerError, "boom", 1)
+
+	status, resp := do(t, s, http.MethodPut, "/v1/domain/a.example.com/renew", "secret", nil)
+	if status != http.StatusInternalServerError || resp.Message != "boom" {
+		t.Fatalf("got %d %q, want the injected failure", status, resp.Message)
+	}
+	if status, _ := do(t, s, http.MethodPut, "/v1/domain/a.example.com/renew", "secret", nil); status != http.StatusOK {
+		t.Fatalf("status = %d after the failure was used up", status)
+	}
+	if n := s.Requests(OpRenew); n != 2 {
+		t.Fatalf("renew requests = %d, want 2", n)
+	}
+}
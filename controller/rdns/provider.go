@@ -0,0 +1,40 @@
+package rdns
+
+import (
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/rdns-server/model"
+	"github.com/pkg/errors"
+)
+
+// ErrNotSupported is returned by the operations a provider cannot publish
+var ErrNotSupported = errors.New("not supported by the provider")
+
+// Provider publishes the hosts of one domain, the controller and the watchers only depend on it
+type Provider interface {
+	// Name returns the name of the configured domain
+	Name() string
+	// RootFqdn returns the fqdn of the domain, empty until the domain exists
+	RootFqdn() string
+	// Rotate advances the host selection for policies which rotate across renewals
+	Rotate() bool
+	// ApplyDomain ensures the domain exists and sets its hosts to the selected candidates
+	ApplyDomain(candidates []selector.Host) error
+	// RenewDomain keeps the domain from expiring
+	RenewDomain() error
+	// GetDomain returns the domain as it is published
+	GetDomain() (model.Domain, error)
+	// DeleteDomain removes the domain and its records
+	DeleteDomain() error
+	// SetRecords sets the A and AAAA records of name under the domain to addresses, without
+	// touching the hosts of the domain. A ttl of zero is the default ttl of the provider.
+	SetRecords(name string, addresses []string, ttl uint32) error
+	// DeleteRecords removes the A and AAAA records of name
+	DeleteRecords(name string) error
+	// SetTXTRecord adds text to the txt records of name under the domain
+	SetTXTRecord(name, text string) error
+	// DeleteTXTRecord removes text from the txt records of name
+	DeleteTXTRecord(name, text string) error
+	State() State
+}
+
+var _ Provider = &Client{}
@@ -0,0 +1,29 @@
+package rdns
+
+import (
+	"github.com/pkg/errors"
+)
+
+// SetTXTRecord is not supported, the rdns server api only publishes the hosts of a domain
+// and its wildcard
+func (c *Client) SetTXTRecord(name, text string) error {
+	return errors.Wrapf(ErrNotSupported, "SetTXTRecord %s", name)
+}
+
+// DeleteTXTRecord is not supported, the rdns server api only publishes the hosts of a domain
+// and its wildcard
+func (c *Client) DeleteTXTRecord(name, text string) error {
+	return errors.Wrapf(ErrNotSupported, "DeleteTXTRecord %s", name)
+}
+
+// SetRecords is not supported, the rdns server api only publishes the hosts of a domain and
+// its wildcard
+func (c *Client) SetRecords(name string, addresses []string, ttl uint32) error {
+	return errors.Wrapf(ErrNotSupported, "SetRecords %s", name)
+}
+
+// DeleteRecords is not supported, the rdns server api only publishes the hosts of a domain and
+// its wildcard
+func (c *Client) DeleteRecords(name string) error {
+	return errors.Wrapf(ErrNotSupported, "DeleteRecords %s", name)
+}
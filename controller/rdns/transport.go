@@ -0,0 +1,90 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+)
+
+// ValidateTransport checks the tls and proxy settings of the rdns client, and that the
+// token is not going to be sent over plain http unless that is allowed
+func ValidateTransport(urls []string) error {
+	if _, err := newHTTPClient(); err != nil {
+		return err
+	}
+	if setting.IsAllowInsecureToken() {
+		return nil
+	}
+	for _, u := range urls {
+		if !isSecure(u) {
+			return errors.Errorf("rdns server endpoint %s does not use https, set allow-insecure-token to send the domain token over it", u)
+		}
+	}
+	return nil
+}
+
+func isSecure(rawurl string) bool {
+	parsed, err := url.Parse(rawurl)
+	return err == nil && parsed.Scheme == "https"
+}
+
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: setting.IsRdnsInsecureSkipVerify()}
+	if tlsConfig.InsecureSkipVerify {
+		log.Warn("The rdns server certificate is not verified")
+	}
+
+	if file := setting.GetRdnsCAFile(); file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the rdns ca file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in the rdns ca file %s", file)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile, keyFile := setting.GetRdnsCertFile(), setting.GetRdnsKeyFile()
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("rdns-cert-file and rdns-key-file must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load the rdns client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if p := setting.GetRdnsProxy(); p != "" {
+		proxyURL, err := url.Parse(p)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, errors.Errorf("invalid rdns proxy %q", p)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: setting.GetRdnsTimeout()}, nil
+}
+
+// authorize sets the domain token on the request, it is refused for plain http
+// endpoints so the token is not sent in cleartext
+func authorize(req *http.Request, token string) error {
+	if req.URL.Scheme != "https" && !setting.IsAllowInsecureToken() {
+		return errors.Errorf("refusing to send the domain token to %s over %s", req.URL.Host, req.URL.Scheme)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
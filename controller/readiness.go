@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"reflect"
+
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiwatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func nginxControllerSelector() string {
+	return labels.SelectorFromSet(labels.Set{"app": podNginxControllerLabel}).String()
+}
+
+// isPodReady returns true for running pods which are ready and not terminating
+func isPodReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// isNodeSchedulable returns true for nodes which are ready and not cordoned
+func isNodeSchedulable(node *v1.Node) bool {
+	return isNodeReady(node) && !node.Spec.Unschedulable
+}
+
+// triggerRepublish asks the republish loop to run, pending triggers are coalesced
+func (c *RDNSController) triggerRepublish() {
+	select {
+	case c.republishCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *RDNSController) republishLoop() {
+	for {
+		select {
+		case <-c.republishCh:
+			c.republish()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// watchReadiness republishes the hosts whenever a nginx controller pod or a node changes readiness
+func (c *RDNSController) watchReadiness() {
+	podWatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = nginxControllerSelector()
+			return c.kubeClient.CoreV1().Pods(defaultNginxIngressNamespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
+			options.LabelSelector = nginxControllerSelector()
+			return c.kubeClient.CoreV1().Pods(defaultNginxIngressNamespace).Watch(options)
+		},
+	}
+	_, pc := cache.NewInformer(podWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.triggerRepublish()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, newPod := oldObj.(*v1.Pod), newObj.(*v1.Pod)
+			if isPodReady(oldPod) != isPodReady(newPod) || oldPod.Spec.NodeName != newPod.Spec.NodeName {
+				log.WithField(logging.FieldNamespace, newPod.Namespace).Infof("Nginx controller pod %s changed readiness", newPod.Name)
+				c.triggerRepublish()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.triggerRepublish()
+		},
+	})
+
+	nodeWatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return c.kubeClient.CoreV1().Nodes().List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
+			return c.kubeClient.CoreV1().Nodes().Watch(options)
+		},
+	}
+	_, nc := cache.NewInformer(nodeWatcher, &v1.Node{}, 0, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, newNode := oldObj.(*v1.Node), newObj.(*v1.Node)
+			if isNodeSchedulable(oldNode) != isNodeSchedulable(newNode) || !reflect.DeepEqual(oldNode.Labels, newNode.Labels) {
+				log.Infof("Node %s changed readiness", newNode.Name)
+				c.triggerRepublish()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.triggerRepublish()
+		},
+	})
+
+	go pc.Run(c.stop)
+	go nc.Run(c.stop)
+}
@@ -0,0 +1,32 @@
+package resolver
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Resolver resolves a hostname to its current ip addresses
+type Resolver interface {
+	LookupHost(hostname string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupHost(hostname string) ([]string, error) {
+	return net.LookupHost(hostname)
+}
+
+// Default resolves hostnames with the system resolver
+var Default Resolver = netResolver{}
+
+// Static resolves hostnames from a fixed table, it is meant for running offline
+type Static map[string][]string
+
+func (s Static) LookupHost(hostname string) ([]string, error) {
+	ips, ok := s[hostname]
+	if !ok {
+		return nil, errors.Errorf("no such host %s", hostname)
+	}
+	return ips, nil
+}
@@ -0,0 +1,213 @@
+package responder
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/metrics"
+)
+
+var log = logging.For("responder")
+
+const (
+	maxUDPSize = 512
+	tcpTimeout = 10 * time.Second
+
+	metricQueries = "kube_rdns_dns_queries_total"
+)
+
+var (
+	zonesLock sync.RWMutex
+	zones     = map[string]*Zone{}
+)
+
+func register(z *Zone) {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+	zones[z.fqdn] = z
+}
+
+// Enabled returns whether any domain is answered by the responder
+func Enabled() bool {
+	zonesLock.RLock()
+	defer zonesLock.RUnlock()
+	return len(zones) > 0
+}
+
+// lookup returns the zone which is the closest enclosing zone of name
+func lookup(name string) *Zone {
+	zonesLock.RLock()
+	defer zonesLock.RUnlock()
+	var found *Zone
+	for fqdn, z := range zones {
+		if name != fqdn && !strings.HasSuffix(name, "."+fqdn) {
+			continue
+		}
+		if found == nil || len(fqdn) > len(found.fqdn) {
+			found = z
+		}
+	}
+	return found
+}
+
+// handle returns the response to a query, nil when the message must be dropped
+func handle(req []byte, maxSize int) []byte {
+	if len(req) < dnsmsg.HeaderLen {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(req[2:4])
+	if flags&0x8000 != 0 {
+		return nil
+	}
+	opcode := (flags >> 11) & 0xf
+
+	reply := func(rcode int, authoritative bool, question []byte, answers, authority []dnsmsg.RR) []byte {
+		metrics.AddCounter(metricQueries, "Queries answered by the dns responder.", map[string]string{"rcode": dnsmsg.RcodeName(rcode)}, 1)
+		rflags := 0x8000 | opcode<<11 | flags&0x0100 | uint16(rcode)
+		if authoritative {
+			rflags |= 0x0400
+		}
+		qdcount := uint16(0)
+		if question != nil {
+			qdcount = 1
+		}
+		buf := make([]byte, 0, maxUDPSize)
+		buf = append(buf, req[0:2]...)
+		buf = dnsmsg.AppendUint16(buf, rflags)
+		buf = dnsmsg.AppendUint16(buf, qdcount)
+		buf = dnsmsg.AppendUint16(buf, uint16(len(answers)))
+		buf = dnsmsg.AppendUint16(buf, uint16(len(authority)))
+		buf = dnsmsg.AppendUint16(buf, 0)
+		buf = append(buf, question...)
+		sections := len(buf)
+		var err error
+		for _, r := range append(answers, authority...) {
+			if buf, err = dnsmsg.AppendRR(buf, r); err != nil {
+				log.Errorf("Failed to pack dns record %s: %v", r.Name, err)
+				return nil
+			}
+		}
+		if len(buf) > maxSize {
+			// the client retries over tcp when the response is truncated
+			buf = buf[:sections]
+			binary.BigEndian.PutUint16(buf[2:4], rflags|0x0200)
+			binary.BigEndian.PutUint16(buf[6:8], 0)
+			binary.BigEndian.PutUint16(buf[8:10], 0)
+		}
+		return buf
+	}
+
+	if opcode != 0 {
+		return reply(dnsmsg.RcodeNotImp, false, nil, nil, nil)
+	}
+	if binary.BigEndian.Uint16(req[4:6]) != 1 {
+		return reply(dnsmsg.RcodeFormErr, false, nil, nil, nil)
+	}
+	name, off, err := dnsmsg.ReadName(req, dnsmsg.HeaderLen)
+	if err != nil || off+4 > len(req) {
+		return reply(dnsmsg.RcodeFormErr, false, nil, nil, nil)
+	}
+	qtype := binary.BigEndian.Uint16(req[off : off+2])
+	qclass := binary.BigEndian.Uint16(req[off+2 : off+4])
+	question, err := dnsmsg.PackName(name)
+	if err != nil {
+		return reply(dnsmsg.RcodeFormErr, false, nil, nil, nil)
+	}
+	question = append(question, req[off:off+4]...)
+
+	zone := lookup(name)
+	if zone == nil || (qclass != dnsmsg.ClassIN && qclass != dnsmsg.ClassANY) {
+		return reply(dnsmsg.RcodeRefused, false, question, nil, nil)
+	}
+	answers, authority, rcode := zone.answer(name, qtype)
+	log.Debugf("Answered dns query %s type %d with %d records", name, qtype, len(answers))
+	return reply(rcode, true, question, answers, authority)
+}
+
+// ListenAndServe answers the queries for the registered zones over udp and tcp until stop is closed
+func ListenAndServe(addr string, stop <-chan struct{}) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go func() {
+		<-stop
+		pc.Close()
+		l.Close()
+	}()
+
+	go serveUDP(pc)
+	serveTCP(l)
+	return nil
+}
+
+func serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			log.Errorf("Failed to read dns query: %v", err)
+			continue
+		}
+		if resp := handle(buf[:n], maxUDPSize); resp != nil {
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				log.Debugf("Failed to write dns response to %s: %v", addr, err)
+			}
+		}
+	}
+}
+
+func serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			log.Errorf("Failed to accept dns connection: %v", err)
+			continue
+		}
+		go serveConn(conn)
+	}
+}
+
+func serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(tcpTimeout))
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		resp := handle(req, 65535)
+		if resp == nil {
+			return
+		}
+		out := dnsmsg.AppendUint16(make([]byte, 0, len(resp)+2), uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,181 @@
+package responder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+)
+
+// response is a decoded answer of the responder
+type response struct {
+	rcode         int
+	authoritative bool
+	truncated     bool
+	answers       []dnsmsg.RR
+	authority     []dnsmsg.RR
+}
+
+func query(name string, qtype uint16) []byte {
+	req := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	qname, _ := dnsmsg.PackName(name)
+	req = append(req, qname...)
+	req = dnsmsg.AppendUint16(req, qtype)
+	return dnsmsg.AppendUint16(req, dnsmsg.ClassIN)
+}
+
+func decode(t *testing.T, resp []byte) response {
+	t.Helper()
+	if len(resp) < dnsmsg.HeaderLen || resp[0] != 0x12 || resp[1] != 0x34 {
+		t.Fatalf("response %x does not answer the query", resp)
+	}
+	flags := binary.BigEndian.Uint16(resp[2:4])
+	r := response{rcode: int(flags & 0xf), authoritative: flags&0x0400 != 0, truncated: flags&0x0200 != 0}
+	off := dnsmsg.HeaderLen
+	if binary.BigEndian.Uint16(resp[4:6]) == 1 {
+		_, next, err := dnsmsg.ReadName(resp, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off = next + 4
+	}
+	for i, section := range []*[]dnsmsg.RR{&r.answers, &r.authority} {
+		for j := 0; j < int(binary.BigEndian.Uint16(resp[6+2*i:])); j++ {
+			name, next, err := dnsmsg.ReadName(resp, off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			length := int(binary.BigEndian.Uint16(resp[next+8:]))
+			*section = append(*section, dnsmsg.RR{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(resp[next:]),
+				TTL:   binary.BigEndian.Uint32(resp[next+4:]),
+				Rdata: resp[next+10 : next+10+length],
+			})
+			off = next + 10 + length
+		}
+	}
+	return r
+}
+
+// rdata returns the readable rdata of the records
+func rdata(t *testing.T, records []dnsmsg.RR) string {
+	t.Helper()
+	var out []string
+	for _, r := range records {
+		switch r.Type {
+		case dnsmsg.TypeA, dnsmsg.TypeAAAA:
+			out = append(out, net.IP(r.Rdata).String())
+		case dnsmsg.TypeNS, dnsmsg.TypeSOA:
+			name, _, err := dnsmsg.ReadName(r.Rdata, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, name)
+		case dnsmsg.TypeTXT:
+			out = append(out, string(r.Rdata[1:]))
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func TestHandle(t *testing.T) {
+	z := newZone(t, Config{NameserverIPs: []string{"9.9.9.9"}})
+	if err := z.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1", "2.2.2.2"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.SetTXTRecord("_acme-challenge."+zoneFqdn, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		rcode         int
+		wantAnswers   string
+		wantAuthority string
+	}{
+		{name: "apex soa", qname: zoneFqdn, qtype: dnsmsg.TypeSOA, wantAnswers: "ns." + zoneFqdn},
+		{name: "apex ns", qname: zoneFqdn, qtype: dnsmsg.TypeNS, wantAnswers: "ns." + zoneFqdn},
+		{name: "apex a", qname: zoneFqdn, qtype: dnsmsg.TypeA, wantAnswers: "1.1.1.1,2.2.2.2"},
+		{name: "nameserver glue", qname: "ns." + zoneFqdn, qtype: dnsmsg.TypeA, wantAnswers: "9.9.9.9"},
+		{name: "wildcard", qname: "web.default." + zoneFqdn, qtype: dnsmsg.TypeA, wantAnswers: "1.1.1.1,2.2.2.2"},
+		{name: "wildcard is case insensitive", qname: "WEB." + strings.ToUpper(zoneFqdn), qtype: dnsmsg.TypeA, wantAnswers: "1.1.1.1,2.2.2.2"},
+		{name: "txt record", qname: "_acme-challenge." + zoneFqdn, qtype: dnsmsg.TypeTXT, wantAnswers: "token"},
+		{name: "txt nodata", qname: "web." + zoneFqdn, qtype: dnsmsg.TypeTXT, wantAuthority: "ns." + zoneFqdn},
+		{name: "aaaa nodata", qname: zoneFqdn, qtype: dnsmsg.TypeAAAA, wantAuthority: "ns." + zoneFqdn},
+		{name: "outside the zone", qname: "www.example.test", qtype: dnsmsg.TypeA, rcode: dnsmsg.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := decode(t, handle(query(tt.qname, tt.qtype), maxUDPSize))
+			if r.rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dnsmsg.RcodeName(r.rcode), dnsmsg.RcodeName(tt.rcode))
+			}
+			if r.authoritative != (tt.rcode == dnsmsg.RcodeSuccess) {
+				t.Fatalf("authoritative = %t for rcode %s", r.authoritative, dnsmsg.RcodeName(r.rcode))
+			}
+			if got := rdata(t, r.answers); got != tt.wantAnswers {
+				t.Fatalf("answers = %q, want %q", got, tt.wantAnswers)
+			}
+			if got := rdata(t, r.authority); got != tt.wantAuthority {
+				t.Fatalf("authority = %q, want %q", got, tt.wantAuthority)
+			}
+		})
+	}
+}
+
+func TestHandleTruncation(t *testing.T) {
+	z := newZone(t, Config{NameserverIPs: []string{"9.9.9.9"}})
+	name := "db.default." + zoneFqdn
+	var addresses []string
+	for i := 1; i <= 30; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.0.%d", i))
+	}
+	if err := z.SetRecords(name, addresses, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := decode(t, handle(query(name, dnsmsg.TypeA), maxUDPSize))
+	if !r.truncated || len(r.answers) != 0 {
+		t.Fatalf("udp response truncated = %t with %d answers, want a truncated response without answers", r.truncated, len(r.answers))
+	}
+	// the retry over tcp gets every record
+	r = decode(t, handle(query(name, dnsmsg.TypeA), 1<<16-1))
+	if r.truncated || len(r.answers) != len(addresses) {
+		t.Fatalf("tcp response truncated = %t with %d answers, want %d answers", r.truncated, len(r.answers), len(addresses))
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	newZone(t, Config{NameserverIPs: []string{"9.9.9.9"}})
+	notify := query(zoneFqdn, dnsmsg.TypeSOA)
+	notify[2] |= 4 << 3
+	noQuestion := query(zoneFqdn, dnsmsg.TypeSOA)[:dnsmsg.HeaderLen]
+	binary.BigEndian.PutUint16(noQuestion[4:6], 0)
+
+	tests := []struct {
+		name  string
+		req   []byte
+		rcode int
+	}{
+		{name: "notify opcode", req: notify, rcode: dnsmsg.RcodeNotImp},
+		{name: "no question", req: noQuestion, rcode: dnsmsg.RcodeFormErr},
+		{name: "truncated question", req: query(zoneFqdn, dnsmsg.TypeSOA)[:dnsmsg.HeaderLen+3], rcode: dnsmsg.RcodeFormErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if r := decode(t, handle(tt.req, maxUDPSize)); r.rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dnsmsg.RcodeName(r.rcode), dnsmsg.RcodeName(tt.rcode))
+			}
+		})
+	}
+	if resp := handle([]byte{0x12, 0x34}, maxUDPSize); resp != nil {
+		t.Fatalf("short message answered with %x, want it dropped", resp)
+	}
+}
@@ -0,0 +1,378 @@
+package responder
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/niusmallnan/rdns-server/model"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 86400
+)
+
+// Config is how the zones are answered
+type Config struct {
+	TTL           uint32
+	Nameservers   []string
+	NameserverIPs []string
+	Mbox          string
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ConfigFromSettings returns the config of the dns responder flags
+func ConfigFromSettings() Config {
+	return Config{
+		TTL:           uint32(setting.GetDNSTTL()),
+		Nameservers:   splitList(setting.GetDNSNameservers()),
+		NameserverIPs: splitList(setting.GetDNSNameserverIPs()),
+		Mbox:          setting.GetDNSSOAMbox(),
+	}
+}
+
+// Validate checks the config for answering the zone fqdn, a nameserver below the apex is
+// answered with the nameserver addresses so they are required
+func Validate(cfg Config, fqdn string) error {
+	if fqdn == "" {
+		return errors.New("the dns responder requires a desired fqdn")
+	}
+	if _, err := dnsmsg.PackName(fqdn); err != nil {
+		return err
+	}
+	for _, ns := range cfg.Nameservers {
+		if _, err := dnsmsg.PackName(ns); err != nil {
+			return err
+		}
+	}
+	for _, ip := range cfg.NameserverIPs {
+		if net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid nameserver address %q", ip)
+		}
+	}
+	if len(cfg.NameserverIPs) == 0 {
+		fqdn = dnsmsg.Normalize(fqdn)
+		for _, ns := range nameservers(cfg, fqdn) {
+			if strings.HasSuffix(dnsmsg.Normalize(ns), "."+fqdn) {
+				return errors.Errorf("nameserver %s is within the zone %s, its addresses are required", ns, fqdn)
+			}
+		}
+	}
+	return nil
+}
+
+// Zone answers the queries for a domain and the wildcard below it with the hosts the
+// controller publishes. It is the provider of the domain, the records live in memory.
+type Zone struct {
+	config   Config
+	domain   setting.DomainConfig
+	fqdn     string
+	selector *selector.Selector
+
+	lock    sync.RWMutex
+	hosts   []string
+	records map[string]addressRecord
+	txt     map[string][]string
+	serial  uint32
+}
+
+// addressRecord is the A and AAAA records of a name below the apex
+type addressRecord struct {
+	addresses []string
+	ttl       uint32
+}
+
+// New returns the zone of the domain and registers it with the responder
+func New(cfg Config, domain setting.DomainConfig) *Zone {
+	z := &Zone{
+		config:   cfg,
+		domain:   domain,
+		fqdn:     dnsmsg.Normalize(domain.DesiredFqdn),
+		selector: selector.New(setting.GetHostPolicy(), setting.GetMaxHosts()),
+		records:  make(map[string]addressRecord),
+		txt:      make(map[string][]string),
+		serial:   uint32(time.Now().Unix()),
+	}
+	register(z)
+	return z
+}
+
+var _ rdns.Provider = &Zone{}
+
+func (z *Zone) Name() string {
+	return z.domain.Name
+}
+
+func (z *Zone) RootFqdn() string {
+	return z.fqdn
+}
+
+func (z *Zone) Rotate() bool {
+	return z.selector.Rotate()
+}
+
+func (z *Zone) State() rdns.State {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+	return rdns.State{
+		LastHosts:  append([]string(nil), z.hosts...),
+		LastDomain: &model.Domain{Fqdn: z.fqdn, Hosts: append([]string(nil), z.hosts...)},
+		Backend:    "responder",
+	}
+}
+
+// bump advances the serial of the zone, the lock must be held
+func (z *Zone) bump() {
+	serial := uint32(time.Now().Unix())
+	if serial <= z.serial {
+		serial = z.serial + 1
+	}
+	z.serial = serial
+}
+
+func (z *Zone) ApplyDomain(candidates []selector.Host) error {
+	if len(candidates) == 0 {
+		return errors.New("ApplyDomain: hosts should not be empty")
+	}
+
+	hosts := z.selector.Select(candidates, z.fqdn)
+	sort.Strings(hosts)
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if reflect.DeepEqual(z.hosts, hosts) {
+		log.WithField(logging.FieldFqdn, z.fqdn).Debug("Domain hosts unchanged")
+		return nil
+	}
+	if setting.IsDryRun() {
+		added, removed := dryrun.Diff(z.hosts, hosts)
+		dryrun.Record(dryrun.Action{Operation: "update domain", Target: z.fqdn, Added: added, Removed: removed, Message: fmt.Sprintf("answer hosts %s", hosts)})
+		return nil
+	}
+	z.hosts = hosts
+	z.bump()
+	log.WithFields(logrus.Fields{logging.FieldFqdn: z.fqdn, logging.FieldHosts: hosts}).Info("Answering domain")
+	return nil
+}
+
+// RenewDomain does nothing, the records of the responder do not expire
+func (z *Zone) RenewDomain() error {
+	return nil
+}
+
+func (z *Zone) GetDomain() (model.Domain, error) {
+	return *z.State().LastDomain, nil
+}
+
+func (z *Zone) DeleteDomain() error {
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: "delete domain", Target: z.fqdn})
+		return nil
+	}
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.hosts = nil
+	z.records = make(map[string]addressRecord)
+	z.txt = make(map[string][]string)
+	z.bump()
+	return nil
+}
+
+func (z *Zone) SetRecords(name string, addresses []string, ttl uint32) error {
+	if len(addresses) == 0 {
+		return errors.Errorf("SetRecords: addresses of %s should not be empty", name)
+	}
+	if ttl == 0 {
+		ttl = z.config.TTL
+	}
+	addresses = append([]string(nil), addresses...)
+	sort.Strings(addresses)
+	return z.nameRecords("SetRecords", name, fmt.Sprintf("answer addresses %s", addresses), func(name string) {
+		z.records[name] = addressRecord{addresses: addresses, ttl: ttl}
+	})
+}
+
+func (z *Zone) DeleteRecords(name string) error {
+	return z.nameRecords("DeleteRecords", name, "delete addresses", func(name string) {
+		delete(z.records, name)
+	})
+}
+
+// nameRecords applies update to the records of name, which must be below the apex and not
+// be a nameserver of the zone
+func (z *Zone) nameRecords(op, name, message string, update func(name string)) error {
+	name = dnsmsg.Normalize(name)
+	if !strings.HasSuffix(name, "."+z.fqdn) || z.isNameserver(name) {
+		return errors.Errorf("%s: %s is not a name under the domain %s", op, name, z.fqdn)
+	}
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: strings.ToLower(op), Target: name, Message: fmt.Sprintf("%s on domain %s", message, z.fqdn)})
+		return nil
+	}
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	update(name)
+	z.bump()
+	log.WithFields(logrus.Fields{logging.FieldFqdn: name, logging.FieldOperation: op}).Info("Updated records")
+	return nil
+}
+
+func (z *Zone) SetTXTRecord(name, text string) error {
+	return z.txtRecord("SetTXTRecord", name, text, true)
+}
+
+func (z *Zone) DeleteTXTRecord(name, text string) error {
+	return z.txtRecord("DeleteTXTRecord", name, text, false)
+}
+
+func (z *Zone) txtRecord(op, name, text string, set bool) error {
+	name = dnsmsg.Normalize(name)
+	if !strings.HasSuffix(name, "."+z.fqdn) {
+		return errors.Errorf("%s: %s is not under the domain %s", op, name, z.fqdn)
+	}
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: strings.ToLower(op), Target: name, Message: fmt.Sprintf("on domain %s", z.fqdn)})
+		return nil
+	}
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	var texts []string
+	for _, t := range z.txt[name] {
+		if t != text {
+			texts = append(texts, t)
+		}
+	}
+	if set {
+		texts = append(texts, text)
+	}
+	if len(texts) == 0 {
+		delete(z.txt, name)
+	} else {
+		z.txt[name] = texts
+	}
+	z.bump()
+	return nil
+}
+
+// nameservers returns the NS names of the zone fqdn, ns.<fqdn> by default
+func nameservers(cfg Config, fqdn string) []string {
+	if len(cfg.Nameservers) > 0 {
+		return cfg.Nameservers
+	}
+	return []string{"ns." + fqdn}
+}
+
+func (z *Zone) nameservers() []string {
+	return nameservers(z.config, z.fqdn)
+}
+
+func (z *Zone) mbox() string {
+	if z.config.Mbox == "" {
+		return "hostmaster." + z.fqdn
+	}
+	return strings.Replace(z.config.Mbox, "@", ".", 1)
+}
+
+// soa returns the SOA record of the zone, the lock must be held
+func (z *Zone) soa() dnsmsg.RR {
+	mname, _ := dnsmsg.PackName(z.nameservers()[0])
+	rname, _ := dnsmsg.PackName(z.mbox())
+	rdata := append(mname, rname...)
+	rdata = dnsmsg.AppendUint32(rdata, z.serial)
+	rdata = dnsmsg.AppendUint32(rdata, soaRefresh)
+	rdata = dnsmsg.AppendUint32(rdata, soaRetry)
+	rdata = dnsmsg.AppendUint32(rdata, soaExpire)
+	rdata = dnsmsg.AppendUint32(rdata, z.config.TTL)
+	return dnsmsg.RR{Name: z.fqdn, Type: dnsmsg.TypeSOA, Class: dnsmsg.ClassIN, TTL: z.config.TTL, Rdata: rdata}
+}
+
+func (z *Zone) isNameserver(name string) bool {
+	for _, ns := range z.nameservers() {
+		if dnsmsg.Normalize(ns) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func addressRRs(name string, addresses []string, qtype uint16, ttl uint32) []dnsmsg.RR {
+	var rrs []dnsmsg.RR
+	for _, address := range addresses {
+		r, err := dnsmsg.AddressRR(name, address, ttl)
+		if err != nil {
+			continue
+		}
+		if qtype == r.Type || qtype == dnsmsg.TypeANY {
+			rrs = append(rrs, r)
+		}
+	}
+	return rrs
+}
+
+// answer returns the answer and authority sections for a query of name within the zone.
+// Names below the apex which have no address or txt records of their own are answered by
+// the wildcard.
+func (z *Zone) answer(name string, qtype uint16) ([]dnsmsg.RR, []dnsmsg.RR, int) {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+
+	ttl := z.config.TTL
+	match := func(t uint16) bool { return qtype == t || qtype == dnsmsg.TypeANY }
+
+	var answers []dnsmsg.RR
+	switch {
+	case name == z.fqdn:
+		if match(dnsmsg.TypeSOA) {
+			answers = append(answers, z.soa())
+		}
+		if match(dnsmsg.TypeNS) {
+			for _, ns := range z.nameservers() {
+				rdata, _ := dnsmsg.PackName(ns)
+				answers = append(answers, dnsmsg.RR{Name: name, Type: dnsmsg.TypeNS, Class: dnsmsg.ClassIN, TTL: ttl, Rdata: rdata})
+			}
+		}
+		answers = append(answers, addressRRs(name, z.hosts, qtype, ttl)...)
+	case z.isNameserver(name):
+		answers = append(answers, addressRRs(name, z.config.NameserverIPs, qtype, ttl)...)
+	case z.records[name].addresses != nil:
+		answers = append(answers, addressRRs(name, z.records[name].addresses, qtype, z.records[name].ttl)...)
+	case z.txt[name] != nil:
+	default:
+		answers = append(answers, addressRRs(name, z.hosts, qtype, ttl)...)
+	}
+	if match(dnsmsg.TypeTXT) {
+		for _, text := range z.txt[name] {
+			answers = append(answers, dnsmsg.RR{Name: name, Type: dnsmsg.TypeTXT, Class: dnsmsg.ClassIN, TTL: ttl, Rdata: dnsmsg.TXTRdata(text)})
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil, []dnsmsg.RR{z.soa()}, dnsmsg.RcodeSuccess
+	}
+	return answers, nil, dnsmsg.RcodeSuccess
+}
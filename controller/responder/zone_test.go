@@ -0,0 +1,89 @@
+package responder
+
+import (
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/niusmallnan/kube-rdns/setting"
+)
+
+const zoneFqdn = "rdns.example.test"
+
+func newZone(t *testing.T, cfg Config) *Zone {
+	t.Helper()
+	if err := testutil.InitSettings(map[string]string{"provider": "responder", "desired-fqdn": zoneFqdn}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 60
+	}
+	z := New(cfg, setting.GetDomains()[0])
+	t.Cleanup(func() {
+		zonesLock.Lock()
+		delete(zones, z.fqdn)
+		zonesLock.Unlock()
+	})
+	return z
+}
+
+func TestZoneRecords(t *testing.T) {
+	z := newZone(t, Config{})
+	if err := z.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1"})); err != nil {
+		t.Fatal(err)
+	}
+	name := "db.default." + zoneFqdn
+	if err := z.SetRecords(name, []string{"2.2.2.2", "2001:db8::2"}, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	answers, _, _ := z.answer(name, dnsmsg.TypeA)
+	if len(answers) != 1 || answers[0].TTL != 30 {
+		t.Fatalf("A answers of %s = %+v, want one record with ttl 30", name, answers)
+	}
+	if answers, _, _ := z.answer(name, dnsmsg.TypeAAAA); len(answers) != 1 {
+		t.Fatalf("AAAA answers of %s = %+v, want one record", name, answers)
+	}
+	// the domain and the other names keep the hosts of the domain
+	for _, other := range []string{zoneFqdn, "web." + zoneFqdn} {
+		answers, _, _ := z.answer(other, dnsmsg.TypeA)
+		if len(answers) != 1 || answers[0].TTL != 60 {
+			t.Fatalf("A answers of %s = %+v, want the host of the domain", other, answers)
+		}
+	}
+
+	if err := z.DeleteRecords(name); err != nil {
+		t.Fatal(err)
+	}
+	if answers, _, _ := z.answer(name, dnsmsg.TypeAAAA); len(answers) != 0 {
+		t.Fatalf("AAAA answers of %s = %+v after delete, want the wildcard without ipv6 hosts", name, answers)
+	}
+
+	for _, bad := range []string{zoneFqdn, "ns." + zoneFqdn, "db.other.test"} {
+		if err := z.SetRecords(bad, []string{"2.2.2.2"}, 0); err == nil {
+			t.Fatalf("SetRecords(%s) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "default nameserver with addresses", cfg: Config{NameserverIPs: []string{"9.9.9.9"}}},
+		{name: "default nameserver without addresses", cfg: Config{}, wantErr: true},
+		{name: "nameserver within the zone without addresses", cfg: Config{Nameservers: []string{"dns." + zoneFqdn}}, wantErr: true},
+		{name: "nameservers outside the zone", cfg: Config{Nameservers: []string{"ns1.example.org", "ns2.example.org"}}},
+		{name: "invalid nameserver address", cfg: Config{NameserverIPs: []string{"9.9.9"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.cfg, zoneFqdn); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package rfc2136
+
+import (
+	"encoding/binary"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/pkg/errors"
+)
+
+const opcodeUpdate = 5
+
+// update is a dns update message, see RFC 2136 section 2
+type update struct {
+	id      uint16
+	zone    string
+	records []dnsmsg.RR
+}
+
+// pack encodes the message without any additional record
+func (u *update) pack() ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	buf = dnsmsg.AppendUint16(buf, u.id)
+	buf = dnsmsg.AppendUint16(buf, opcodeUpdate<<11)
+	buf = dnsmsg.AppendUint16(buf, 1) // ZOCOUNT
+	buf = dnsmsg.AppendUint16(buf, 0) // PRCOUNT
+	buf = dnsmsg.AppendUint16(buf, uint16(len(u.records)))
+	buf = dnsmsg.AppendUint16(buf, 0) // ADCOUNT
+
+	zone, err := dnsmsg.PackName(u.zone)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, zone...)
+	buf = dnsmsg.AppendUint16(buf, dnsmsg.TypeSOA)
+	buf = dnsmsg.AppendUint16(buf, dnsmsg.ClassIN)
+
+	for _, r := range u.records {
+		if buf, err = dnsmsg.AppendRR(buf, r); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// deleteRRset deletes all the records of the type at name, TypeANY deletes every rrset
+func deleteRRset(name string, rrtype uint16) dnsmsg.RR {
+	return dnsmsg.RR{Name: name, Type: rrtype, Class: dnsmsg.ClassANY}
+}
+
+func addTXT(name, text string, ttl uint32) dnsmsg.RR {
+	return dnsmsg.RR{Name: name, Type: dnsmsg.TypeTXT, Class: dnsmsg.ClassIN, TTL: ttl, Rdata: dnsmsg.TXTRdata(text)}
+}
+
+// deleteTXT deletes a single txt record, the other records of the rrset are kept
+func deleteTXT(name, text string) dnsmsg.RR {
+	return dnsmsg.RR{Name: name, Type: dnsmsg.TypeTXT, Class: dnsmsg.ClassNONE, Rdata: dnsmsg.TXTRdata(text)}
+}
+
+// readRR decodes the resource record at off and returns the offset after it
+func readRR(msg []byte, off int) (dnsmsg.RR, int, error) {
+	name, off, err := dnsmsg.ReadName(msg, off)
+	if err != nil {
+		return dnsmsg.RR{}, 0, err
+	}
+	if off+10 > len(msg) {
+		return dnsmsg.RR{}, 0, errors.New("short resource record")
+	}
+	r := dnsmsg.RR{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[off:]),
+		Class: binary.BigEndian.Uint16(msg[off+2:]),
+		TTL:   binary.BigEndian.Uint32(msg[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+length > len(msg) {
+		return dnsmsg.RR{}, 0, errors.New("rdata overflows the message")
+	}
+	r.Rdata = msg[off : off+length]
+	return r, off + length, nil
+}
+
+// lastRecord returns the offset of the last resource record of the message, which is where
+// the TSIG record has to be
+func lastRecord(msg []byte) (int, error) {
+	if len(msg) < dnsmsg.HeaderLen {
+		return 0, errors.New("short message")
+	}
+	off := dnsmsg.HeaderLen
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		_, next, err := dnsmsg.ReadName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		off = next + 4
+	}
+	count := 0
+	for _, c := range []int{6, 8, 10} {
+		count += int(binary.BigEndian.Uint16(msg[c : c+2]))
+	}
+	if count == 0 {
+		return 0, errors.New("message has no resource records")
+	}
+	for i := 0; i < count-1; i++ {
+		_, next, err := readRR(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		off = next
+	}
+	return off, nil
+}
+
+// checkResponse validates the header of the server response to the update with id
+func checkResponse(resp []byte, id uint16) error {
+	if len(resp) < dnsmsg.HeaderLen {
+		return errors.New("short response")
+	}
+	if binary.BigEndian.Uint16(resp[0:2]) != id {
+		return errors.New("response id does not match the request")
+	}
+	flags := binary.BigEndian.Uint16(resp[2:4])
+	if flags&0x8000 == 0 {
+		return errors.New("response is not flagged as a response")
+	}
+	if rcode := int(flags & 0xf); rcode != dnsmsg.RcodeSuccess {
+		return errors.Errorf("server answered %s", dnsmsg.RcodeName(rcode))
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package rfc2136
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/niusmallnan/rdns-server/model"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.For("rfc2136")
+
+// Config is the server, zone and key the dynamic updates are sent with
+type Config struct {
+	Server        string
+	Zone          string
+	TSIGKey       string
+	TSIGSecret    string
+	TSIGAlgorithm string
+	TTL           int
+	Timeout       time.Duration
+}
+
+// ConfigFromSettings returns the config of the rfc2136 flags
+func ConfigFromSettings() Config {
+	return Config{
+		Server:        setting.GetRFC2136Server(),
+		Zone:          setting.GetRFC2136Zone(),
+		TSIGKey:       setting.GetRFC2136TSIGKey(),
+		TSIGSecret:    setting.GetRFC2136TSIGSecret(),
+		TSIGAlgorithm: setting.GetRFC2136TSIGAlgorithm(),
+		TTL:           setting.GetRFC2136TTL(),
+		Timeout:       setting.GetRFC2136Timeout(),
+	}
+}
+
+// Validate checks the config for publishing fqdn, fqdn must be within the zone
+func Validate(cfg Config, fqdn string) error {
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		return errors.Wrapf(err, "invalid rfc2136 server %q", cfg.Server)
+	}
+	if cfg.Zone == "" {
+		return errors.New("rfc2136 zone is required")
+	}
+	if fqdn == "" {
+		return errors.New("rfc2136 requires a desired fqdn")
+	}
+	if !inZone(fqdn, cfg.Zone) {
+		return errors.Errorf("fqdn %s is not within the zone %s", fqdn, cfg.Zone)
+	}
+	if cfg.TTL < 0 {
+		return errors.Errorf("invalid rfc2136 ttl %d", cfg.TTL)
+	}
+	_, err := newTSIGKey(cfg.TSIGKey, cfg.TSIGAlgorithm, cfg.TSIGSecret)
+	return err
+}
+
+func inZone(name, zone string) bool {
+	name, zone = dnsmsg.Normalize(name), dnsmsg.Normalize(zone)
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// Provider publishes a domain and the wildcard below it with RFC 2136 dynamic updates.
+// The records have no expiration, renewing the domain sends the last hosts again so
+// records changed behind the back of the controller are repaired.
+type Provider struct {
+	config   Config
+	domain   setting.DomainConfig
+	fqdn     string
+	key      *tsigKey
+	selector *selector.Selector
+
+	lock      sync.RWMutex
+	lastHosts []string
+}
+
+// New returns the provider of the domain, the config must have been validated
+func New(cfg Config, domain setting.DomainConfig) *Provider {
+	key, _ := newTSIGKey(cfg.TSIGKey, cfg.TSIGAlgorithm, cfg.TSIGSecret)
+	return &Provider{
+		config:   cfg,
+		domain:   domain,
+		fqdn:     dnsmsg.Normalize(domain.DesiredFqdn),
+		key:      key,
+		selector: selector.New(setting.GetHostPolicy(), setting.GetMaxHosts()),
+	}
+}
+
+var _ rdns.Provider = &Provider{}
+
+func (p *Provider) Name() string {
+	return p.domain.Name
+}
+
+func (p *Provider) RootFqdn() string {
+	return p.fqdn
+}
+
+func (p *Provider) Rotate() bool {
+	return p.selector.Rotate()
+}
+
+func (p *Provider) State() rdns.State {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return rdns.State{
+		LastHosts:  append([]string(nil), p.lastHosts...),
+		LastDomain: &model.Domain{Fqdn: p.fqdn, Hosts: append([]string(nil), p.lastHosts...)},
+		Backend:    p.config.Server,
+	}
+}
+
+func (p *Provider) ApplyDomain(candidates []selector.Host) error {
+	if len(candidates) == 0 {
+		return errors.New("ApplyDomain: hosts should not be empty")
+	}
+
+	hosts := p.selector.Select(candidates, p.fqdn)
+	sort.Strings(hosts)
+
+	p.lock.RLock()
+	unchanged := reflect.DeepEqual(p.lastHosts, hosts)
+	p.lock.RUnlock()
+	if unchanged {
+		log.WithField(logging.FieldFqdn, p.fqdn).Debug("Domain hosts unchanged")
+		return nil
+	}
+
+	return p.setHosts("ApplyDomain", hosts)
+}
+
+func (p *Provider) setHosts(op string, hosts []string) error {
+	if setting.IsDryRun() {
+		p.lock.RLock()
+		added, removed := dryrun.Diff(p.lastHosts, hosts)
+		p.lock.RUnlock()
+		dryrun.Record(dryrun.Action{Operation: "update domain", Target: p.fqdn, Added: added, Removed: removed, Message: fmt.Sprintf("set hosts to %s with rfc2136", hosts)})
+		return nil
+	}
+
+	var records []dnsmsg.RR
+	for _, name := range []string{p.fqdn, "*." + p.fqdn} {
+		records = append(records, deleteRRset(name, dnsmsg.TypeA), deleteRRset(name, dnsmsg.TypeAAAA))
+		for _, host := range hosts {
+			r, err := dnsmsg.AddressRR(name, host, uint32(p.config.TTL))
+			if err != nil {
+				return errors.Wrapf(err, "%s: failed to build the update", op)
+			}
+			records = append(records, r)
+		}
+	}
+	if err := p.send(records); err != nil {
+		return errors.Wrapf(err, "%s: failed to update %s", op, p.fqdn)
+	}
+
+	p.lock.Lock()
+	p.lastHosts = hosts
+	p.lock.Unlock()
+	log.WithFields(logrus.Fields{logging.FieldFqdn: p.fqdn, logging.FieldHosts: hosts, logging.FieldBackend: p.config.Server}).Info("Updated domain")
+	return nil
+}
+
+func (p *Provider) RenewDomain() error {
+	p.lock.RLock()
+	hosts := p.lastHosts
+	p.lock.RUnlock()
+	if len(hosts) == 0 {
+		return errors.New("RenewDomain: no hosts have been published yet")
+	}
+	return p.setHosts("RenewDomain", hosts)
+}
+
+func (p *Provider) GetDomain() (model.Domain, error) {
+	return *p.State().LastDomain, nil
+}
+
+func (p *Provider) DeleteDomain() error {
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: "delete domain", Target: p.fqdn})
+		return nil
+	}
+	err := p.send([]dnsmsg.RR{deleteRRset(p.fqdn, dnsmsg.TypeANY), deleteRRset("*."+p.fqdn, dnsmsg.TypeANY)})
+	if err != nil {
+		return errors.Wrapf(err, "DeleteDomain: failed to delete %s", p.fqdn)
+	}
+	p.lock.Lock()
+	p.lastHosts = nil
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *Provider) SetRecords(name string, addresses []string, ttl uint32) error {
+	if len(addresses) == 0 {
+		return errors.Errorf("SetRecords: addresses of %s should not be empty", name)
+	}
+	if ttl == 0 {
+		ttl = uint32(p.config.TTL)
+	}
+	records := []dnsmsg.RR{deleteRRset(name, dnsmsg.TypeA), deleteRRset(name, dnsmsg.TypeAAAA)}
+	for _, address := range addresses {
+		r, err := dnsmsg.AddressRR(name, address, ttl)
+		if err != nil {
+			return errors.Wrap(err, "SetRecords: failed to build the update")
+		}
+		records = append(records, r)
+	}
+	return p.nameRecords("SetRecords", name, records, fmt.Sprintf("set addresses to %s", addresses))
+}
+
+func (p *Provider) DeleteRecords(name string) error {
+	return p.nameRecords("DeleteRecords", name, []dnsmsg.RR{deleteRRset(name, dnsmsg.TypeA), deleteRRset(name, dnsmsg.TypeAAAA)}, "delete addresses")
+}
+
+// nameRecords sends the update of records at name, which must be below the domain
+func (p *Provider) nameRecords(op, name string, records []dnsmsg.RR, message string) error {
+	if !strings.HasSuffix(dnsmsg.Normalize(name), "."+p.fqdn) {
+		return errors.Errorf("%s: %s is not under the domain %s", op, name, p.fqdn)
+	}
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: strings.ToLower(op), Target: name, Message: fmt.Sprintf("%s on domain %s", message, p.fqdn)})
+		return nil
+	}
+	if err := p.send(records); err != nil {
+		return errors.Wrapf(err, "%s: failed to update %s", op, name)
+	}
+	log.WithFields(logrus.Fields{logging.FieldFqdn: name, logging.FieldOperation: op, logging.FieldBackend: p.config.Server}).Info("Updated records")
+	return nil
+}
+
+func (p *Provider) SetTXTRecord(name, text string) error {
+	return p.txtRecord("SetTXTRecord", name, addTXT(name, text, uint32(p.config.TTL)))
+}
+
+func (p *Provider) DeleteTXTRecord(name, text string) error {
+	return p.txtRecord("DeleteTXTRecord", name, deleteTXT(name, text))
+}
+
+func (p *Provider) txtRecord(op, name string, record dnsmsg.RR) error {
+	if !strings.HasSuffix(dnsmsg.Normalize(name), "."+p.fqdn) {
+		return errors.Errorf("%s: %s is not under the domain %s", op, name, p.fqdn)
+	}
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{Operation: strings.ToLower(op), Target: name, Message: fmt.Sprintf("on domain %s", p.fqdn)})
+		return nil
+	}
+	if err := p.send([]dnsmsg.RR{record}); err != nil {
+		return errors.Wrapf(err, "%s: failed to update %s", op, name)
+	}
+	return nil
+}
+
+// send signs the update and exchanges it with the server over tcp. With a key the response
+// has to be signed too, so a response of anyone but the key holder is not trusted.
+func (p *Provider) send(records []dnsmsg.RR) error {
+	u := &update{id: uint16(rand.Intn(1 << 16)), zone: p.config.Zone, records: records}
+	msg, err := u.pack()
+	if err != nil {
+		return err
+	}
+	var mac []byte
+	if p.key != nil {
+		if msg, mac, err = p.key.sign(msg, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", p.config.Server, p.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.config.Timeout))
+
+	out := dnsmsg.AppendUint16(make([]byte, 0, len(msg)+2), uint16(len(msg)))
+	if _, err := conn.Write(append(out, msg...)); err != nil {
+		return err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return errors.Wrap(err, "failed to read the response")
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return errors.Wrap(err, "failed to read the response")
+	}
+	if err := checkResponse(resp, u.id); err != nil {
+		return err
+	}
+	if p.key != nil {
+		return p.key.verify(resp, mac, time.Now())
+	}
+	return nil
+}
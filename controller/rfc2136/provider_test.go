@@ -0,0 +1,404 @@
+package rfc2136
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/niusmallnan/kube-rdns/setting"
+)
+
+const (
+	testZone    = "example.test"
+	testFqdn    = "rdns.example.test"
+	testKeyName = "kube-rdns"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// exchange is an update received by the server
+type exchange struct {
+	zone    string
+	prereqs []dnsmsg.RR
+	updates []dnsmsg.RR
+	tsig    *dnsmsg.RR
+}
+
+// server is an authoritative server accepting dynamic updates over tcp. It checks the TSIG
+// of the requests with secret, and signs its responses with signWith.
+type server struct {
+	t        *testing.T
+	addr     string
+	secret   []byte
+	signWith []byte
+	rcode    int
+
+	lock      sync.Mutex
+	exchanges []exchange
+}
+
+func newServer(t *testing.T, secret []byte) *server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &server{t: t, addr: l.Addr().String(), secret: secret, signWith: secret}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *server) received() []exchange {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]exchange(nil), s.exchanges...)
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	req := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+
+	ex, zoneEnd, mac, err := s.decode(req)
+	if err != nil {
+		s.t.Errorf("invalid update: %v", err)
+		return
+	}
+	s.lock.Lock()
+	s.exchanges = append(s.exchanges, ex)
+	rcode := s.rcode
+	s.lock.Unlock()
+
+	resp := append([]byte(nil), req[0:2]...)
+	resp = dnsmsg.AppendUint16(resp, 0x8000|opcodeUpdate<<11|uint16(rcode))
+	resp = dnsmsg.AppendUint16(resp, 1)
+	resp = append(resp, 0, 0, 0, 0, 0, 0)
+	resp = append(resp, req[dnsmsg.HeaderLen:zoneEnd]...)
+	if s.signWith != nil {
+		resp = signResponse(resp, mac, s.signWith, time.Now())
+	}
+	conn.Write(append(dnsmsg.AppendUint16(nil, uint16(len(resp))), resp...))
+}
+
+// decode parses the update and verifies its TSIG, it returns the end of the zone section and the request mac
+func (s *server) decode(req []byte) (exchange, int, []byte, error) {
+	var ex exchange
+	if len(req) < dnsmsg.HeaderLen {
+		return ex, 0, nil, io.ErrUnexpectedEOF
+	}
+	if opcode := binary.BigEndian.Uint16(req[2:4]) >> 11 & 0xf; opcode != opcodeUpdate {
+		s.t.Errorf("opcode = %d, want %d", opcode, opcodeUpdate)
+	}
+	counts := make([]int, 4)
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(req[4+2*i:]))
+	}
+	if counts[0] != 1 {
+		s.t.Errorf("ZOCOUNT = %d, want 1", counts[0])
+	}
+	zone, off, err := dnsmsg.ReadName(req, dnsmsg.HeaderLen)
+	if err != nil {
+		return ex, 0, nil, err
+	}
+	if zoneType := binary.BigEndian.Uint16(req[off:]); zoneType != dnsmsg.TypeSOA {
+		s.t.Errorf("zone type = %d, want SOA", zoneType)
+	}
+	ex.zone = zone
+	off += 4
+	zoneEnd := off
+
+	sections := []*[]dnsmsg.RR{&ex.prereqs, &ex.updates}
+	for i, section := range sections {
+		for j := 0; j < counts[i+1]; j++ {
+			var r dnsmsg.RR
+			if r, off, err = readRR(req, off); err != nil {
+				return ex, 0, nil, err
+			}
+			*section = append(*section, r)
+		}
+	}
+	if counts[3] == 0 {
+		return ex, zoneEnd, nil, nil
+	}
+	if counts[3] != 1 {
+		s.t.Errorf("ADCOUNT = %d, want the TSIG record only", counts[3])
+	}
+	start := off
+	r, _, err := readRR(req, off)
+	if err != nil {
+		return ex, 0, nil, err
+	}
+	ex.tsig = &r
+	if r.Type != dnsmsg.TypeTSIG {
+		s.t.Errorf("additional record type = %d, want TSIG", r.Type)
+		return ex, zoneEnd, nil, nil
+	}
+
+	// the request mac covers the message without the TSIG record and the TSIG variables
+	alg, roff, err := dnsmsg.ReadName(r.Rdata, 0)
+	if err != nil {
+		return ex, 0, nil, err
+	}
+	timeSigned := r.Rdata[roff : roff+6]
+	fudge := binary.BigEndian.Uint16(r.Rdata[roff+6:])
+	size := int(binary.BigEndian.Uint16(r.Rdata[roff+8:]))
+	mac := r.Rdata[roff+10 : roff+10+size]
+	msg := append([]byte(nil), req[:start]...)
+	binary.BigEndian.PutUint16(msg[10:12], 0)
+	if want := testMAC(s.secret, nil, msg, r.Name, alg, timeSigned, fudge); !hmac.Equal(mac, want) {
+		s.t.Errorf("request TSIG does not verify")
+	}
+	return ex, zoneEnd, mac, nil
+}
+
+// testMAC computes a hmac-sha256 TSIG mac, RFC 8945 sections 4.3.3 and 5.3
+func testMAC(secret, requestMAC, msg []byte, keyName, alg string, timeSigned []byte, fudge uint16) []byte {
+	mac := hmac.New(sha256.New, secret)
+	if requestMAC != nil {
+		mac.Write(dnsmsg.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	name, _ := dnsmsg.PackName(keyName)
+	algName, _ := dnsmsg.PackName(alg)
+	mac.Write(name)
+	mac.Write([]byte{0, dnsmsg.ClassANY, 0, 0, 0, 0})
+	mac.Write(algName)
+	mac.Write(timeSigned)
+	mac.Write(dnsmsg.AppendUint16(nil, fudge))
+	mac.Write([]byte{0, 0, 0, 0})
+	return mac.Sum(nil)
+}
+
+func signResponse(resp, requestMAC, secret []byte, now time.Time) []byte {
+	signed := uint64(now.Unix())
+	timeSigned := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+	mac := testMAC(secret, requestMAC, resp, testKeyName, "hmac-sha256", timeSigned, tsigFudge)
+	rdata, _ := dnsmsg.PackName("hmac-sha256")
+	rdata = append(rdata, timeSigned...)
+	rdata = dnsmsg.AppendUint16(rdata, tsigFudge)
+	rdata = dnsmsg.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, resp[0:2]...)
+	rdata = append(rdata, 0, 0, 0, 0)
+	out, _ := dnsmsg.AppendRR(append([]byte(nil), resp...), dnsmsg.RR{Name: testKeyName, Type: dnsmsg.TypeTSIG, Class: dnsmsg.ClassANY, Rdata: rdata})
+	binary.BigEndian.PutUint16(out[10:12], 1)
+	return out
+}
+
+func newProvider(t *testing.T, addr string, secret []byte) *Provider {
+	t.Helper()
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Server: addr, Zone: testZone, TTL: 300, Timeout: time.Second, TSIGAlgorithm: "hmac-sha256"}
+	if secret != nil {
+		cfg.TSIGKey = testKeyName
+		cfg.TSIGSecret = base64.StdEncoding.EncodeToString(secret)
+	}
+	if err := Validate(cfg, testFqdn); err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg, setting.DomainConfig{Name: "default", DesiredFqdn: testFqdn})
+}
+
+func describe(records []dnsmsg.RR) []string {
+	var out []string
+	for _, r := range records {
+		s := r.Name + " "
+		switch {
+		case r.Class == dnsmsg.ClassANY && r.Type == dnsmsg.TypeANY:
+			s += "delete all"
+		case r.Class == dnsmsg.ClassANY:
+			s += "delete " + typeName(r.Type)
+		case r.Class == dnsmsg.ClassNONE:
+			s += "delete " + typeName(r.Type) + " " + rdataString(r)
+		default:
+			s += "add " + typeName(r.Type) + " " + rdataString(r) + " " + strconv.Itoa(int(r.TTL))
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func typeName(t uint16) string {
+	switch t {
+	case dnsmsg.TypeA:
+		return "A"
+	case dnsmsg.TypeAAAA:
+		return "AAAA"
+	case dnsmsg.TypeTXT:
+		return "TXT"
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+func rdataString(r dnsmsg.RR) string {
+	if r.Type == dnsmsg.TypeTXT {
+		return string(r.Rdata[1:])
+	}
+	return net.IP(r.Rdata).String()
+}
+
+func TestUpdates(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(p *Provider) error
+		want []string
+	}{
+		{
+			name: "set records",
+			send: func(p *Provider) error {
+				return p.SetRecords("web."+testFqdn, []string{"1.1.1.1", "2001:db8::1"}, 60)
+			},
+			want: []string{
+				"web.rdns.example.test delete A",
+				"web.rdns.example.test delete AAAA",
+				"web.rdns.example.test add A 1.1.1.1 60",
+				"web.rdns.example.test add AAAA 2001:db8::1 60",
+			},
+		},
+		{
+			name: "set records with the ttl of the provider",
+			send: func(p *Provider) error { return p.SetRecords("web."+testFqdn, []string{"1.1.1.1"}, 0) },
+			want: []string{
+				"web.rdns.example.test delete A",
+				"web.rdns.example.test delete AAAA",
+				"web.rdns.example.test add A 1.1.1.1 300",
+			},
+		},
+		{
+			name: "delete records",
+			send: func(p *Provider) error { return p.DeleteRecords("web." + testFqdn) },
+			want: []string{"web.rdns.example.test delete A", "web.rdns.example.test delete AAAA"},
+		},
+		{
+			name: "set txt record",
+			send: func(p *Provider) error { return p.SetTXTRecord("_acme-challenge."+testFqdn, "token") },
+			want: []string{"_acme-challenge.rdns.example.test add TXT token 300"},
+		},
+		{
+			name: "delete txt record",
+			send: func(p *Provider) error { return p.DeleteTXTRecord("_acme-challenge."+testFqdn, "token") },
+			want: []string{"_acme-challenge.rdns.example.test delete TXT token"},
+		},
+		{
+			name: "delete domain",
+			send: func(p *Provider) error { return p.DeleteDomain() },
+			want: []string{"rdns.example.test delete all", "*.rdns.example.test delete all"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, testSecret)
+			p := newProvider(t, s.addr, testSecret)
+			if err := tt.send(p); err != nil {
+				t.Fatal(err)
+			}
+
+			exchanges := s.received()
+			if len(exchanges) != 1 {
+				t.Fatalf("%d updates were received, want 1", len(exchanges))
+			}
+			ex := exchanges[0]
+			if ex.zone != testZone {
+				t.Fatalf("zone = %s, want %s", ex.zone, testZone)
+			}
+			if len(ex.prereqs) != 0 {
+				t.Fatalf("prerequisites = %v, want none", describe(ex.prereqs))
+			}
+			if got := describe(ex.updates); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("updates =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if ex.tsig == nil || dnsmsg.Normalize(ex.tsig.Name) != testKeyName || ex.tsig.Class != dnsmsg.ClassANY {
+				t.Fatalf("tsig = %+v, want the record of the key %s", ex.tsig, testKeyName)
+			}
+		})
+	}
+}
+
+func TestApplyDomain(t *testing.T) {
+	s := newServer(t, nil)
+	p := newProvider(t, s.addr, nil)
+	if err := p.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1"})); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"rdns.example.test delete A",
+		"rdns.example.test delete AAAA",
+		"rdns.example.test add A 1.1.1.1 300",
+		"*.rdns.example.test delete A",
+		"*.rdns.example.test delete AAAA",
+		"*.rdns.example.test add A 1.1.1.1 300",
+	}
+	exchanges := s.received()
+	if len(exchanges) != 1 || exchanges[0].tsig != nil {
+		t.Fatalf("updates = %+v, want one unsigned update", exchanges)
+	}
+	if got := describe(exchanges[0].updates); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("updates =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the same hosts are not sent again
+	if err := p.ApplyDomain(selector.FromAddresses([]string{"1.1.1.1"})); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.received()); n != 1 {
+		t.Fatalf("%d updates were received, want 1", n)
+	}
+}
+
+func TestResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		rcode    int
+		key      []byte
+		signWith []byte
+		wantErr  string
+	}{
+		{name: "noerror", rcode: dnsmsg.RcodeSuccess, key: testSecret, signWith: testSecret},
+		{name: "notauth", rcode: dnsmsg.RcodeNotAuth, key: testSecret, signWith: testSecret, wantErr: "NOTAUTH"},
+		{name: "refused", rcode: dnsmsg.RcodeRefused, key: testSecret, signWith: testSecret, wantErr: "REFUSED"},
+		{name: "unsigned without a key", rcode: dnsmsg.RcodeSuccess},
+		{name: "unsigned response", rcode: dnsmsg.RcodeSuccess, key: testSecret, wantErr: "not signed"},
+		{name: "response signed with another secret", rcode: dnsmsg.RcodeSuccess, key: testSecret, signWith: []byte("another secret"), wantErr: "does not verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, tt.key)
+			s.rcode, s.signWith = tt.rcode, tt.signWith
+			p := newProvider(t, s.addr, tt.key)
+
+			err := p.SetRecords("web."+testFqdn, []string{"1.1.1.1"}, 0)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("SetRecords() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
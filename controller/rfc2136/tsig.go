@@ -0,0 +1,202 @@
+package rfc2136
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/dnsmsg"
+	"github.com/pkg/errors"
+)
+
+const tsigFudge = 300
+
+var tsigAlgorithms = map[string]struct {
+	name string
+	hash func() hash.Hash
+}{
+	"hmac-md5":    {"hmac-md5.sig-alg.reg.int", md5.New},
+	"hmac-sha1":   {"hmac-sha1", sha1.New},
+	"hmac-sha256": {"hmac-sha256", sha256.New},
+	"hmac-sha512": {"hmac-sha512", sha512.New},
+}
+
+// tsigKey signs the update messages, see RFC 8945
+type tsigKey struct {
+	name      string
+	algorithm string
+	hash      func() hash.Hash
+	secret    []byte
+}
+
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	if name == "" {
+		return nil, nil
+	}
+	alg, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(algorithm, "."))]
+	if !ok {
+		return nil, errors.Errorf("unsupported TSIG algorithm %q", algorithm)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "TSIG secret is not valid base64")
+	}
+	if len(decoded) == 0 {
+		return nil, errors.New("TSIG secret is empty")
+	}
+	return &tsigKey{name: name, algorithm: alg.name, hash: alg.hash, secret: decoded}, nil
+}
+
+var tsigErrors = map[uint16]string{
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+	22: "BADTRUNC",
+}
+
+func tsigErrorName(code uint16) string {
+	if name, ok := tsigErrors[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("TSIG error %d", code)
+}
+
+// digest returns the mac of the message and the TSIG variables, RFC 8945 section 4.3.3.
+// The mac of a response also covers the mac of its request.
+func (k *tsigKey) digest(requestMAC, msg, timeSigned []byte, fudge, tsigError uint16, other []byte) ([]byte, error) {
+	keyName, err := dnsmsg.PackName(k.name)
+	if err != nil {
+		return nil, err
+	}
+	algName, err := dnsmsg.PackName(k.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(k.hash, k.secret)
+	if requestMAC != nil {
+		mac.Write(dnsmsg.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	vars := append([]byte(nil), keyName...)
+	vars = dnsmsg.AppendUint16(vars, dnsmsg.ClassANY)
+	vars = dnsmsg.AppendUint32(vars, 0)
+	vars = append(vars, algName...)
+	vars = append(vars, timeSigned...)
+	vars = dnsmsg.AppendUint16(vars, fudge)
+	vars = dnsmsg.AppendUint16(vars, tsigError)
+	vars = dnsmsg.AppendUint16(vars, uint16(len(other)))
+	vars = append(vars, other...)
+	mac.Write(vars)
+	return mac.Sum(nil), nil
+}
+
+// sign appends the TSIG record to a packed message which has no additional records, the mac
+// is returned to verify the response with
+func (k *tsigKey) sign(msg []byte, now time.Time) ([]byte, []byte, error) {
+	algName, err := dnsmsg.PackName(k.algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := uint64(now.Unix())
+	timeSigned := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+	sum, err := k.digest(nil, msg, timeSigned, tsigFudge, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rdata := append([]byte(nil), algName...)
+	rdata = append(rdata, timeSigned...)
+	rdata = dnsmsg.AppendUint16(rdata, tsigFudge)
+	rdata = dnsmsg.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0:2]...)    // original id
+	rdata = dnsmsg.AppendUint16(rdata, 0) // error
+	rdata = dnsmsg.AppendUint16(rdata, 0) // other len
+
+	out := append([]byte(nil), msg...)
+	out, err = dnsmsg.AppendRR(out, dnsmsg.RR{Name: k.name, Type: dnsmsg.TypeTSIG, Class: dnsmsg.ClassANY, Rdata: rdata})
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(out[10:12])+1)
+	return out, sum, nil
+}
+
+// verify checks the TSIG record of the response to a request signed with requestMAC,
+// RFC 8945 section 5.3
+func (k *tsigKey) verify(resp, requestMAC []byte, now time.Time) error {
+	start, err := lastRecord(resp)
+	if err != nil {
+		return errors.Wrap(err, "response is not signed")
+	}
+	r, _, err := readRR(resp, start)
+	if err != nil {
+		return err
+	}
+	if r.Type != dnsmsg.TypeTSIG || binary.BigEndian.Uint16(resp[10:12]) == 0 {
+		return errors.New("response is not signed")
+	}
+	if dnsmsg.Normalize(r.Name) != dnsmsg.Normalize(k.name) {
+		return errors.Errorf("response is signed with the key %s", r.Name)
+	}
+
+	// the rdata names are not compressed, the offsets are relative to the rdata
+	algorithm, off, err := dnsmsg.ReadName(r.Rdata, 0)
+	if err != nil {
+		return err
+	}
+	if algorithm != dnsmsg.Normalize(k.algorithm) {
+		return errors.Errorf("response is signed with the algorithm %s", algorithm)
+	}
+	if off+10 > len(r.Rdata) {
+		return errors.New("short response TSIG record")
+	}
+	timeSigned := r.Rdata[off : off+6]
+	fudge := binary.BigEndian.Uint16(r.Rdata[off+6:])
+	size := int(binary.BigEndian.Uint16(r.Rdata[off+8:]))
+	off += 10
+	if off+size+6 > len(r.Rdata) {
+		return errors.New("short response TSIG record")
+	}
+	sum := r.Rdata[off : off+size]
+	originalID := r.Rdata[off+size : off+size+2]
+	tsigError := binary.BigEndian.Uint16(r.Rdata[off+size+2:])
+	otherLen := int(binary.BigEndian.Uint16(r.Rdata[off+size+4:]))
+	if off+size+6+otherLen > len(r.Rdata) {
+		return errors.New("short response TSIG record")
+	}
+	other := r.Rdata[off+size+6 : off+size+6+otherLen]
+	if tsigError != 0 {
+		return errors.Errorf("server answered %s", tsigErrorName(tsigError))
+	}
+
+	// the digest covers the response without the TSIG record and with the original id
+	msg := append([]byte(nil), resp[:start]...)
+	copy(msg[0:2], originalID)
+	binary.BigEndian.PutUint16(msg[10:12], binary.BigEndian.Uint16(msg[10:12])-1)
+	want, err := k.digest(requestMAC, msg, timeSigned, fudge, tsigError, other)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sum, want) {
+		return errors.New("response TSIG does not verify")
+	}
+
+	var signed int64
+	for _, b := range timeSigned {
+		signed = signed<<8 | int64(b)
+	}
+	if skew := now.Unix() - signed; skew > int64(fudge) || -skew > int64(fudge) {
+		return errors.Errorf("response TSIG was signed %ds away from now, more than the fudge of %ds", skew, fudge)
+	}
+	return nil
+}
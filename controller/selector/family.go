@@ -0,0 +1,48 @@
+package selector
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyDual = "dual"
+)
+
+// ValidateFamily returns an error if the ip family is not supported
+func ValidateFamily(family string) error {
+	switch family {
+	case FamilyIPv4, FamilyIPv6, FamilyDual:
+		return nil
+	}
+	return errors.Errorf("unknown ip family %q, must be one of %s, %s, %s", family, FamilyIPv4, FamilyIPv6, FamilyDual)
+}
+
+// Families returns the single address families enabled by family
+func Families(family string) []string {
+	if family == FamilyDual {
+		return []string{FamilyIPv4, FamilyIPv6}
+	}
+	return []string{family}
+}
+
+// AddressFamily returns the family of the address, or an empty string if it is not an ip
+func AddressFamily(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// MatchFamily returns true if the address belongs to one of the families enabled by family
+func MatchFamily(address, family string) bool {
+	f := AddressFamily(address)
+	return f != "" && (family == FamilyDual || family == f)
+}
@@ -0,0 +1,169 @@
+package selector
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	PolicyOrdered    = "ordered"
+	PolicyReady      = "ready"
+	PolicyZone       = "zone"
+	PolicyHash       = "hash"
+	PolicyRoundRobin = "round-robin"
+)
+
+// Policies lists the supported host selection policies
+var Policies = []string{PolicyOrdered, PolicyReady, PolicyZone, PolicyHash, PolicyRoundRobin}
+
+// Host is a candidate address with the metadata of the node it belongs to
+type Host struct {
+	Address string `json:"address"`
+	Node    string `json:"node,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	Ready   bool   `json:"ready"`
+}
+
+// FromAddresses builds candidates for addresses without any node metadata
+func FromAddresses(addresses []string) []Host {
+	hosts := make([]Host, 0, len(addresses))
+	for _, a := range addresses {
+		hosts = append(hosts, Host{Address: a, Ready: true})
+	}
+	return hosts
+}
+
+// ValidatePolicy returns an error if the policy is not supported
+func ValidatePolicy(policy string) error {
+	for _, p := range Policies {
+		if p == policy {
+			return nil
+		}
+	}
+	return errors.Errorf("unknown host policy %q, must be one of %s", policy, Policies)
+}
+
+// Selector picks at most max addresses out of the candidates in a deterministic order
+type Selector struct {
+	policy string
+	max    int
+
+	lock   sync.Mutex
+	offset int
+}
+
+func New(policy string, max int) *Selector {
+	return &Selector{policy: policy, max: max}
+}
+
+// Rotate advances the round-robin window, it returns false for the other policies
+func (s *Selector) Rotate() bool {
+	if s.policy != PolicyRoundRobin {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.offset++
+	return true
+}
+
+// Select returns the addresses to publish, seed keeps the hash policy stable per domain.
+// Each address family is selected on its own so that max applies per family.
+func (s *Selector) Select(candidates []Host, seed string) []string {
+	byFamily := make(map[string][]Host)
+	for _, h := range candidates {
+		f := AddressFamily(h.Address)
+		byFamily[f] = append(byFamily[f], h)
+	}
+
+	var addresses []string
+	for _, f := range []string{FamilyIPv4, FamilyIPv6, ""} {
+		if len(byFamily[f]) > 0 {
+			addresses = append(addresses, s.selectFamily(byFamily[f], seed)...)
+		}
+	}
+	return addresses
+}
+
+func (s *Selector) selectFamily(candidates []Host, seed string) []string {
+	hosts := dedupe(candidates)
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Address < hosts[j].Address })
+
+	switch s.policy {
+	case PolicyReady:
+		sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Ready && !hosts[j].Ready })
+	case PolicyZone:
+		hosts = spreadZones(hosts)
+	case PolicyHash:
+		sort.SliceStable(hosts, func(i, j int) bool { return score(seed, hosts[i].Address) > score(seed, hosts[j].Address) })
+	case PolicyRoundRobin:
+		if len(hosts) > 0 {
+			s.lock.Lock()
+			offset := s.offset % len(hosts)
+			s.lock.Unlock()
+			rotated := make([]Host, 0, len(hosts))
+			rotated = append(rotated, hosts[offset:]...)
+			hosts = append(rotated, hosts[:offset]...)
+		}
+	}
+
+	if s.max > 0 && len(hosts) > s.max {
+		hosts = hosts[:s.max]
+	}
+
+	addresses := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		addresses = append(addresses, h.Address)
+	}
+	return addresses
+}
+
+func dedupe(candidates []Host) []Host {
+	seen := make(map[string]bool, len(candidates))
+	var hosts []Host
+	for _, h := range candidates {
+		if h.Address == "" || seen[h.Address] {
+			continue
+		}
+		seen[h.Address] = true
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// spreadZones takes one host from each zone in turn, ready hosts first within a zone
+func spreadZones(hosts []Host) []Host {
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Ready && !hosts[j].Ready })
+
+	var zones []string
+	byZone := make(map[string][]Host)
+	for _, h := range hosts {
+		if _, ok := byZone[h.Zone]; !ok {
+			zones = append(zones, h.Zone)
+		}
+		byZone[h.Zone] = append(byZone[h.Zone], h)
+	}
+	sort.Strings(zones)
+
+	spread := make([]Host, 0, len(hosts))
+	for len(spread) < len(hosts) {
+		for _, zone := range zones {
+			if len(byZone[zone]) > 0 {
+				spread = append(spread, byZone[zone][0])
+				byZone[zone] = byZone[zone][1:]
+			}
+		}
+	}
+	return spread
+}
+
+// score implements rendezvous hashing so that adding or removing a host only moves that host
+func score(seed, address string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte(address))
+	return h.Sum64()
+}
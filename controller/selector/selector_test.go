@@ -0,0 +1,214 @@
+package selector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		max        int
+		candidates []Host
+		want       string
+	}{
+		{
+			name:       "ordered sorts before truncating",
+			policy:     PolicyOrdered,
+			max:        2,
+			candidates: FromAddresses([]string{"3.3.3.3", "1.1.1.1", "2.2.2.2"}),
+			want:       "1.1.1.1,2.2.2.2",
+		},
+		{
+			name:       "ordered without a maximum",
+			policy:     PolicyOrdered,
+			candidates: FromAddresses([]string{"3.3.3.3", "1.1.1.1", "2.2.2.2"}),
+			want:       "1.1.1.1,2.2.2.2,3.3.3.3",
+		},
+		{
+			name:       "duplicate and empty addresses",
+			policy:     PolicyOrdered,
+			candidates: FromAddresses([]string{"2.2.2.2", "", "1.1.1.1", "2.2.2.2"}),
+			want:       "1.1.1.1,2.2.2.2",
+		},
+		{
+			name:   "ready hosts first",
+			policy: PolicyReady,
+			max:    2,
+			candidates: []Host{
+				{Address: "1.1.1.1"},
+				{Address: "2.2.2.2", Ready: true},
+				{Address: "3.3.3.3"},
+				{Address: "4.4.4.4", Ready: true},
+			},
+			want: "2.2.2.2,4.4.4.4",
+		},
+		{
+			name:   "unready hosts fill up to the maximum",
+			policy: PolicyReady,
+			max:    3,
+			candidates: []Host{
+				{Address: "3.3.3.3"},
+				{Address: "2.2.2.2", Ready: true},
+				{Address: "1.1.1.1"},
+			},
+			want: "2.2.2.2,1.1.1.1,3.3.3.3",
+		},
+		{
+			name:   "one host per zone in turn",
+			policy: PolicyZone,
+			max:    3,
+			candidates: []Host{
+				{Address: "1.1.1.1", Zone: "a", Ready: true},
+				{Address: "2.2.2.2", Zone: "a", Ready: true},
+				{Address: "3.3.3.3", Zone: "b", Ready: true},
+				{Address: "4.4.4.4", Zone: "b", Ready: true},
+				{Address: "5.5.5.5", Zone: "c", Ready: true},
+			},
+			want: "1.1.1.1,3.3.3.3,5.5.5.5",
+		},
+		{
+			name:   "ready hosts first within a zone",
+			policy: PolicyZone,
+			max:    2,
+			candidates: []Host{
+				{Address: "1.1.1.1", Zone: "a"},
+				{Address: "2.2.2.2", Zone: "a", Ready: true},
+				{Address: "3.3.3.3", Zone: "b", Ready: true},
+			},
+			want: "2.2.2.2,3.3.3.3",
+		},
+		{
+			name:   "hosts without a zone",
+			policy: PolicyZone,
+			candidates: []Host{
+				{Address: "2.2.2.2", Ready: true},
+				{Address: "1.1.1.1", Zone: "a", Ready: true},
+				{Address: "3.3.3.3", Ready: true},
+			},
+			want: "2.2.2.2,1.1.1.1,3.3.3.3",
+		},
+		{
+			name:       "round-robin starts at the first host",
+			policy:     PolicyRoundRobin,
+			max:        2,
+			candidates: FromAddresses([]string{"3.3.3.3", "2.2.2.2", "1.1.1.1"}),
+			want:       "1.1.1.1,2.2.2.2",
+		},
+		{
+			name:       "maximum per address family",
+			policy:     PolicyOrdered,
+			max:        1,
+			candidates: FromAddresses([]string{"2001:db8::2", "2.2.2.2", "2001:db8::1", "1.1.1.1"}),
+			want:       "1.1.1.1,2001:db8::1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(New(tt.policy, tt.max).Select(tt.candidates, "seed"), ","); got != tt.want {
+				t.Fatalf("Select() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectHash(t *testing.T) {
+	addresses := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5", "6.6.6.6"}
+	reversed := make([]string, 0, len(addresses))
+	for i := len(addresses) - 1; i >= 0; i-- {
+		reversed = append(reversed, addresses[i])
+	}
+	s := New(PolicyHash, 3)
+	selected := s.Select(FromAddresses(addresses), "cluster.lb.rancher.cloud")
+
+	tests := []struct {
+		name       string
+		candidates []string
+		want       []string
+	}{
+		{name: "same candidates", candidates: addresses, want: selected},
+		{name: "candidates in another order", candidates: reversed, want: selected},
+		{name: "unselected host removed", candidates: without(addresses, unselected(addresses, selected)), want: selected},
+		{name: "host added", candidates: append(append([]string{}, addresses...), "7.7.7.7")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.Select(FromAddresses(tt.candidates), "cluster.lb.rancher.cloud")
+			if len(got) != 3 {
+				t.Fatalf("Select() = %v, want 3 hosts", got)
+			}
+			if tt.want != nil && strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("Select() = %v, want %v", got, tt.want)
+			}
+			// a new host displaces at most one of the selected hosts
+			kept := 0
+			for _, a := range got {
+				for _, b := range selected {
+					if a == b {
+						kept++
+					}
+				}
+			}
+			if kept < 2 {
+				t.Fatalf("Select() = %v keeps %d of %v, want at least 2", got, kept, selected)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	candidates := FromAddresses([]string{"1.1.1.1", "2.2.2.2", "3.3.3.3"})
+	s := New(PolicyRoundRobin, 2)
+	tests := []struct {
+		rotations int
+		want      string
+	}{
+		{rotations: 0, want: "1.1.1.1,2.2.2.2"},
+		{rotations: 1, want: "2.2.2.2,3.3.3.3"},
+		{rotations: 2, want: "3.3.3.3,1.1.1.1"},
+		{rotations: 3, want: "1.1.1.1,2.2.2.2"},
+		{rotations: 4, want: "2.2.2.2,3.3.3.3"},
+	}
+	done := 0
+	for _, tt := range tests {
+		for ; done < tt.rotations; done++ {
+			if !s.Rotate() {
+				t.Fatal("Rotate() = false for the round-robin policy")
+			}
+		}
+		if got := strings.Join(s.Select(candidates, ""), ","); got != tt.want {
+			t.Fatalf("Select() after %d rotations = %s, want %s", tt.rotations, got, tt.want)
+		}
+	}
+
+	for _, policy := range []string{PolicyOrdered, PolicyReady, PolicyZone, PolicyHash} {
+		s := New(policy, 2)
+		before := s.Select(candidates, "seed")
+		if s.Rotate() {
+			t.Fatalf("Rotate() = true for the %s policy", policy)
+		}
+		if after := s.Select(candidates, "seed"); strings.Join(after, ",") != strings.Join(before, ",") {
+			t.Fatalf("Select() of the %s policy changed from %v to %v after Rotate()", policy, before, after)
+		}
+	}
+}
+
+func unselected(addresses, selected []string) string {
+	for _, a := range addresses {
+		if strings.Join(without(selected, a), ",") == strings.Join(selected, ",") {
+			return a
+		}
+	}
+	return ""
+}
+
+func without(addresses []string, drop string) []string {
+	var out []string
+	for _, a := range addresses {
+		if a != drop {
+			out = append(out, a)
+		}
+	}
+	return out
+}
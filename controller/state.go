@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"github.com/niusmallnan/kube-rdns/controller/prober"
+	"github.com/niusmallnan/kube-rdns/controller/watch"
+)
+
+// State is the desired and observed state of the controller
+type State struct {
+	Domains  []DomainState     `json:"domains"`
+	Services map[string]string `json:"services"`
+	Routes   map[string]string `json:"routes"`
+	Records  []watch.Record    `json:"records"`
+	Probes   []prober.Result   `json:"probes"`
+}
+
+func (c *RDNSController) State() State {
+	state := State{
+		Services: c.svcRes.Hostnames(),
+		Routes:   c.gwRes.Hostnames(),
+		Records:  c.recRes.Records(),
+		Probes:   c.prober.Results(),
+	}
+	for _, d := range c.domains {
+		state.Domains = append(state.Domains, d.state())
+	}
+	return state
+}
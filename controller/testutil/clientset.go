@@ -0,0 +1,43 @@
+// Package testutil has the helpers the controller tests share: the fake clientset they run
+// against and the initialization of the settings.
+package testutil
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// NewClientset returns a fake clientset holding objects. Unlike the plain fake clientset it
+// does what the apiserver does on a create: the objects with a generateName are named, so that
+// the events recorded against the same object do not collide, and the string data of a secret
+// is moved to its data.
+func NewClientset(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	// the reactors run under the lock of the clientset
+	generated := 0
+	client.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.CreateAction).GetObject()
+		if secret, ok := obj.(*v1.Secret); ok && len(secret.StringData) > 0 {
+			if secret.Data == nil {
+				secret.Data = map[string][]byte{}
+			}
+			for k, v := range secret.StringData {
+				secret.Data[k] = []byte(v)
+			}
+			secret.StringData = nil
+		}
+		accessor, err := meta.Accessor(obj)
+		if err == nil && accessor.GetName() == "" && accessor.GetGenerateName() != "" {
+			generated++
+			accessor.SetName(fmt.Sprintf("%s%05d", accessor.GetGenerateName(), generated))
+		}
+		// the object is stored by the default reactor
+		return false, nil, nil
+	})
+	return client
+}
@@ -0,0 +1,60 @@
+package testutil
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/hostname"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/urfave/cli"
+)
+
+// defaults are the values of the flags the settings are read from, as main registers them
+var defaults = map[string]string{
+	"root-domain":               setting.DefaultRootDomain,
+	"base-rdns-url":             setting.DefaultBaseRdnsURL,
+	"backend-policy":            setting.DefaultBackendPolicy,
+	"backend-retry-interval":    setting.DefaultBackendRetryInterval.String(),
+	"rdns-timeout":              setting.DefaultRdnsTimeout.String(),
+	"provider":                  setting.DefaultProvider,
+	"rfc2136-tsig-algorithm":    setting.DefaultRFC2136TSIGAlgorithm,
+	"rfc2136-ttl":               fmt.Sprint(setting.DefaultRFC2136TTL),
+	"rfc2136-timeout":           setting.DefaultRFC2136Timeout.String(),
+	"dns-listen":                setting.DefaultDNSListen,
+	"dns-ttl":                   fmt.Sprint(setting.DefaultDNSTTL),
+	"renew-duration":            setting.DefaultRnewDuration.String(),
+	"ingress-resync-duration":   setting.DefaultIngressResyncDuration.String(),
+	"max-hosts":                 fmt.Sprint(setting.DefaultMaxHosts),
+	"host-policy":               setting.DefaultHostPolicy,
+	"ip-family":                 setting.DefaultIPFamily,
+	"node-address-sources":      address.DefaultSources,
+	"lb-hostname-refresh":       setting.DefaultLBHostnameRefresh.String(),
+	"gateway-poll-interval":     setting.DefaultGatewayPollInterval.String(),
+	"record-poll-interval":      setting.DefaultRecordPollInterval.String(),
+	"probe-port":                fmt.Sprint(setting.DefaultProbePort),
+	"probe-path":                setting.DefaultProbePath,
+	"probe-interval":            setting.DefaultProbeInterval.String(),
+	"probe-timeout":             setting.DefaultProbeTimeout.String(),
+	"probe-failure-threshold":   fmt.Sprint(setting.DefaultProbeFailureThreshold),
+	"hostname-template":         hostname.DefaultTemplate,
+	"service-hostname-template": hostname.DefaultServiceTemplate,
+	"route-hostname-template":   hostname.DefaultRouteTemplate,
+	"tls-issuer-kind":           setting.DefaultTLSIssuerKind,
+}
+
+// InitSettings initializes the settings with the flag defaults overridden by values,
+// and loads the domains
+func InitSettings(values map[string]string) error {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for name, value := range defaults {
+		if _, ok := values[name]; !ok {
+			set.String(name, value, "")
+		}
+	}
+	for name, value := range values {
+		set.String(name, value, "")
+	}
+	setting.Init(cli.NewContext(nil, set, nil))
+	return setting.LoadDomains()
+}
@@ -0,0 +1,107 @@
+package watch
+
+import (
+	"fmt"
+
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/sirupsen/logrus"
+	k8scorev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// olderThan orders ingresses by creation, the namespace/name breaks ties
+func olderThan(a, b *extensionsv1beta1.Ingress) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return ingressKey(a) < ingressKey(b)
+}
+
+// hostnameWinner returns the object which owns or has precedence on the hostname when it
+// is not ing. An object already assigned the hostname keeps it, otherwise the oldest
+// ingress claiming the hostname wins. The hostnames of the other ingresses are rendered under
+// rootFqdn.
+func (n *IngressResource) hostnameWinner(ing *extensionsv1beta1.Ingress, fqdn, rootFqdn string) string {
+	key := ingressKey(ing)
+
+	if owner := n.owners.Owner(fqdn); owner != "" {
+		if owner == key {
+			return ""
+		}
+		return owner
+	}
+
+	if n.store == nil {
+		return ""
+	}
+	winner := ing
+	for _, obj := range n.store.List() {
+		other, ok := obj.(*extensionsv1beta1.Ingress)
+		if !ok || ingressKey(other) == key || !n.selects(other) || other.Annotations[annotationHostname] != "" {
+			continue
+		}
+		h, err := getRdnsHostname(other, rootFqdn)
+		if err != nil || h != fqdn {
+			continue
+		}
+		if olderThan(other, winner) {
+			winner = other
+		}
+	}
+	if winner == ing {
+		return ""
+	}
+	return ingressKey(winner)
+}
+
+// markConflict annotates the losing ingress with the owner of the hostname and records an event
+func (n *IngressResource) markConflict(ing *extensionsv1beta1.Ingress, fqdn, owner string) {
+	log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace, logging.FieldFqdn: fqdn}).Errorf("Hostname is owned by %s", owner)
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latestIng, err := n.kubeClient.ExtensionsV1beta1().Ingresses(ing.Namespace).Get(ing.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if latestIng.Annotations[annotationConflict] == owner {
+			return nil
+		}
+
+		latestIng = latestIng.DeepCopy()
+		if latestIng.Annotations == nil {
+			latestIng.Annotations = make(map[string]string)
+		}
+		latestIng.Annotations[annotationConflict] = owner
+
+		if setting.IsDryRun() {
+			dryrun.Record(dryrun.Action{
+				Operation: "mark ingress conflict",
+				Target:    ingressKey(latestIng),
+				Message:   fmt.Sprintf("hostname %s is owned by %s", fqdn, owner),
+			})
+			return nil
+		}
+
+		if _, err = n.kubeClient.ExtensionsV1beta1().Ingresses(latestIng.Namespace).Update(latestIng); err != nil {
+			return err
+		}
+		k8s.RecordEvent(n.kubeClient, k8scorev1.ObjectReference{
+			Kind:            "Ingress",
+			APIVersion:      "extensions/v1beta1",
+			Name:            latestIng.Name,
+			Namespace:       latestIng.Namespace,
+			UID:             latestIng.UID,
+			ResourceVersion: latestIng.ResourceVersion,
+		}, k8scorev1.EventTypeWarning, "HostnameConflict", "Hostname %s is owned by %s", fqdn, owner)
+		return nil
+	})
+
+	if retryErr != nil {
+		log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Errorf("Failed to mark hostname conflict: %v", retryErr)
+	}
+}
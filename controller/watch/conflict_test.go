@@ -0,0 +1,160 @@
+package watch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// countingProvider counts how often the root fqdn is read, the rdns client reads it from a secret
+type countingProvider struct {
+	rdns.Provider
+	calls int
+}
+
+func (p *countingProvider) RootFqdn() string {
+	p.calls++
+	return rootFqdn
+}
+
+func newClaimant(name string, created time.Time, annotations map[string]string) *extensionsv1beta1.Ingress {
+	return &extensionsv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Name:              name,
+		Namespace:         "default",
+		Labels:            map[string]string{"team": "a"},
+		Annotations:       annotations,
+		CreationTimestamp: metav1.NewTime(created),
+	}}
+}
+
+func TestHostnameWinner(t *testing.T) {
+	if err := testutil.InitSettings(map[string]string{"hostname-template": "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	fqdn := "shared." + rootFqdn
+	now := time.Now()
+	ing := newClaimant("web", now, nil)
+
+	tests := []struct {
+		name     string
+		owner    string
+		selector string
+		others   []*extensionsv1beta1.Ingress
+		want     string
+	}{
+		{name: "no other claimant"},
+		{name: "owned by the ingress", owner: "default/web", others: []*extensionsv1beta1.Ingress{newClaimant("old", now.Add(-time.Hour), nil)}},
+		{name: "owned by another ingress", owner: "default/new", want: "default/new"},
+		{name: "older claimant", others: []*extensionsv1beta1.Ingress{newClaimant("old", now.Add(-time.Hour), nil)}, want: "default/old"},
+		{name: "newer claimant", others: []*extensionsv1beta1.Ingress{newClaimant("new", now.Add(time.Hour), nil)}},
+		{name: "same age, the name breaks the tie", others: []*extensionsv1beta1.Ingress{newClaimant("aaa", now, nil), newClaimant("zzz", now, nil)}, want: "default/aaa"},
+		{name: "oldest of many", others: []*extensionsv1beta1.Ingress{newClaimant("b", now.Add(-time.Minute), nil), newClaimant("a", now.Add(-time.Hour), nil)}, want: "default/a"},
+		{
+			name:   "claimant with another template",
+			others: []*extensionsv1beta1.Ingress{newClaimant("old", now.Add(-time.Hour), map[string]string{annotationTemplate: "{{.Name}}.{{.Namespace}}"})},
+		},
+		{
+			name:   "claimant already assigned a hostname",
+			others: []*extensionsv1beta1.Ingress{newClaimant("old", now.Add(-time.Hour), map[string]string{annotationHostname: "other." + rootFqdn})},
+		},
+		{
+			name:     "claimant of another domain",
+			selector: "team=a",
+			others: []*extensionsv1beta1.Ingress{func() *extensionsv1beta1.Ingress {
+				other := newClaimant("old", now.Add(-time.Hour), nil)
+				other.Labels = map[string]string{"team": "b"}
+				return other
+			}()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sel labels.Selector
+			if tt.selector != "" {
+				var err error
+				if sel, err = labels.Parse(tt.selector); err != nil {
+					t.Fatal(err)
+				}
+			}
+			provider := &countingProvider{}
+			n := NewIngressResource(nil, provider, nil, sel, NewHostnameOwners())
+			n.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+			n.store.Add(ing)
+			for _, other := range tt.others {
+				n.store.Add(other)
+			}
+			if tt.owner != "" {
+				n.owners.Claim(fqdn, tt.owner)
+			}
+
+			if got := n.hostnameWinner(ing, fqdn, rootFqdn); got != tt.want {
+				t.Fatalf("hostnameWinner() = %q, want %q", got, tt.want)
+			}
+			if provider.calls != 0 {
+				t.Fatalf("the root fqdn was read %d times while rendering the claims", provider.calls)
+			}
+		})
+	}
+}
+
+func TestMarkConflict(t *testing.T) {
+	tests := []struct {
+		name       string
+		dryRun     bool
+		annotation string
+		wantUpdate bool
+	}{
+		{name: "annotated", wantUpdate: true},
+		{name: "already annotated", annotation: "default/old"},
+		{name: "owner changed", annotation: "default/older", wantUpdate: true},
+		{name: "dry run", dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]string{}
+			if tt.dryRun {
+				values["dry-run"] = "true"
+			}
+			if err := testutil.InitSettings(values); err != nil {
+				t.Fatal(err)
+			}
+			ing := newClaimant("web", time.Now(), nil)
+			if tt.annotation != "" {
+				ing.Annotations = map[string]string{annotationConflict: tt.annotation}
+			}
+			kube := testutil.NewClientset(ing)
+
+			n := NewIngressResource(kube, nil, nil, nil, NewHostnameOwners())
+			n.markConflict(ing, "web.default."+rootFqdn, "default/old")
+
+			got, err := kube.ExtensionsV1beta1().Ingresses("default").Get("web", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.annotation
+			if tt.wantUpdate {
+				want = "default/old"
+			}
+			if got.Annotations[annotationConflict] != want {
+				t.Fatalf("conflict annotation = %q, want %q", got.Annotations[annotationConflict], want)
+			}
+			events := 0
+			if tt.wantUpdate {
+				events = 1
+			}
+			recorded, err := kube.CoreV1().Events("default").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(recorded.Items); n != events {
+				t.Fatalf("%d events were recorded, want %d", n, events)
+			}
+		})
+	}
+}
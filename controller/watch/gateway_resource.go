@@ -0,0 +1,537 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	k8scorev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	gatewayGroup         = "gateway.networking.k8s.io"
+	gatewayKind          = "Gateway"
+	gatewayResource      = "gateways"
+	httpRouteResource    = "httproutes"
+	gatewayAddressTypeIP = "IPAddress"
+)
+
+// gatewayVersions are tried in order until one serves both gateways and httproutes
+var gatewayVersions = []string{"v1", "v1beta1"}
+
+// deepCopyJSON copies in into out, the gateway api objects only hold json data
+func deepCopyJSON(in, out interface{}) {
+	data, err := json.Marshal(in)
+	if err == nil {
+		err = json.Unmarshal(data, out)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to copy %T: %v", in, err))
+	}
+}
+
+type gateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Status            struct {
+		Addresses []struct {
+			Type  *string `json:"type"`
+			Value string  `json:"value"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+func (g *gateway) DeepCopyObject() runtime.Object {
+	out := &gateway{}
+	deepCopyJSON(g, out)
+	return out
+}
+
+type gatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []gateway `json:"items"`
+}
+
+func (l *gatewayList) DeepCopyObject() runtime.Object {
+	out := &gatewayList{}
+	deepCopyJSON(l, out)
+	return out
+}
+
+type parentReference struct {
+	Group     *string `json:"group"`
+	Kind      *string `json:"kind"`
+	Namespace *string `json:"namespace"`
+	Name      string  `json:"name"`
+}
+
+type httpRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ParentRefs []parentReference `json:"parentRefs"`
+		Hostnames  []string          `json:"hostnames"`
+	} `json:"spec"`
+}
+
+func (r *httpRoute) DeepCopyObject() runtime.Object {
+	out := &httpRoute{}
+	deepCopyJSON(r, out)
+	return out
+}
+
+type httpRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []httpRoute `json:"items"`
+}
+
+func (l *httpRouteList) DeepCopyObject() runtime.Object {
+	out := &httpRouteList{}
+	deepCopyJSON(l, out)
+	return out
+}
+
+// watchDecoder decodes the json watch events of a resource there is no typed client for
+type watchDecoder struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+	newObj  func() runtime.Object
+}
+
+func (d *watchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	var obj runtime.Object
+	switch event.Type {
+	case watch.Added, watch.Modified, watch.Deleted:
+		obj = d.newObj()
+	case watch.Error:
+		obj = &metav1.Status{}
+	default:
+		return "", nil, errors.Errorf("got invalid watch event type: %v", event.Type)
+	}
+	if err := json.Unmarshal(event.Object, obj); err != nil {
+		return "", nil, errors.Wrap(err, "unable to decode watch event")
+	}
+	return event.Type, obj, nil
+}
+
+func (d *watchDecoder) Close() {
+	d.stream.Close()
+}
+
+// GatewayResource assigns generated hostnames to Gateway API HTTPRoutes and publishes them
+// as records of their own with the addresses of their gateways. The CRDs are served through
+// the raw rest client because there is no typed client for them.
+type GatewayResource struct {
+	rdnsClient rdns.Provider
+	kubeClient kubernetes.Interface
+	queue      workqueue.Interface
+	stop       chan struct{}
+	version    string
+
+	gateways cache.Store
+	routes   cache.Store
+	owners   *HostnameOwners
+
+	unsupported unsupported
+
+	lock      sync.RWMutex
+	hostnames map[string]string
+}
+
+// NewGatewayResource watches the routes, their hostnames are claimed in owners, which the
+// other watchers of the domain share.
+func NewGatewayResource(kubeClient kubernetes.Interface, rdnsClient rdns.Provider, owners *HostnameOwners) *GatewayResource {
+	owners.register()
+	return &GatewayResource{
+		rdnsClient: rdnsClient,
+		kubeClient: kubeClient,
+		queue:      workqueue.New(),
+		stop:       make(chan struct{}),
+		gateways:   cache.NewStore(cache.MetaNamespaceKeyFunc),
+		routes:     cache.NewStore(cache.MetaNamespaceKeyFunc),
+		owners:     owners,
+		hostnames:  make(map[string]string),
+	}
+}
+
+// Hostnames returns the hostname assigned to each route
+func (g *GatewayResource) Hostnames() map[string]string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	hostnames := make(map[string]string, len(g.hostnames))
+	for key, h := range g.hostnames {
+		hostnames[key] = h
+	}
+	return hostnames
+}
+
+// discover returns the served gateway api version, or an empty string if the CRDs are absent
+func (g *GatewayResource) discover() string {
+	for _, version := range gatewayVersions {
+		resources, err := g.kubeClient.Discovery().ServerResourcesForGroupVersion(gatewayGroup + "/" + version)
+		if err != nil {
+			continue
+		}
+		served := map[string]bool{}
+		for _, r := range resources.APIResources {
+			served[r.Name] = true
+		}
+		if served[gatewayResource] && served[httpRouteResource] {
+			return version
+		}
+	}
+	return ""
+}
+
+func (g *GatewayResource) path(namespace, resource, name string) string {
+	segments := []string{"/apis", gatewayGroup, g.version}
+	if namespace != "" {
+		segments = append(segments, "namespaces", namespace)
+	}
+	segments = append(segments, resource)
+	if name != "" {
+		segments = append(segments, name)
+	}
+	return strings.Join(segments, "/")
+}
+
+// listWatch lists and watches a gateway api resource of every namespace
+func (g *GatewayResource) listWatch(resource string, newList, newObj func() runtime.Object) *cache.ListWatch {
+	request := func(options metav1.ListOptions) *rest.Request {
+		req := g.kubeClient.CoreV1().RESTClient().Get().AbsPath(g.path("", resource, ""))
+		if options.ResourceVersion != "" {
+			req = req.Param("resourceVersion", options.ResourceVersion)
+		}
+		if options.TimeoutSeconds != nil {
+			req = req.Param("timeoutSeconds", strconv.FormatInt(*options.TimeoutSeconds, 10))
+		}
+		return req
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			data, err := request(options).DoRaw()
+			if err != nil {
+				return nil, err
+			}
+			list := newList()
+			return list, json.Unmarshal(data, list)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			stream, err := request(options).Param("watch", "true").Stream()
+			if err != nil {
+				return nil, err
+			}
+			return watch.NewStreamWatcher(&watchDecoder{stream: stream, decoder: json.NewDecoder(stream), newObj: newObj}), nil
+		},
+	}
+}
+
+func (g *GatewayResource) patch(path string, patch interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = g.kubeClient.CoreV1().RESTClient().Patch(types.MergePatchType).AbsPath(path).Body(data).DoRaw()
+	return err
+}
+
+func (g *GatewayResource) getRdnsHostname(route *httpRoute) (string, error) {
+	return renderHostname(setting.GetRouteHostnameTemplate(), route.ObjectMeta, g.rdnsClient.RootFqdn())
+}
+
+// getRouteIps returns the ip addresses of the gateways the route is attached to
+func (g *GatewayResource) getRouteIps(route *httpRoute) []string {
+	var ips []string
+	for _, ref := range route.Spec.ParentRefs {
+		if (ref.Group != nil && *ref.Group != gatewayGroup) || (ref.Kind != nil && *ref.Kind != gatewayKind) {
+			continue
+		}
+		namespace := route.Namespace
+		if ref.Namespace != nil {
+			namespace = *ref.Namespace
+		}
+		obj, ok, _ := g.gateways.GetByKey(namespace + "/" + ref.Name)
+		if !ok {
+			continue
+		}
+		for _, addr := range obj.(*gateway).Status.Addresses {
+			if (addr.Type == nil || *addr.Type == gatewayAddressTypeIP) && selector.MatchFamily(addr.Value, setting.GetIPFamily()) {
+				ips = append(ips, addr.Value)
+			}
+		}
+	}
+	return ips
+}
+
+// sync publishes the records of the route, a route keeps the hostname it has been assigned
+func (g *GatewayResource) sync(route *httpRoute) error {
+	key := route.Namespace + "/" + route.Name
+	fqdn := route.Annotations[annotationHostname]
+	if fqdn == "" {
+		var err error
+		if fqdn, err = g.getRdnsHostname(route); err != nil {
+			return err
+		}
+	}
+
+	if other := g.owners.Claim(fqdn, ownerName("httproute", route.Namespace, route.Name)); other != "" {
+		return g.markConflict(route, fqdn, other)
+	}
+
+	ips := g.getRouteIps(route)
+	if len(ips) == 0 {
+		log.Debugf("HTTPRoute /%s has no gateway addresses", key)
+		g.lock.RLock()
+		_, published := g.hostnames[key]
+		g.lock.RUnlock()
+		if published {
+			// the hostname stays claimed, only the records of the addresses which are gone are deleted
+			return errors.Wrap(g.rdnsClient.DeleteRecords(fqdn), "Called by gateway watch")
+		}
+		return nil
+	}
+	// the route gets records of its own, the hosts of the domain belong to the ingresses
+	if err := g.rdnsClient.SetRecords(fqdn, ips, 0); err != nil {
+		return errors.Wrap(err, "Called by gateway watch")
+	}
+
+	g.lock.Lock()
+	g.hostnames[key] = fqdn
+	g.lock.Unlock()
+
+	var before []string
+	after := make([]string, 0, len(route.Spec.Hostnames))
+	for _, h := range route.Spec.Hostnames {
+		before = append(before, h)
+		if strings.HasSuffix(h, setting.GetRootDomain()) {
+			h = fqdn
+		}
+		after = append(after, h)
+	}
+	added, removed := dryrun.Diff(before, after)
+	if route.Annotations[annotationHostname] == fqdn && route.Annotations[annotationConflict] == "" && len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	// a null value removes the conflict annotation of a route which lost its hostname before
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annotationHostname: fqdn, annotationConflict: nil},
+		},
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		patch["spec"] = map[string]interface{}{"hostnames": after}
+	}
+
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{
+			Operation: "update httproute",
+			Target:    key,
+			Added:     added,
+			Removed:   removed,
+			Message:   fmt.Sprintf("rewrite hostnames to %s", fqdn),
+		})
+		return nil
+	}
+	return g.patch(g.path(route.Namespace, httpRouteResource, route.Name), patch)
+}
+
+// markConflict annotates a route whose hostname is owned by another object and records an event
+func (g *GatewayResource) markConflict(route *httpRoute, fqdn, owner string) error {
+	key := route.Namespace + "/" + route.Name
+	log.WithField(logging.FieldFqdn, fqdn).Errorf("Hostname of httproute /%s is owned by %s", key, owner)
+	if route.Annotations[annotationConflict] == owner {
+		return nil
+	}
+
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{
+			Operation: "mark httproute conflict",
+			Target:    key,
+			Message:   fmt.Sprintf("hostname %s is owned by %s", fqdn, owner),
+		})
+		return nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annotationConflict: owner},
+		},
+	}
+	if err := g.patch(g.path(route.Namespace, httpRouteResource, route.Name), patch); err != nil {
+		return err
+	}
+	k8s.RecordEvent(g.kubeClient, k8scorev1.ObjectReference{
+		Kind:       "HTTPRoute",
+		APIVersion: gatewayGroup + "/" + g.version,
+		Name:       route.Name,
+		Namespace:  route.Namespace,
+		UID:        route.UID,
+	}, k8scorev1.EventTypeWarning, "HostnameConflict", "Hostname %s is owned by %s", fqdn, owner)
+	return nil
+}
+
+// restore claims the hostname a route was assigned before the controller started
+func (g *GatewayResource) restore(obj interface{}) {
+	route, ok := obj.(*httpRoute)
+	if !ok || route.Annotations[annotationHostname] == "" {
+		return
+	}
+	fqdn := route.Annotations[annotationHostname]
+	if g.owners.Claim(fqdn, ownerName("httproute", route.Namespace, route.Name)) != "" {
+		return
+	}
+	g.lock.Lock()
+	g.hostnames[route.Namespace+"/"+route.Name] = fqdn
+	g.lock.Unlock()
+}
+
+// forget deletes the records of a deleted route
+func (g *GatewayResource) forget(key string) {
+	g.lock.Lock()
+	fqdn, ok := g.hostnames[key]
+	delete(g.hostnames, key)
+	g.lock.Unlock()
+	if !ok {
+		return
+	}
+	if namespace, name, err := cache.SplitMetaNamespaceKey(key); err == nil {
+		g.owners.Release(fqdn, ownerName("httproute", namespace, name))
+	}
+	if err := g.rdnsClient.DeleteRecords(fqdn); err != nil {
+		log.Errorf("Failed to delete the records of httproute /%s: %v", key, err)
+	}
+}
+
+func (g *GatewayResource) enqueueRoutes() {
+	for _, key := range g.routes.ListKeys() {
+		g.queue.Add(key)
+	}
+}
+
+func (g *GatewayResource) enqueue(obj interface{}) {
+	if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+		g.queue.Add(key)
+	}
+}
+
+func (g *GatewayResource) process(key string) {
+	obj, ok, err := g.routes.GetByKey(key)
+	if err != nil {
+		log.Errorf("Failed to get httproute /%s: %v", key, err)
+		return
+	}
+	if !ok {
+		g.unsupported.forget(key)
+		g.forget(key)
+		return
+	}
+	route := obj.(*httpRoute)
+	if err := g.sync(route); err != nil {
+		ref := k8scorev1.ObjectReference{Kind: "HTTPRoute", APIVersion: gatewayGroup + "/" + g.version, Name: route.Name, Namespace: route.Namespace, UID: route.UID}
+		if !g.unsupported.notify(g.kubeClient, key, ref, err) {
+			log.Errorf("Failed to sync httproute /%s: %v", key, err)
+		}
+	}
+}
+
+// WatchResources waits for the gateway api CRDs to be installed, then watches the gateways
+// and the routes. Every route attached to a gateway is synced when the gateway changes.
+func (g *GatewayResource) WatchResources() {
+	ticker := time.NewTicker(setting.GetGatewayPollInterval())
+	defer ticker.Stop()
+	restored := false
+	for g.version = g.discover(); g.version == ""; g.version = g.discover() {
+		log.Debug("Gateway API CRDs are not installed, skip watching routes")
+		// there are no routes to restore, the other watchers do not wait for the CRDs
+		if !restored {
+			g.owners.restored()
+			restored = true
+		}
+		select {
+		case <-ticker.C:
+		case <-g.stop:
+			return
+		}
+	}
+	ticker.Stop()
+
+	gatewayHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { g.enqueueRoutes() },
+		UpdateFunc: func(oldObj, newObj interface{}) { g.enqueueRoutes() },
+		DeleteFunc: func(obj interface{}) { g.enqueueRoutes() },
+	}
+	routeHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			g.restore(obj)
+			g.enqueue(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) { g.enqueue(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				g.queue.Add(key)
+			}
+		},
+	}
+	resync := setting.GetIngressResyncDuration()
+	var gc, rc cache.Controller
+	g.gateways, gc = cache.NewInformer(g.listWatch(gatewayResource,
+		func() runtime.Object { return &gatewayList{} },
+		func() runtime.Object { return &gateway{} }), &gateway{}, resync, gatewayHandler)
+	g.routes, rc = cache.NewInformer(g.listWatch(httpRouteResource,
+		func() runtime.Object { return &httpRouteList{} },
+		func() runtime.Object { return &httpRoute{} }), &httpRoute{}, resync, routeHandler)
+	go gc.Run(g.stop)
+	go rc.Run(g.stop)
+
+	go func() {
+		// the routes are only synced once the addresses of their gateways are known
+		if !cache.WaitForCacheSync(g.stop, gc.HasSynced, rc.HasSynced) {
+			return
+		}
+		if !restored {
+			g.owners.restored()
+		}
+		if !g.owners.wait(g.stop) {
+			return
+		}
+		for {
+			item, quit := g.queue.Get()
+			if quit {
+				return
+			}
+			g.process(item.(string))
+			g.queue.Done(item)
+		}
+	}()
+
+	<-g.stop
+	g.queue.ShutDown()
+}
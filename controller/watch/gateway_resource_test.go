@@ -0,0 +1,157 @@
+package watch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newGateway(name string, addresses ...string) *gateway {
+	gw := &gateway{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	for _, addr := range addresses {
+		gw.Status.Addresses = append(gw.Status.Addresses, struct {
+			Type  *string `json:"type"`
+			Value string  `json:"value"`
+		}{Value: addr})
+	}
+	return gw
+}
+
+func newRoute(name string, annotations map[string]string, gateways ...string) *httpRoute {
+	route := &httpRoute{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+	for _, gw := range gateways {
+		route.Spec.ParentRefs = append(route.Spec.ParentRefs, parentReference{Name: gw})
+	}
+	return route
+}
+
+func TestGatewaySync(t *testing.T) {
+	if err := testutil.InitSettings(map[string]string{"dry-run": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	provider := newRecordingProvider()
+	owners := NewHostnameOwners()
+	owners.Claim("taken.route.default."+rootFqdn, "default/taken")
+	g := NewGatewayResource(nil, provider, owners)
+	g.gateways.Add(newGateway("a", "1.1.1.1"))
+	g.gateways.Add(newGateway("b", "2.2.2.2", "2001:db8::1"))
+
+	tests := []struct {
+		name  string
+		route *httpRoute
+		fqdn  string
+		want  []string
+	}{
+		{name: "one gateway", route: newRoute("web", nil, "a"), fqdn: "web.route.default." + rootFqdn, want: []string{"1.1.1.1"}},
+		{name: "two gateways", route: newRoute("api", nil, "a", "b"), fqdn: "api.route.default." + rootFqdn, want: []string{"1.1.1.1", "2.2.2.2"}},
+		{name: "missing gateway", route: newRoute("lost", nil, "c"), fqdn: "lost.route.default." + rootFqdn},
+		{name: "hostname owned by an ingress", route: newRoute("taken", nil, "a"), fqdn: "taken.route.default." + rootFqdn},
+		{
+			name:  "assigned hostname is kept",
+			route: newRoute("old", map[string]string{annotationHostname: "kept." + rootFqdn}, "b"),
+			fqdn:  "kept." + rootFqdn,
+			want:  []string{"2.2.2.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := g.sync(tt.route); err != nil {
+				t.Fatal(err)
+			}
+			if got := provider.records[tt.fqdn]; strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("records of %s = %v, want %v", tt.fqdn, got, tt.want)
+			}
+		})
+	}
+	if provider.applied != 0 {
+		t.Fatalf("the hosts of the domain were replaced %d times by a route", provider.applied)
+	}
+
+	if owner := owners.Owner("api.route.default." + rootFqdn); owner != "httproute/default/api" {
+		t.Fatalf("owner of the route hostname = %q, want httproute/default/api", owner)
+	}
+	if !dryRunRecorded("mark httproute conflict", "default/taken") {
+		t.Fatal("the conflict of a route whose hostname is owned by an ingress was not marked")
+	}
+
+	// the records of a route whose gateways lost their addresses are deleted
+	g.gateways.Update(newGateway("a"))
+	if err := g.sync(newRoute("web", nil, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := provider.records["web.route.default."+rootFqdn]; ok {
+		t.Fatal("the records of a route without gateway addresses were kept")
+	}
+
+	// a deleted route is no longer in the store, its records are deleted and its hostname released
+	g.process("default/api")
+	if _, ok := provider.records["api.route.default."+rootFqdn]; ok {
+		t.Fatal("the records of a deleted route were kept")
+	}
+	if _, ok := g.Hostnames()["default/api"]; ok {
+		t.Fatal("the hostname of a deleted route was kept")
+	}
+	if owner := owners.Owner("api.route.default." + rootFqdn); owner != "" {
+		t.Fatalf("owner of the hostname of a deleted route = %q, want none", owner)
+	}
+}
+
+func dryRunRecorded(operation, target string) bool {
+	for _, a := range dryrun.Actions() {
+		if a.Operation == operation && a.Target == target {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWatchDecoder(t *testing.T) {
+	events := `{"type":"ADDED","object":{"metadata":{"name":"web","namespace":"default"}}}
+{"type":"ERROR","object":{"kind":"Status","status":"Failure","code":410,"reason":"Expired"}}
+{"type":"BOOKMARK","object":{}}`
+	d := &watchDecoder{
+		stream: ioutil.NopCloser(strings.NewReader(events)),
+		newObj: func() runtime.Object { return &httpRoute{} },
+	}
+	d.decoder = json.NewDecoder(d.stream)
+
+	typ, obj, err := d.Decode()
+	if err != nil || typ != watch.Added {
+		t.Fatalf("Decode() = %v, %v, want an added route", typ, err)
+	}
+	if key, _ := cache.MetaNamespaceKeyFunc(obj); key != "default/web" {
+		t.Fatalf("Decode() object = %s, want default/web", key)
+	}
+	typ, obj, err = d.Decode()
+	if status, ok := obj.(*metav1.Status); err != nil || typ != watch.Error || !ok || status.Code != 410 {
+		t.Fatalf("Decode() = %v, %v, %v, want the status of an error event", typ, obj, err)
+	}
+	if _, _, err := d.Decode(); err == nil {
+		t.Fatal("Decode() of an unknown event type did not fail")
+	}
+}
+
+func TestGatewayUnsupported(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	kube := testutil.NewClientset()
+	g := NewGatewayResource(kube, unsupportedProvider{newRecordingProvider()}, NewHostnameOwners())
+	g.version = "v1"
+	g.gateways.Add(newGateway("a", "1.1.1.1"))
+	g.routes.Add(newRoute("web", nil, "a"))
+
+	g.process("default/web")
+	g.process("default/web")
+	if got := countEvents(t, kube, "default", "RecordsNotSupported"); got != 1 {
+		t.Fatalf("recorded %d RecordsNotSupported events, want 1", got)
+	}
+}
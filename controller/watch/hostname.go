@@ -0,0 +1,35 @@
+package watch
+
+import (
+	"strings"
+
+	"github.com/niusmallnan/kube-rdns/controller/hostname"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// renderHostname renders the hostname of an object under rootFqdn with tmpl. The object can
+// override tmpl with the hostname-template annotation, the name it renders has to end with the
+// namespace of the object so that a namespace cannot claim the hostnames of another one.
+func renderHostname(tmpl string, meta metav1.ObjectMeta, rootFqdn string) (string, error) {
+	data := hostname.NewData(meta.Name, meta.Namespace)
+	override := meta.Annotations[annotationTemplate]
+	if override == "" {
+		return hostname.Render(tmpl, data, rootFqdn)
+	}
+
+	name, err := hostname.Render(override, data, "")
+	if err != nil {
+		return "", err
+	}
+	if !inNamespace(name, meta.Namespace) {
+		return "", errors.Errorf("hostname %s of the %s annotation does not end with the namespace %s", name, annotationTemplate, meta.Namespace)
+	}
+	return hostname.Join(name, rootFqdn)
+}
+
+// inNamespace returns whether the last label of the sanitized name is the namespace
+func inNamespace(name, namespace string) bool {
+	ns := hostname.Sanitize(namespace)
+	return name == ns || strings.HasSuffix(name, "."+ns)
+}
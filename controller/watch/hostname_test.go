@@ -0,0 +1,43 @@
+package watch
+
+import (
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderHostname(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		override string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default template", want: "web.prod." + rootFqdn},
+		{name: "override in the namespace", override: "{{.Name}}-v2.{{.Namespace}}", want: "web-v2.prod." + rootFqdn},
+		{name: "namespace only", override: "{{.Namespace}}", want: "prod." + rootFqdn},
+		{name: "another namespace", override: "{{.Name}}.staging", wantErr: true},
+		{name: "namespace not last", override: "{{.Namespace}}.{{.Name}}", wantErr: true},
+		{name: "namespace as a prefix of a label", override: "{{.Name}}.x{{.Namespace}}", wantErr: true},
+		{name: "flat name", override: "{{.Name}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := metav1.ObjectMeta{Name: "web", Namespace: "prod"}
+			if tt.override != "" {
+				meta.Annotations = map[string]string{annotationTemplate: tt.override}
+			}
+			got, err := renderHostname("{{.Name}}.{{.Namespace}}", meta, rootFqdn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderHostname() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("renderHostname() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
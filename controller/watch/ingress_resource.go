@@ -2,27 +2,173 @@ package watch
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
 	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/resolver"
 	"github.com/niusmallnan/kube-rdns/setting"
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiwatch "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 )
 
-func NewIngressResource(kubeClient *kubernetes.Clientset, rdnsClient *rdns.Client) *IngressResource {
+// NewIngressResource watches the ingresses matched by selector and assigns them hostnames on the rdns domain,
+// the load balancer addresses of the ingresses are published with publish. The hostnames are claimed in
+// owners, which the other watchers of the domain share.
+func NewIngressResource(kubeClient kubernetes.Interface, rdnsClient rdns.Provider, publish PublishFunc, selector labels.Selector, owners *HostnameOwners) *IngressResource {
 	queue := workqueue.New()
 	stop := make(chan struct{})
-	return &IngressResource{rdnsClient, kubeClient, queue, stop}
+	owners.register()
+	return &IngressResource{
+		rdnsClient: rdnsClient,
+		kubeClient: kubeClient,
+		publish:    publish,
+		queue:      queue,
+		stop:       stop,
+		resolver:   resolver.Default,
+		selector:   selector,
+
+		pending:     make(map[string]bool),
+		hostnames:   make(map[string]string),
+		owners:      owners,
+		lbHostnames: make(map[string]*extensionsv1beta1.Ingress),
+	}
+}
+
+// SetResolver replaces the resolver used for hostname-only load balancers
+func (n *IngressResource) SetResolver(r resolver.Resolver) {
+	n.resolver = r
+}
+
+func hasLoadBalancerHostname(ing *extensionsv1beta1.Ingress) bool {
+	for _, i := range ing.Status.LoadBalancer.Ingress {
+		if i.IP == "" && i.Hostname != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// track remembers the ingresses backed by hostname-only load balancers, they are
+// resynced on every refresh because the resolved ips can change behind the hostname
+func (n *IngressResource) track(ing *extensionsv1beta1.Ingress) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if hasLoadBalancerHostname(ing) {
+		n.lbHostnames[ingressKey(ing)] = ing
+	} else {
+		delete(n.lbHostnames, ingressKey(ing))
+	}
+}
+
+func (n *IngressResource) untrack(ing *extensionsv1beta1.Ingress) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.lbHostnames, ingressKey(ing))
+	key := ingressKey(ing)
+	n.owners.Release(n.hostnames[key], key)
+	delete(n.hostnames, key)
+}
+
+func (n *IngressResource) refreshLoop() {
+	ticker := time.NewTicker(setting.GetLoadBalancerHostnameRefresh())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stop:
+			return
+		}
+
+		n.lock.RLock()
+		ings := make([]*extensionsv1beta1.Ingress, 0, len(n.lbHostnames))
+		for _, ing := range n.lbHostnames {
+			ings = append(ings, ing)
+		}
+		n.lock.RUnlock()
+
+		for _, ing := range ings {
+			log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Debug("Refresh ingress with hostname load balancer")
+			n.enqueue(ing)
+		}
+	}
+}
+
+func ingressKey(ing *extensionsv1beta1.Ingress) string {
+	return fmt.Sprintf("%s/%s", ing.Namespace, ing.Name)
+}
+
+func (n *IngressResource) enqueue(ing *extensionsv1beta1.Ingress) {
+	n.lock.Lock()
+	n.pending[ingressKey(ing)] = true
+	n.lock.Unlock()
+	n.queue.Add(ing)
+}
+
+func (n *IngressResource) done(ing *extensionsv1beta1.Ingress, hostname string) {
+	n.lock.Lock()
+	delete(n.pending, ingressKey(ing))
+	n.lock.Unlock()
+	n.setHostname(ing, hostname)
+}
+
+func (n *IngressResource) setHostname(ing *extensionsv1beta1.Ingress, hostname string) {
+	if hostname == "" {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	key := ingressKey(ing)
+	if prev := n.hostnames[key]; prev != hostname {
+		n.owners.Release(prev, key)
+	}
+	n.hostnames[key] = hostname
+	n.owners.Claim(hostname, key)
+}
+
+func (n *IngressResource) State() IngressState {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	state := IngressState{
+		Queue:     []string{},
+		Hostnames: make(map[string]string, len(n.hostnames)),
+	}
+	for key := range n.pending {
+		state.Queue = append(state.Queue, key)
+	}
+	sort.Strings(state.Queue)
+	for key, hostname := range n.hostnames {
+		state.Hostnames[key] = hostname
+	}
+	return state
+}
+
+// Exclude leaves the ingresses matched by the selectors of other domains to them
+func (n *IngressResource) Exclude(selectors ...labels.Selector) {
+	n.excluded = append(n.excluded, selectors...)
+}
+
+// selects reports whether the ingress belongs to the domain of this resource
+func (n *IngressResource) selects(ing *extensionsv1beta1.Ingress) bool {
+	set := labels.Set(ing.Labels)
+	for _, s := range n.excluded {
+		if s.Matches(set) {
+			return false
+		}
+	}
+	return n.selector == nil || n.selector.Matches(set)
 }
 
 func (n *IngressResource) ignore(ing *extensionsv1beta1.Ingress) bool {
@@ -35,32 +181,38 @@ func (n *IngressResource) ignore(ing *extensionsv1beta1.Ingress) bool {
 	return true
 }
 
-func (n *IngressResource) getRdnsHostname(ing *extensionsv1beta1.Ingress) string {
-	_, rootFqdn := k8s.GetTokenAndRootFqdn(n.kubeClient)
-	return fmt.Sprintf("%s.%s.%s", ing.Name, ing.Namespace, rootFqdn)
+// getRdnsHostname renders the hostname of the ingress under rootFqdn, the root fqdn is read
+// once by the caller because it may cost a request
+func getRdnsHostname(ing *extensionsv1beta1.Ingress, rootFqdn string) (string, error) {
+	return renderHostname(setting.GetHostnameTemplate(), ing.ObjectMeta, rootFqdn)
 }
 
 func (n *IngressResource) getIngressIps(ing *extensionsv1beta1.Ingress) []string {
-	var ips []string
-	for _, i := range ing.Status.LoadBalancer.Ingress {
-		if i.IP != "" {
-			ips = append(ips, i.IP)
-		}
-	}
-	logrus.Debugf("Got ingress resource ip addresses: %s", ips)
+	ips := loadBalancerIPs(ing.Status.LoadBalancer, n.resolver)
+	log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Debugf("Got ingress ip addresses: %s", ips)
 
 	return ips
 }
 
-func (n *IngressResource) sync(ing *extensionsv1beta1.Ingress) {
-	fqdn := n.getRdnsHostname(ing)
+func (n *IngressResource) sync(ing *extensionsv1beta1.Ingress) string {
+	rootFqdn := n.rdnsClient.RootFqdn()
+	fqdn, err := getRdnsHostname(ing, rootFqdn)
+	if err != nil {
+		log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Errorf("Failed to generate hostname: %v", err)
+		return ""
+	}
+	if owner := n.hostnameWinner(ing, fqdn, rootFqdn); owner != "" {
+		n.markConflict(ing, fqdn, owner)
+		return ""
+	}
+	assigned := ""
 
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		// Retrieve the latest version of Ingress before attempting update
 		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
 		latestIng, err := n.kubeClient.ExtensionsV1beta1().Ingresses(ing.Namespace).Get(ing.Name, metav1.GetOptions{})
 		if err != nil {
-			logrus.Errorf("Failed to get latest version of ingress: %v", err)
+			log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Errorf("Failed to get latest version of ingress: %v", err)
 			return err
 		}
 
@@ -75,81 +227,145 @@ func (n *IngressResource) sync(ing *extensionsv1beta1.Ingress) {
 		case ingressClassNginx:
 			ips := n.getIngressIps(latestIng)
 			if len(ips) > 0 {
-				if err := n.rdnsClient.ApplyDomain(ips); err == nil {
+				if err := n.publish(ips); err == nil {
 					latestIng.Annotations[annotationHostname] = fqdn
+					assigned = fqdn
 				} else {
-					logrus.Error(errors.Wrap(err, "Called by ingress watch"))
+					log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Errorf("Failed to apply domain: %v", err)
 					return err
 				}
 			}
 		default:
-			logrus.Infof("Do nothing with ingress class %s", latestIng.Annotations[annotationIngressClass])
+			log.WithFields(logrus.Fields{logging.FieldIngress: latestIng.Name, logging.FieldNamespace: latestIng.Namespace}).Infof("Do nothing with ingress class %s", latestIng.Annotations[annotationIngressClass])
 		}
 
 		changed := false
+		var before, after []string
 
 		// Also need to update rules for hostname when using nginx
 		for i, rule := range latestIng.Spec.Rules {
-			logrus.Debugf("Got ingress resource hostname: %s", rule.Host)
+			log.WithFields(logrus.Fields{logging.FieldIngress: latestIng.Name, logging.FieldNamespace: latestIng.Namespace}).Debugf("Got ingress rule host: %s", rule.Host)
+			before = append(before, rule.Host)
 			if strings.HasSuffix(rule.Host, setting.GetRootDomain()) && rule.Host != fqdn {
 				latestIng.Spec.Rules[i].Host = fqdn
 				changed = true
 			}
+			after = append(after, latestIng.Spec.Rules[i].Host)
 		}
 
+		if _, ok := latestIng.Annotations[annotationConflict]; ok && assigned != "" {
+			delete(latestIng.Annotations, annotationConflict)
+			changed = true
+		}
+
+		tlsAdded := ensureTLS(latestIng, fqdn)
+		changed = changed || tlsAdded
+
 		if !changed {
 			return nil
 		}
 
+		if setting.IsDryRun() {
+			added, removed := dryrun.Diff(before, after)
+			dryrun.Record(dryrun.Action{
+				Operation: "update ingress",
+				Target:    fmt.Sprintf("%s/%s", latestIng.Namespace, latestIng.Name),
+				Added:     added,
+				Removed:   removed,
+				Message:   fmt.Sprintf("rewrite rule hosts to %s, add tls: %t", fqdn, tlsAdded),
+			})
+			return nil
+		}
+
 		_, err = n.kubeClient.ExtensionsV1beta1().Ingresses(latestIng.Namespace).Update(latestIng)
 		if err != nil {
-			logrus.Errorf("Failed to update ingress resource: %v", err)
+			log.WithFields(logrus.Fields{logging.FieldIngress: latestIng.Name, logging.FieldNamespace: latestIng.Namespace}).Errorf("Failed to update ingress: %v", err)
 		}
 
 		return err
 	})
 
 	if retryErr != nil {
-		logrus.Errorf("Failed to retry to update ingress resource: %v", retryErr)
+		log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Errorf("Failed to retry to update ingress: %v", retryErr)
+		return ""
 	}
+	return assigned
 }
 
 func (n *IngressResource) WatchResources() {
 	defer close(n.stop)
 
-	watcher := cache.NewListWatchFromClient(n.kubeClient.ExtensionsV1beta1().RESTClient(), "ingresses", v1.NamespaceAll, fields.Everything())
+	// the typed client is used rather than its rest client, which a fake clientset does not have
+	watcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return n.kubeClient.ExtensionsV1beta1().Ingresses(v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
+			return n.kubeClient.ExtensionsV1beta1().Ingresses(v1.NamespaceAll).Watch(options)
+		},
+	}
 
-	_, wc := cache.NewInformer(watcher,
+	store, wc := cache.NewInformer(watcher,
 		&extensionsv1beta1.Ingress{},
 		setting.GetIngressResyncDuration(),
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				addIng := obj.(*extensionsv1beta1.Ingress)
+				if !n.selects(addIng) {
+					return
+				}
+				n.track(addIng)
+				// the hostname the ingress already owns is claimed before the watchers process claims
+				n.setHostname(addIng, GetIngressHostname(addIng))
 				if !n.ignore(addIng) {
-					logrus.Infof("Created ingress /%s/%s", addIng.Namespace, addIng.Name)
-					n.queue.Add(addIng)
+					log.WithFields(logrus.Fields{logging.FieldIngress: addIng.Name, logging.FieldNamespace: addIng.Namespace}).Info("Created ingress")
+					n.enqueue(addIng)
 				}
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
 				newIng := newObj.(*extensionsv1beta1.Ingress)
+				if !n.selects(newIng) {
+					n.untrack(newIng)
+					return
+				}
+				n.track(newIng)
 				if !n.ignore(newIng) {
-					logrus.Infof("Updated ingress /%s/%s", newIng.Namespace, newIng.Name)
-					n.queue.Add(newIng)
+					log.WithFields(logrus.Fields{logging.FieldIngress: newIng.Name, logging.FieldNamespace: newIng.Namespace}).Info("Updated ingress")
+					n.enqueue(newIng)
+				} else {
+					n.setHostname(newIng, GetIngressHostname(newIng))
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if delIng, ok := obj.(*extensionsv1beta1.Ingress); ok {
+					n.untrack(delIng)
 				}
 			},
 		})
+	n.store = store
 	go wc.Run(n.stop)
+	go n.refreshLoop()
 
 	go func() {
+		// the hostnames already owned by the objects of the domain are indexed before any claim
+		// is processed
+		if !cache.WaitForCacheSync(n.stop, wc.HasSynced) {
+			return
+		}
+		n.owners.restored()
+		if !n.owners.wait(n.stop) {
+			return
+		}
 		for {
 			item, quit := n.queue.Get()
 			if quit {
 				return
 			}
 			ing := item.(*extensionsv1beta1.Ingress)
-			logrus.Debugf("Ingress resource /%s/%s: begin processing", ing.Namespace, ing.Name)
-			n.sync(ing)
-			logrus.Debugf("Ingress resource /%s/%s: done processing", ing.Namespace, ing.Name)
+			log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).Debug("Begin processing ingress")
+			hostname := n.sync(ing)
+			n.done(ing, hostname)
+			log.WithFields(logrus.Fields{logging.FieldIngress: ing.Name, logging.FieldNamespace: ing.Namespace}).WithField(logging.FieldFqdn, hostname).Debug("Done processing ingress")
 			n.queue.Done(item)
 		}
 	}()
@@ -157,3 +373,24 @@ func (n *IngressResource) WatchResources() {
 	<-n.stop
 	n.queue.ShutDown()
 }
+
+// ListManagedIngresses returns the ingresses which have been assigned a rdns hostname
+func ListManagedIngresses(kubeClient kubernetes.Interface) ([]extensionsv1beta1.Ingress, error) {
+	ings, err := kubeClient.ExtensionsV1beta1().Ingresses(v1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []extensionsv1beta1.Ingress
+	for _, ing := range ings.Items {
+		if ing.Annotations[annotationHostname] != "" {
+			managed = append(managed, ing)
+		}
+	}
+	return managed, nil
+}
+
+// GetIngressHostname returns the rdns hostname assigned to the ingress
+func GetIngressHostname(ing *extensionsv1beta1.Ingress) string {
+	return ing.Annotations[annotationHostname]
+}
@@ -0,0 +1,243 @@
+package watch
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/rdns/fake"
+	"github.com/niusmallnan/kube-rdns/controller/resolver"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+const rootFqdn = "abcd.lb.rancher.cloud"
+
+func newIngress(class string, lbIPs []string, hosts ...string) *extensionsv1beta1.Ingress {
+	ing := &extensionsv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"team": "a"}},
+	}
+	if class != "" {
+		ing.Annotations = map[string]string{annotationIngressClass: class}
+	}
+	for _, h := range hosts {
+		ing.Spec.Rules = append(ing.Spec.Rules, extensionsv1beta1.IngressRule{Host: h})
+	}
+	for _, ip := range lbIPs {
+		ing.Status.LoadBalancer.Ingress = append(ing.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+	}
+	return ing
+}
+
+// newIngressEnv returns an ingress resource of the saved domain rootFqdn, which has the host
+// 9.9.9.9 on the fake rdns server, with ing stored in the fake clientset
+func newIngressEnv(t *testing.T, ing *extensionsv1beta1.Ingress) (*IngressResource, *kubefake.Clientset, *fake.Server) {
+	t.Helper()
+	server := fake.NewServer()
+	base, err := server.Start("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	if err := testutil.InitSettings(map[string]string{"base-rdns-url": base, "allow-insecure-token": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	server.AddDomain(rootFqdn, "secret", []string{"9.9.9.9"})
+	kube := testutil.NewClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: setting.DefaultDomainSecret, Namespace: metav1.NamespaceSystem},
+		Data:       map[string][]byte{"token": []byte("secret"), "fqdn": []byte(rootFqdn), "backend": []byte(base)},
+	}, ing)
+
+	domain, _ := setting.GetDomain("")
+	client := rdns.NewClient(kube, domain)
+	publish := func(addresses []string) error {
+		return client.ApplyDomain(selector.FromAddresses(addresses))
+	}
+	return NewIngressResource(kube, client, publish, nil, NewHostnameOwners()), kube, server
+}
+
+func TestIngressSync(t *testing.T) {
+	tests := []struct {
+		name         string
+		ing          *extensionsv1beta1.Ingress
+		wantHostname string
+		wantHosts    []string
+		wantDomain   []string
+	}{
+		{
+			name:         "default class",
+			ing:          newIngress("", []string{"1.1.1.1"}, "old.lb.rancher.cloud"),
+			wantHostname: "web.default." + rootFqdn,
+			wantHosts:    []string{"web.default." + rootFqdn},
+			wantDomain:   []string{"1.1.1.1"},
+		},
+		{
+			name:         "nginx class",
+			ing:          newIngress(ingressClassNginx, []string{"1.1.1.1", "2.2.2.2"}, "old.lb.rancher.cloud"),
+			wantHostname: "web.default." + rootFqdn,
+			wantHosts:    []string{"web.default." + rootFqdn},
+			wantDomain:   []string{"1.1.1.1", "2.2.2.2"},
+		},
+		{
+			name:       "other class",
+			ing:        newIngress("traefik", []string{"1.1.1.1"}, "example.com"),
+			wantHosts:  []string{"example.com"},
+			wantDomain: []string{"9.9.9.9"},
+		},
+		{
+			name:         "host outside the root domain",
+			ing:          newIngress("", []string{"1.1.1.1"}, "example.com", "old.lb.rancher.cloud"),
+			wantHostname: "web.default." + rootFqdn,
+			wantHosts:    []string{"example.com", "web.default." + rootFqdn},
+			wantDomain:   []string{"1.1.1.1"},
+		},
+		{
+			name:       "no load balancer ips",
+			ing:        newIngress("", nil, "example.com"),
+			wantHosts:  []string{"example.com"},
+			wantDomain: []string{"9.9.9.9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, kube, server := newIngressEnv(t, tt.ing)
+			if got := n.sync(tt.ing); got != tt.wantHostname {
+				t.Fatalf("sync() = %q, want %q", got, tt.wantHostname)
+			}
+
+			ing, err := kube.ExtensionsV1beta1().Ingresses("default").Get("web", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := GetIngressHostname(ing); got != tt.wantHostname {
+				t.Fatalf("hostname annotation = %q, want %q", got, tt.wantHostname)
+			}
+			var hosts []string
+			for _, rule := range ing.Spec.Rules {
+				hosts = append(hosts, rule.Host)
+			}
+			if len(hosts) != len(tt.wantHosts) {
+				t.Fatalf("rule hosts = %v, want %v", hosts, tt.wantHosts)
+			}
+			for i := range hosts {
+				if hosts[i] != tt.wantHosts[i] {
+					t.Fatalf("rule hosts = %v, want %v", hosts, tt.wantHosts)
+				}
+			}
+			if n := server.Requests(fake.OpCreate); n != 0 {
+				t.Fatalf("%d domains were created for a saved domain", n)
+			}
+			d, _ := server.Domain(rootFqdn)
+			got := append([]string(nil), d.Hosts...)
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.wantDomain, ",") {
+				t.Fatalf("domain hosts = %v, want %v", got, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func TestIngressSelects(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		exclude  string
+		want     bool
+	}{
+		{name: "no selector", want: true},
+		{name: "matching", selector: "team=a", want: true},
+		{name: "not matching", selector: "team=b", want: false},
+		{name: "selected by another domain", exclude: "team=a", want: false},
+		{name: "not selected by another domain", exclude: "team=b", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sel labels.Selector
+			if tt.selector != "" {
+				var err error
+				if sel, err = labels.Parse(tt.selector); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n := NewIngressResource(nil, nil, nil, sel, NewHostnameOwners())
+			if tt.exclude != "" {
+				exclude, err := labels.Parse(tt.exclude)
+				if err != nil {
+					t.Fatal(err)
+				}
+				n.Exclude(exclude)
+			}
+			if got := n.selects(newIngress("", nil)); got != tt.want {
+				t.Fatalf("selects() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngressSyncLoadBalancerHostname(t *testing.T) {
+	static := resolver.Static{
+		"lb.example.com":    {"3.3.3.3", "4.4.4.4", "2001:db8::1"},
+		"lb6.example.com":   {"2001:db8::1"},
+		"other.example.com": {"5.5.5.5"},
+	}
+	tests := []struct {
+		name         string
+		lbIPs        []string
+		lbHostnames  []string
+		wantHostname string
+		wantDomain   []string
+	}{
+		{
+			name:         "resolved hostname",
+			lbHostnames:  []string{"lb.example.com"},
+			wantHostname: "web.default." + rootFqdn,
+			wantDomain:   []string{"3.3.3.3", "4.4.4.4"},
+		},
+		{
+			name:         "ip and hostname",
+			lbIPs:        []string{"1.1.1.1"},
+			lbHostnames:  []string{"other.example.com"},
+			wantHostname: "web.default." + rootFqdn,
+			wantDomain:   []string{"1.1.1.1", "5.5.5.5"},
+		},
+		{
+			name:        "no address of the ip family",
+			lbHostnames: []string{"lb6.example.com"},
+			wantDomain:  []string{"9.9.9.9"},
+		},
+		{
+			name:        "unresolvable hostname",
+			lbHostnames: []string{"missing.example.com"},
+			wantDomain:  []string{"9.9.9.9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := newIngress("", tt.lbIPs, "old.lb.rancher.cloud")
+			for _, h := range tt.lbHostnames {
+				ing.Status.LoadBalancer.Ingress = append(ing.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{Hostname: h})
+			}
+			n, _, server := newIngressEnv(t, ing)
+			n.SetResolver(static)
+
+			if got := n.sync(ing); got != tt.wantHostname {
+				t.Fatalf("sync() = %q, want %q", got, tt.wantHostname)
+			}
+			n.track(ing)
+			if _, ok := n.lbHostnames[ingressKey(ing)]; !ok {
+				t.Fatal("the ingress is not refreshed when the load balancer hostname resolves to other ips")
+			}
+			d, _ := server.Domain(rootFqdn)
+			if strings.Join(d.Hosts, ",") != strings.Join(tt.wantDomain, ",") {
+				t.Fatalf("domain hosts = %v, want %v", d.Hosts, tt.wantDomain)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package watch
+
+import (
+	"github.com/niusmallnan/kube-rdns/controller/resolver"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"k8s.io/api/core/v1"
+)
+
+// loadBalancerIPs returns the ips of the load balancer status, hostname-only entries are resolved
+func loadBalancerIPs(status v1.LoadBalancerStatus, r resolver.Resolver) []string {
+	var ips []string
+	for _, i := range status.Ingress {
+		if i.IP != "" && selector.MatchFamily(i.IP, setting.GetIPFamily()) {
+			ips = append(ips, i.IP)
+		}
+		if i.IP == "" && i.Hostname != "" {
+			resolved, err := r.LookupHost(i.Hostname)
+			if err != nil {
+				log.Errorf("Failed to resolve load balancer hostname %s: %v", i.Hostname, err)
+				continue
+			}
+			for _, ip := range resolved {
+				if selector.MatchFamily(ip, setting.GetIPFamily()) {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+	return ips
+}
@@ -0,0 +1,89 @@
+package watch
+
+import (
+	"sync"
+)
+
+// HostnameOwners indexes the object which owns each hostname of a domain. The ingresses,
+// services, routes and rdnsrecords of a domain share it, so that the records of one object
+// never override the answer of another. The ingresses are named namespace/name as in their
+// conflict annotation, the other objects are prefixed with their kind.
+type HostnameOwners struct {
+	lock    sync.RWMutex
+	owners  map[string]string
+	pending int
+	indexed chan struct{}
+}
+
+func NewHostnameOwners() *HostnameOwners {
+	return &HostnameOwners{owners: make(map[string]string), indexed: make(chan struct{})}
+}
+
+func ownerName(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// Owner returns the owner of fqdn, or an empty string if no object owns it
+func (o *HostnameOwners) Owner(fqdn string) string {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.owners[fqdn]
+}
+
+// Claim makes owner the owner of fqdn unless another object owns it, it returns that other owner
+func (o *HostnameOwners) Claim(fqdn, owner string) string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if current := o.owners[fqdn]; current != "" && current != owner {
+		return current
+	}
+	o.owners[fqdn] = owner
+	return ""
+}
+
+// Release gives up fqdn if owner owns it
+func (o *HostnameOwners) Release(fqdn, owner string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.owners[fqdn] == owner {
+		delete(o.owners, fqdn)
+	}
+}
+
+// register adds a watcher which claims the hostnames its objects already own before any new
+// claim is processed
+func (o *HostnameOwners) register() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.pending++
+}
+
+// restored reports that a registered watcher claimed the hostnames its objects already own
+func (o *HostnameOwners) restored() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.pending == 0 {
+		return
+	}
+	o.pending--
+	if o.pending == 0 {
+		close(o.indexed)
+	}
+}
+
+// wait blocks until every registered watcher restored its hostnames, it returns false if stop
+// is closed first
+func (o *HostnameOwners) wait(stop <-chan struct{}) bool {
+	o.lock.RLock()
+	pending := o.pending
+	o.lock.RUnlock()
+	if pending == 0 {
+		return true
+	}
+	select {
+	case <-o.indexed:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,510 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/hostname"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/resolver"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	recordGroupVersion = "rdns.cattle.io/v1"
+	recordResource     = "rdnsrecords"
+
+	RecordTypeA    = "A"
+	RecordTypeAAAA = "AAAA"
+	RecordTypeTXT  = "TXT"
+
+	// maxRecordTTL is the largest ttl of a record, rfc 2181 section 8
+	maxRecordTTL = 1<<31 - 1
+)
+
+// RecordSpec declares an extra record under the root fqdn
+type RecordSpec struct {
+	Hostname     string            `json:"hostname,omitempty"`
+	Type         string            `json:"type,omitempty"`
+	TTL          int64             `json:"ttl,omitempty"`
+	Addresses    []string          `json:"addresses,omitempty"`
+	Text         string            `json:"text,omitempty"`
+	TargetRef    *RecordTargetRef  `json:"targetRef,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// RecordTargetRef points at a Service or Ingress whose load balancer addresses are published
+type RecordTargetRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// RecordStatus reports the published fqdn and the last reconcile result
+type RecordStatus struct {
+	Fqdn               string   `json:"fqdn,omitempty"`
+	ObservedHosts      []string `json:"observedHosts,omitempty"`
+	ObservedGeneration int64    `json:"observedGeneration,omitempty"`
+	LastError          string   `json:"lastError,omitempty"`
+}
+
+// Record is the RDNSRecord custom resource
+type Record struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              RecordSpec   `json:"spec"`
+	Status            RecordStatus `json:"status,omitempty"`
+}
+
+type recordList struct {
+	Items []Record `json:"items"`
+}
+
+// addressRecords are the addresses published for a name
+type addressRecords struct {
+	addresses []string
+	ttl       uint32
+}
+
+// RecordResource reconciles RDNSRecord custom resources, they are polled because there is
+// no typed client for the CRD. The records are published by name, which the rdns provider
+// cannot do, the records report it in their status instead.
+type RecordResource struct {
+	rdnsClient rdns.Provider
+	kubeClient kubernetes.Interface
+	addresses  *address.Resolver
+	resolver   resolver.Resolver
+	stop       chan struct{}
+	owners     *HostnameOwners
+
+	// published, claims and indexed are only used by the poll loop
+	published map[string]addressRecords
+	claims    map[string]string
+	indexed   bool
+
+	lock    sync.RWMutex
+	records map[string]Record
+}
+
+// NewRecordResource reconciles the rdnsrecords, their hostnames are claimed in owners, which the
+// other watchers of the domain share. The records of a namespace share its claims.
+func NewRecordResource(kubeClient kubernetes.Interface, rdnsClient rdns.Provider, addresses *address.Resolver, owners *HostnameOwners) *RecordResource {
+	owners.register()
+	return &RecordResource{
+		rdnsClient: rdnsClient,
+		kubeClient: kubeClient,
+		addresses:  addresses,
+		resolver:   resolver.Default,
+		stop:       make(chan struct{}),
+		owners:     owners,
+		published:  make(map[string]addressRecords),
+		claims:     make(map[string]string),
+		records:    make(map[string]Record),
+	}
+}
+
+// Records returns the last reconciled records
+func (r *RecordResource) Records() []Record {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	records := make([]Record, 0, len(r.records))
+	for _, rec := range r.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Namespace+"/"+records[i].Name < records[j].Namespace+"/"+records[j].Name
+	})
+	return records
+}
+
+func recordPath(namespace, name string) string {
+	segments := []string{"/apis", recordGroupVersion}
+	if namespace != "" {
+		segments = append(segments, "namespaces", namespace)
+	}
+	segments = append(segments, recordResource)
+	if name != "" {
+		segments = append(segments, name, "status")
+	}
+	return strings.Join(segments, "/")
+}
+
+func recordOwner(namespace string) string {
+	return "rdnsrecord/" + namespace
+}
+
+// getFqdn returns the fqdn of the record, a custom hostname has to end with the namespace of the
+// record so that a namespace cannot publish the names of another one
+func (r *RecordResource) getFqdn(rec *Record) (string, error) {
+	rootFqdn := r.rdnsClient.RootFqdn()
+	if rec.Spec.Hostname != "" {
+		name := hostname.Sanitize(rec.Spec.Hostname)
+		if name == "" {
+			return "", errors.Errorf("hostname %q is invalid", rec.Spec.Hostname)
+		}
+		if !inNamespace(name, rec.Namespace) {
+			return "", errors.Errorf("hostname %s does not end with the namespace %s", name, rec.Namespace)
+		}
+		return hostname.Join(name, rootFqdn)
+	}
+	return hostname.Render(setting.GetHostnameTemplate(), hostname.NewData(rec.Name, rec.Namespace), rootFqdn)
+}
+
+// getHosts returns the addresses the record points at, filtered by the record type
+func (r *RecordResource) getHosts(rec *Record) ([]string, error) {
+	var candidates []string
+	switch {
+	case len(rec.Spec.Addresses) > 0:
+		candidates = rec.Spec.Addresses
+	case rec.Spec.TargetRef != nil:
+		switch rec.Spec.TargetRef.Kind {
+		case "Service":
+			svc, err := r.kubeClient.CoreV1().Services(rec.Namespace).Get(rec.Spec.TargetRef.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			candidates = loadBalancerIPs(svc.Status.LoadBalancer, r.resolver)
+		case "Ingress":
+			ing, err := r.kubeClient.ExtensionsV1beta1().Ingresses(rec.Namespace).Get(rec.Spec.TargetRef.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			candidates = loadBalancerIPs(ing.Status.LoadBalancer, r.resolver)
+		default:
+			return nil, errors.Errorf("unsupported target kind %q", rec.Spec.TargetRef.Kind)
+		}
+	case len(rec.Spec.NodeSelector) > 0:
+		nodes, err := r.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set(rec.Spec.NodeSelector)).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := range nodes.Items {
+			candidates = append(candidates, r.addresses.NodeAddresses(&nodes.Items[i], selector.FamilyDual)...)
+		}
+	default:
+		return nil, errors.New("one of addresses, targetRef or nodeSelector is required")
+	}
+
+	family := selector.FamilyIPv4
+	if rec.Spec.Type == RecordTypeAAAA {
+		family = selector.FamilyIPv6
+	}
+	var hosts []string
+	for _, c := range candidates {
+		if selector.MatchFamily(c, family) {
+			hosts = append(hosts, c)
+		}
+	}
+	sort.Strings(hosts)
+	if len(hosts) == 0 {
+		return nil, errors.Errorf("no %s addresses found", rec.Spec.Type)
+	}
+	return hosts, nil
+}
+
+// reconcile validates the record and resolves its fqdn and addresses, the address records
+// are published by publish once every record of their name is known
+func (r *RecordResource) reconcile(rec *Record, prev Record) RecordStatus {
+	status := RecordStatus{ObservedGeneration: rec.Generation}
+	if rec.Spec.Type == "" {
+		rec.Spec.Type = RecordTypeA
+	}
+	if rec.Spec.TTL < 0 || rec.Spec.TTL > maxRecordTTL {
+		status.LastError = fmt.Sprintf("ttl %d is out of range, must be between 0 and %d", rec.Spec.TTL, maxRecordTTL)
+		return status
+	}
+
+	fqdn, err := r.getFqdn(rec)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	status.Fqdn = fqdn
+	if other := r.owners.Claim(fqdn, recordOwner(rec.Namespace)); other != "" {
+		status.LastError = fmt.Sprintf("hostname %s is owned by %s", fqdn, other)
+		return status
+	}
+
+	switch rec.Spec.Type {
+	case RecordTypeTXT:
+		if rec.Spec.TTL != 0 {
+			err = errors.New("ttl is not supported for TXT records, they use the ttl of the provider")
+			break
+		}
+		if prev.Status.Fqdn == fqdn && prev.Spec.Text == rec.Spec.Text && prev.Status.LastError == "" {
+			return status
+		}
+		err = r.rdnsClient.SetTXTRecord(fqdn, rec.Spec.Text)
+	case RecordTypeA, RecordTypeAAAA:
+		status.ObservedHosts, err = r.getHosts(rec)
+	default:
+		err = errors.Errorf("unsupported record type %q", rec.Spec.Type)
+	}
+	if err != nil {
+		status.LastError = statusError(err)
+	}
+	return status
+}
+
+// publish sets the address records of every name declared by the records, and deletes the
+// names which are no longer declared. Records of the same name are merged, the smallest ttl wins.
+func (r *RecordResource) publish(records map[string]*Record) {
+	names := make(map[string]*addressRecords)
+	owners := make(map[string][]*Record)
+	for _, rec := range records {
+		if rec.Status.LastError != "" || (rec.Spec.Type != RecordTypeA && rec.Spec.Type != RecordTypeAAAA) {
+			continue
+		}
+		fqdn := rec.Status.Fqdn
+		name, ok := names[fqdn]
+		if !ok {
+			name = &addressRecords{}
+			names[fqdn] = name
+		}
+		name.addresses = append(name.addresses, rec.Status.ObservedHosts...)
+		if ttl := uint32(rec.Spec.TTL); ttl != 0 && (name.ttl == 0 || ttl < name.ttl) {
+			name.ttl = ttl
+		}
+		owners[fqdn] = append(owners[fqdn], rec)
+	}
+
+	published := make(map[string]addressRecords, len(names))
+	for fqdn, name := range names {
+		name.addresses = dedupe(name.addresses)
+		if reflect.DeepEqual(r.published[fqdn], *name) {
+			published[fqdn] = *name
+			continue
+		}
+		if err := r.rdnsClient.SetRecords(fqdn, name.addresses, name.ttl); err != nil {
+			for _, rec := range owners[fqdn] {
+				rec.Status.LastError = statusError(err)
+			}
+			continue
+		}
+		published[fqdn] = *name
+	}
+	for fqdn := range r.published {
+		if _, ok := names[fqdn]; ok {
+			continue
+		}
+		if err := r.rdnsClient.DeleteRecords(fqdn); err != nil {
+			log.Errorf("Failed to delete the records of %s: %v", fqdn, err)
+			published[fqdn] = r.published[fqdn]
+		}
+	}
+	r.published = published
+}
+
+// dedupe returns the sorted addresses without duplicates
+func dedupe(addresses []string) []string {
+	sort.Strings(addresses)
+	out := addresses[:0]
+	for i, a := range addresses {
+		if i == 0 || a != addresses[i-1] {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// forgetTXT deletes the txt value of a record which was deleted or changed
+func (r *RecordResource) forgetTXT(prev Record, current *Record) {
+	if prev.Spec.Type != RecordTypeTXT || prev.Status.Fqdn == "" || prev.Status.LastError != "" {
+		return
+	}
+	if current != nil && current.Spec.Type == RecordTypeTXT && current.Status.Fqdn == prev.Status.Fqdn && current.Spec.Text == prev.Spec.Text && current.Status.LastError == "" {
+		return
+	}
+	if err := r.rdnsClient.DeleteTXTRecord(prev.Status.Fqdn, prev.Spec.Text); err != nil {
+		log.Errorf("Failed to delete the txt record of %s: %v", prev.Status.Fqdn, err)
+	}
+}
+
+// updateStatus patches the status of the record unless the observed status is the same
+func (r *RecordResource) updateStatus(rec *Record, observed RecordStatus) error {
+	status := rec.Status
+	if reflect.DeepEqual(observed, status) {
+		return nil
+	}
+	if setting.IsDryRun() {
+		dryrun.Record(dryrun.Action{
+			Operation: "update rdnsrecord status",
+			Target:    rec.Namespace + "/" + rec.Name,
+			Message:   status.Fqdn,
+		})
+		return nil
+	}
+	data, err := statusPatch(status)
+	if err != nil {
+		return err
+	}
+	_, err = r.kubeClient.CoreV1().RESTClient().Patch(types.MergePatchType).AbsPath(recordPath(rec.Namespace, rec.Name)).Body(data).DoRaw()
+	return err
+}
+
+// statusPatch returns a merge patch of the whole status. The empty fields of RecordStatus are
+// omitted, so they are set to null to clear the values of the previous status, like the last
+// error of a record which recovered.
+func statusPatch(status RecordStatus) ([]byte, error) {
+	fields := map[string]interface{}{
+		"fqdn":               nil,
+		"observedHosts":      nil,
+		"observedGeneration": nil,
+		"lastError":          nil,
+	}
+	if status.Fqdn != "" {
+		fields["fqdn"] = status.Fqdn
+	}
+	if len(status.ObservedHosts) > 0 {
+		fields["observedHosts"] = status.ObservedHosts
+	}
+	if status.ObservedGeneration != 0 {
+		fields["observedGeneration"] = status.ObservedGeneration
+	}
+	if status.LastError != "" {
+		fields["lastError"] = status.LastError
+	}
+	return json.Marshal(map[string]interface{}{"status": fields})
+}
+
+// installed returns whether the apiserver serves the rdnsrecords
+func (r *RecordResource) installed() bool {
+	resources, err := r.kubeClient.Discovery().ServerResourcesForGroupVersion(recordGroupVersion)
+	if err != nil {
+		return false
+	}
+	for _, res := range resources.APIResources {
+		if res.Name == recordResource {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the rdnsrecords of every namespace, it returns false if they could not be listed
+func (r *RecordResource) list() ([]Record, bool) {
+	if !r.installed() {
+		log.Debug("RDNSRecord CRD is not installed, skip reconciling records")
+		return nil, false
+	}
+	data, err := r.kubeClient.CoreV1().RESTClient().Get().AbsPath(recordPath("", "")).DoRaw()
+	if apierrors.IsNotFound(err) {
+		log.Debug("RDNSRecord CRD is not installed, skip reconciling records")
+		return nil, false
+	}
+	if err != nil {
+		log.Errorf("Failed to list rdnsrecords: %v", err)
+		return nil, false
+	}
+
+	var list recordList
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Errorf("Failed to decode rdnsrecords: %v", err)
+		return nil, false
+	}
+	return list.Items, true
+}
+
+// restore claims the hostnames the records published before the controller started, the other
+// watchers of the domain wait for them on the first poll
+func (r *RecordResource) restore(items []Record) bool {
+	for _, rec := range items {
+		if rec.Status.Fqdn != "" && rec.Status.LastError == "" {
+			r.owners.Claim(rec.Status.Fqdn, recordOwner(rec.Namespace))
+			r.claims[rec.Status.Fqdn] = recordOwner(rec.Namespace)
+		}
+	}
+	r.indexed = true
+	r.owners.restored()
+	return r.owners.wait(r.stop)
+}
+
+// release gives up the hostnames which none of the records of a namespace uses anymore
+func (r *RecordResource) release(records map[string]*Record) {
+	claims := make(map[string]string)
+	for _, rec := range records {
+		if owner := recordOwner(rec.Namespace); rec.Status.Fqdn != "" && r.owners.Owner(rec.Status.Fqdn) == owner {
+			claims[rec.Status.Fqdn] = owner
+		}
+	}
+	for fqdn, owner := range r.claims {
+		if claims[fqdn] != owner {
+			r.owners.Release(fqdn, owner)
+		}
+	}
+	r.claims = claims
+}
+
+func (r *RecordResource) poll() {
+	items, ok := r.list()
+	if !r.indexed && !r.restore(items) {
+		return
+	}
+	if !ok {
+		return
+	}
+
+	prev := r.Records()
+	previous := make(map[string]Record, len(prev))
+	for _, rec := range prev {
+		previous[rec.Namespace+"/"+rec.Name] = rec
+	}
+
+	// the status is patched once the records are published
+	observed := make(map[string]RecordStatus, len(items))
+	current := make(map[string]*Record, len(items))
+	for i := range items {
+		rec := &items[i]
+		key := rec.Namespace + "/" + rec.Name
+		observed[key] = rec.Status
+		rec.Status = r.reconcile(rec, previous[key])
+		current[key] = rec
+	}
+	r.publish(current)
+	r.release(current)
+	for key, rec := range previous {
+		r.forgetTXT(rec, current[key])
+	}
+
+	records := make(map[string]Record, len(items))
+	for key, rec := range current {
+		if rec.Status.LastError != "" {
+			log.Errorf("Failed to reconcile rdnsrecord /%s: %s", key, rec.Status.LastError)
+		}
+		if err := r.updateStatus(rec, observed[key]); err != nil {
+			log.Errorf("Failed to update rdnsrecord /%s status: %v", key, err)
+		}
+		records[key] = *rec
+	}
+
+	r.lock.Lock()
+	r.records = records
+	r.lock.Unlock()
+}
+
+func (r *RecordResource) WatchResources() {
+	ticker := time.NewTicker(setting.GetRecordPollInterval())
+	defer ticker.Stop()
+	for {
+		r.poll()
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package watch
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newRecord(name, typ string, ttl int64, addresses ...string) *Record {
+	return &Record{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       RecordSpec{Hostname: "www.default", Type: typ, TTL: ttl, Addresses: addresses},
+	}
+}
+
+func TestRecordReconcile(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	owners := NewHostnameOwners()
+	owners.Claim("web.default."+rootFqdn, "default/web")
+	r := NewRecordResource(nil, newRecordingProvider(), nil, owners)
+	custom := func(name, host string) *Record {
+		rec := newRecord(name, RecordTypeA, 0, "1.1.1.1")
+		rec.Spec.Hostname = host
+		return rec
+	}
+
+	tests := []struct {
+		name      string
+		rec       *Record
+		wantHosts []string
+		wantErr   string
+	}{
+		{name: "a record", rec: newRecord("a", "", 60, "1.1.1.1", "2001:db8::1"), wantHosts: []string{"1.1.1.1"}},
+		{name: "aaaa record", rec: newRecord("aaaa", RecordTypeAAAA, 0, "1.1.1.1", "2001:db8::1"), wantHosts: []string{"2001:db8::1"}},
+		{name: "negative ttl", rec: newRecord("a", RecordTypeA, -1, "1.1.1.1"), wantErr: "out of range"},
+		{name: "ttl too large", rec: newRecord("a", RecordTypeA, maxRecordTTL+1, "1.1.1.1"), wantErr: "out of range"},
+		{name: "txt record with a ttl", rec: &Record{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}, Spec: RecordSpec{Hostname: "www.default", Type: RecordTypeTXT, TTL: 60, Text: "v"}}, wantErr: "not supported"},
+		{name: "no addresses of the family", rec: newRecord("a", RecordTypeAAAA, 0, "1.1.1.1"), wantErr: "no AAAA addresses"},
+		{name: "hostname of another namespace", rec: custom("a", "www.kube-system"), wantErr: "does not end with the namespace default"},
+		{name: "hostname without a namespace", rec: custom("a", "www"), wantErr: "does not end with the namespace default"},
+		{name: "hostname owned by an ingress", rec: custom("a", "web.default"), wantErr: "is owned by default/web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := r.reconcile(tt.rec, Record{})
+			if !strings.Contains(status.LastError, tt.wantErr) || (tt.wantErr == "") != (status.LastError == "") {
+				t.Fatalf("reconcile() error = %q, want %q", status.LastError, tt.wantErr)
+			}
+			if strings.Join(status.ObservedHosts, ",") != strings.Join(tt.wantHosts, ",") {
+				t.Fatalf("reconcile() hosts = %v, want %v", status.ObservedHosts, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestRecordPublish(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	provider := newRecordingProvider()
+	r := NewRecordResource(nil, provider, nil, NewHostnameOwners())
+	fqdn := "www.default." + rootFqdn
+
+	reconcile := func(recs ...*Record) map[string]*Record {
+		records := make(map[string]*Record, len(recs))
+		for _, rec := range recs {
+			rec.Status = r.reconcile(rec, Record{})
+			records[rec.Name] = rec
+		}
+		return records
+	}
+
+	// the a and aaaa records of a name are published together with the smallest ttl
+	records := reconcile(newRecord("a", RecordTypeA, 300, "1.1.1.1", "2.2.2.2"), newRecord("aaaa", RecordTypeAAAA, 60, "2001:db8::1"))
+	r.publish(records)
+	if got := provider.records[fqdn]; strings.Join(got, ",") != "1.1.1.1,2.2.2.2,2001:db8::1" {
+		t.Fatalf("records of %s = %v, want the a and aaaa addresses", fqdn, got)
+	}
+	if provider.ttls[fqdn] != 60 {
+		t.Fatalf("ttl of %s = %d, want 60", fqdn, provider.ttls[fqdn])
+	}
+
+	// unchanged records are not published again
+	r.publish(reconcile(newRecord("a", RecordTypeA, 300, "1.1.1.1", "2.2.2.2"), newRecord("aaaa", RecordTypeAAAA, 60, "2001:db8::1")))
+	if provider.sets != 1 {
+		t.Fatalf("records were set %d times, want 1", provider.sets)
+	}
+
+	r.publish(reconcile(newRecord("a", RecordTypeA, 0, "1.1.1.1")))
+	if got := provider.records[fqdn]; strings.Join(got, ",") != "1.1.1.1" || provider.ttls[fqdn] != 0 {
+		t.Fatalf("records of %s = %v ttl %d, want [1.1.1.1] with the ttl of the provider", fqdn, got, provider.ttls[fqdn])
+	}
+
+	r.publish(nil)
+	if _, ok := provider.records[fqdn]; ok {
+		t.Fatalf("the records of %s were not deleted", fqdn)
+	}
+	if provider.applied != 0 {
+		t.Fatalf("the hosts of the domain were replaced %d times by a record", provider.applied)
+	}
+}
+
+func TestRecordStatusPatch(t *testing.T) {
+	previous := RecordStatus{Fqdn: "www." + rootFqdn, ObservedGeneration: 1, LastError: "no A addresses found"}
+	tests := []struct {
+		name   string
+		status RecordStatus
+	}{
+		{name: "error clears", status: RecordStatus{Fqdn: "www." + rootFqdn, ObservedHosts: []string{"1.1.1.1"}, ObservedGeneration: 2}},
+		{name: "error changes", status: RecordStatus{ObservedGeneration: 2, LastError: "ttl -1 is out of range"}},
+		{name: "empty status", status: RecordStatus{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := statusPatch(tt.status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mergeStatus(t, previous, data); !reflect.DeepEqual(got, tt.status) {
+				t.Fatalf("status after the patch %s = %+v, want %+v", data, got, tt.status)
+			}
+		})
+	}
+}
+
+// mergeStatus applies the status of a json merge patch to status, a null removes a field
+func mergeStatus(t *testing.T, status RecordStatus, patch []byte) RecordStatus {
+	data, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var p struct {
+		Status map[string]interface{} `json:"status"`
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range p.Status {
+		if v == nil {
+			delete(fields, k)
+		} else {
+			fields[k] = v
+		}
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		t.Fatal(err)
+	}
+	var merged RecordStatus
+	if err := json.Unmarshal(data, &merged); err != nil {
+		t.Fatal(err)
+	}
+	return merged
+}
+
+func TestRecordRelease(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	owners := NewHostnameOwners()
+	r := NewRecordResource(nil, newRecordingProvider(), nil, owners)
+	fqdn := "www.default." + rootFqdn
+
+	// the records of a namespace share the hostname, another namespace cannot publish it
+	a := newRecord("a", RecordTypeA, 0, "1.1.1.1")
+	b := newRecord("b", RecordTypeA, 0, "2.2.2.2")
+	a.Status = r.reconcile(a, Record{})
+	b.Status = r.reconcile(b, Record{})
+	if a.Status.LastError != "" || b.Status.LastError != "" {
+		t.Fatalf("reconcile() errors = %q, %q, want none", a.Status.LastError, b.Status.LastError)
+	}
+	if owner := owners.Owner(fqdn); owner != "rdnsrecord/default" {
+		t.Fatalf("owner of %s = %q, want rdnsrecord/default", fqdn, owner)
+	}
+	r.release(map[string]*Record{"default/a": a, "default/b": b})
+
+	r.release(map[string]*Record{"default/b": b})
+	if owner := owners.Owner(fqdn); owner != "rdnsrecord/default" {
+		t.Fatalf("owner of %s = %q while a record still uses it, want rdnsrecord/default", fqdn, owner)
+	}
+	r.release(nil)
+	if owner := owners.Owner(fqdn); owner != "" {
+		t.Fatalf("owner of %s = %q after its records were deleted, want none", fqdn, owner)
+	}
+}
+
+func TestRecordUnsupported(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRecordResource(nil, unsupportedProvider{newRecordingProvider()}, nil, NewHostnameOwners())
+	rec := newRecord("a", RecordTypeA, 0, "1.1.1.1")
+	rec.Status = r.reconcile(rec, Record{})
+	r.publish(map[string]*Record{"default/a": rec})
+	if rec.Status.LastError != unsupportedMessage {
+		t.Fatalf("status error = %q, want %q", rec.Status.LastError, unsupportedMessage)
+	}
+}
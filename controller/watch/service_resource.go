@@ -0,0 +1,418 @@
+package watch
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/resolver"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiwatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// NewServiceResource watches the exposed services, their hostnames are claimed in owners,
+// which the other watchers of the domain share.
+func NewServiceResource(kubeClient kubernetes.Interface, rdnsClient rdns.Provider, addresses *address.Resolver, owners *HostnameOwners) *ServiceResource {
+	owners.register()
+	return &ServiceResource{
+		rdnsClient: rdnsClient,
+		kubeClient: kubeClient,
+		addresses:  addresses,
+		queue:      workqueue.New(),
+		stop:       make(chan struct{}),
+		resolver:   resolver.Default,
+		store:      cache.NewStore(cache.MetaNamespaceKeyFunc),
+		owners:     owners,
+		hostnames:  make(map[string]string),
+	}
+}
+
+// SetResolver replaces the resolver used for hostname-only load balancers
+func (s *ServiceResource) SetResolver(r resolver.Resolver) {
+	s.resolver = r
+}
+
+func serviceKey(svc *v1.Service) string {
+	return fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
+}
+
+// exposed returns true for LoadBalancer and NodePort services which opted in by annotation
+func (s *ServiceResource) exposed(svc *v1.Service) bool {
+	if svc.Annotations[annotationExpose] != "true" {
+		return false
+	}
+	return svc.Spec.Type == v1.ServiceTypeLoadBalancer || svc.Spec.Type == v1.ServiceTypeNodePort
+}
+
+func serviceFields(key string) logrus.Fields {
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	return logrus.Fields{logging.FieldService: name, logging.FieldNamespace: namespace}
+}
+
+func hasFinalizer(meta metav1.ObjectMeta, finalizer string) bool {
+	for _, f := range meta.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(finalizers []string, finalizer string) []string {
+	var kept []string
+	for _, f := range finalizers {
+		if f != finalizer {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// managed returns true for the services which are exposed or still hold published records
+func (s *ServiceResource) managed(svc *v1.Service) bool {
+	return s.exposed(svc) || svc.Annotations[annotationHostname] != "" || hasFinalizer(svc.ObjectMeta, finalizerRecords)
+}
+
+// Hostnames returns the hostname assigned to each exposed service
+func (s *ServiceResource) Hostnames() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	hostnames := make(map[string]string, len(s.hostnames))
+	for key, h := range s.hostnames {
+		hostnames[key] = h
+	}
+	return hostnames
+}
+
+func (s *ServiceResource) getRdnsHostname(svc *v1.Service) (string, error) {
+	return renderHostname(setting.GetServiceHostnameTemplate(), svc.ObjectMeta, s.rdnsClient.RootFqdn())
+}
+
+func (s *ServiceResource) getServiceIps(svc *v1.Service) []string {
+	if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+		return loadBalancerIPs(svc.Status.LoadBalancer, s.resolver)
+	}
+	return s.getNodePortIps(svc)
+}
+
+// getNodePortIps returns the public ips of the nodes running ready endpoints of the service
+func (s *ServiceResource) getNodePortIps(svc *v1.Service) []string {
+	endpoints, err := s.kubeClient.CoreV1().Endpoints(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+	if err != nil {
+		log.WithFields(logrus.Fields{logging.FieldService: svc.Name, logging.FieldNamespace: svc.Namespace}).Errorf("Failed to get endpoints: %v", err)
+		return nil
+	}
+
+	nodes := make(map[string]bool)
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil && *addr.NodeName != "" {
+				nodes[*addr.NodeName] = true
+			}
+		}
+	}
+
+	var ips []string
+	for nodeName := range nodes {
+		node, err := s.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			log.WithError(err).Errorf("get node %s public ip error", nodeName)
+			continue
+		}
+		ips = append(ips, s.addresses.NodeAddresses(node, setting.GetIPFamily())...)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// process reconciles the service of key with its records, a service which is gone, being
+// deleted or no longer exposed loses them
+func (s *ServiceResource) process(key string) {
+	obj, exists, err := s.store.GetByKey(key)
+	if err != nil {
+		log.WithFields(serviceFields(key)).Errorf("Failed to get service: %v", err)
+		return
+	}
+	if !exists {
+		s.unsupported.forget(key)
+		s.forget(key, "")
+		return
+	}
+	svc := obj.(*v1.Service)
+	if svc.DeletionTimestamp != nil || !s.exposed(svc) {
+		s.release(svc)
+		return
+	}
+	s.sync(svc)
+}
+
+func (s *ServiceResource) sync(svc *v1.Service) {
+	key := serviceKey(svc)
+	fields := logrus.Fields{logging.FieldService: svc.Name, logging.FieldNamespace: svc.Namespace}
+	fqdn, err := s.getRdnsHostname(svc)
+	if err != nil {
+		log.WithFields(fields).Errorf("Failed to generate hostname: %v", err)
+		return
+	}
+
+	owner := ownerName("service", svc.Namespace, svc.Name)
+	if other := s.owners.Claim(fqdn, owner); other != "" {
+		s.markConflict(svc, fqdn, other)
+		return
+	}
+	if prev := s.hostname(svc); prev != "" && prev != fqdn {
+		// the template changed, the records of the previous hostname are not answered anymore
+		if !s.forget(key, prev) {
+			return
+		}
+	}
+
+	ips := s.getServiceIps(svc)
+	log.WithFields(fields).Debugf("Got service ip addresses: %s", ips)
+	if len(ips) == 0 {
+		if s.hostname(svc) == "" {
+			return
+		}
+		// the hostname stays claimed, only the records of the addresses which are gone are deleted
+		if err := s.rdnsClient.DeleteRecords(fqdn); err != nil {
+			log.WithFields(fields).Errorf("Failed to delete service records: %v", err)
+		}
+		return
+	}
+	// the service gets records of its own, the hosts of the domain belong to the ingresses
+	if err := s.rdnsClient.SetRecords(fqdn, ips, 0); err != nil {
+		ref := v1.ObjectReference{Kind: "Service", APIVersion: "v1", Name: svc.Name, Namespace: svc.Namespace, UID: svc.UID}
+		if !s.unsupported.notify(s.kubeClient, key, ref, err) {
+			log.WithFields(fields).Errorf("Failed to set service records: %v", err)
+		}
+		return
+	}
+
+	s.lock.Lock()
+	s.hostnames[key] = fqdn
+	s.lock.Unlock()
+
+	// the finalizer keeps the service until its records are deleted, even when it is deleted
+	// while the controller is down
+	s.update(svc, fmt.Sprintf("annotate hostname %s", fqdn), func(latest *v1.Service) bool {
+		if latest.Annotations[annotationHostname] == fqdn && latest.Annotations[annotationConflict] == "" && hasFinalizer(latest.ObjectMeta, finalizerRecords) {
+			return false
+		}
+		if latest.Annotations == nil {
+			latest.Annotations = make(map[string]string)
+		}
+		latest.Annotations[annotationHostname] = fqdn
+		delete(latest.Annotations, annotationConflict)
+		if !hasFinalizer(latest.ObjectMeta, finalizerRecords) {
+			latest.Finalizers = append(latest.Finalizers, finalizerRecords)
+		}
+		return true
+	})
+}
+
+// hostname returns the hostname the service published, the annotation keeps it across restarts
+func (s *ServiceResource) hostname(svc *v1.Service) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if fqdn, ok := s.hostnames[serviceKey(svc)]; ok {
+		return fqdn
+	}
+	return svc.Annotations[annotationHostname]
+}
+
+// markConflict annotates a service whose hostname is owned by another object and records an event
+func (s *ServiceResource) markConflict(svc *v1.Service, fqdn, owner string) {
+	log.WithFields(logrus.Fields{logging.FieldService: svc.Name, logging.FieldNamespace: svc.Namespace}).WithField(logging.FieldFqdn, fqdn).Errorf("Hostname is owned by %s", owner)
+	updated := s.update(svc, fmt.Sprintf("mark hostname %s owned by %s", fqdn, owner), func(latest *v1.Service) bool {
+		if latest.Annotations[annotationConflict] == owner {
+			return false
+		}
+		if latest.Annotations == nil {
+			latest.Annotations = make(map[string]string)
+		}
+		latest.Annotations[annotationConflict] = owner
+		return true
+	})
+	if updated != nil {
+		k8s.RecordEvent(s.kubeClient, v1.ObjectReference{
+			Kind:            "Service",
+			APIVersion:      "v1",
+			Name:            updated.Name,
+			Namespace:       updated.Namespace,
+			UID:             updated.UID,
+			ResourceVersion: updated.ResourceVersion,
+		}, v1.EventTypeWarning, "HostnameConflict", "Hostname %s is owned by %s", fqdn, owner)
+	}
+}
+
+// release deletes the records of a service which is no longer exposed or is being deleted,
+// then drops the annotations and the finalizer which kept them
+func (s *ServiceResource) release(svc *v1.Service) {
+	if !s.forget(serviceKey(svc), svc.Annotations[annotationHostname]) {
+		return
+	}
+	s.update(svc, "remove hostname", func(latest *v1.Service) bool {
+		if latest.Annotations[annotationHostname] == "" && latest.Annotations[annotationConflict] == "" && !hasFinalizer(latest.ObjectMeta, finalizerRecords) {
+			return false
+		}
+		delete(latest.Annotations, annotationHostname)
+		delete(latest.Annotations, annotationConflict)
+		latest.Finalizers = removeFinalizer(latest.Finalizers, finalizerRecords)
+		return true
+	})
+}
+
+// forget deletes the records the service of key published, persisted is the hostname of its
+// annotation when the controller did not publish them since it started. It returns false if the
+// records could not be deleted.
+func (s *ServiceResource) forget(key, persisted string) bool {
+	s.lock.Lock()
+	fqdn, ok := s.hostnames[key]
+	delete(s.hostnames, key)
+	s.lock.Unlock()
+	if !ok {
+		fqdn = persisted
+	}
+	if fqdn == "" {
+		return true
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	s.owners.Release(fqdn, ownerName("service", namespace, name))
+	if err := s.rdnsClient.DeleteRecords(fqdn); err != nil {
+		log.WithFields(serviceFields(key)).WithField(logging.FieldFqdn, fqdn).Errorf("Failed to delete service records: %v", err)
+		return false
+	}
+	return true
+}
+
+// update applies change to the latest version of the service, change returns false if the
+// service is already up to date. It returns the updated service, or nil if nothing was updated.
+func (s *ServiceResource) update(svc *v1.Service, message string, change func(*v1.Service) bool) *v1.Service {
+	var updated *v1.Service
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latestSvc, err := s.kubeClient.CoreV1().Services(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		latestSvc = latestSvc.DeepCopy()
+		if !change(latestSvc) {
+			return nil
+		}
+
+		if setting.IsDryRun() {
+			dryrun.Record(dryrun.Action{
+				Operation: "update service",
+				Target:    serviceKey(latestSvc),
+				Message:   message,
+			})
+			return nil
+		}
+
+		updated, err = s.kubeClient.CoreV1().Services(latestSvc.Namespace).Update(latestSvc)
+		return err
+	})
+
+	if retryErr != nil && !apierrors.IsNotFound(retryErr) {
+		log.WithFields(logrus.Fields{logging.FieldService: svc.Name, logging.FieldNamespace: svc.Namespace}).Errorf("Failed to update service: %v", retryErr)
+		return nil
+	}
+	return updated
+}
+
+// restore claims the hostname a service published before the controller started
+func (s *ServiceResource) restore(svc *v1.Service) {
+	fqdn := svc.Annotations[annotationHostname]
+	if fqdn == "" {
+		return
+	}
+	s.lock.Lock()
+	s.hostnames[serviceKey(svc)] = fqdn
+	s.lock.Unlock()
+	s.owners.Claim(fqdn, ownerName("service", svc.Namespace, svc.Name))
+}
+
+func (s *ServiceResource) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Errorf("Failed to get service key: %v", err)
+		return
+	}
+	s.queue.Add(key)
+}
+
+func (s *ServiceResource) WatchResources() {
+	defer close(s.stop)
+
+	watcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return s.kubeClient.CoreV1().Services(v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
+			return s.kubeClient.CoreV1().Services(v1.NamespaceAll).Watch(options)
+		},
+	}
+
+	store, wc := cache.NewInformer(watcher,
+		&v1.Service{},
+		setting.GetIngressResyncDuration(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				svc := obj.(*v1.Service)
+				s.restore(svc)
+				if s.managed(svc) {
+					log.WithFields(logrus.Fields{logging.FieldService: svc.Name, logging.FieldNamespace: svc.Namespace}).Info("Created service")
+					s.enqueue(svc)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				svc := newObj.(*v1.Service)
+				if s.managed(svc) {
+					log.WithFields(logrus.Fields{logging.FieldService: svc.Name, logging.FieldNamespace: svc.Namespace}).Info("Updated service")
+					s.enqueue(svc)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				// the final state of a service deleted while the watch was down is a tombstone
+				s.enqueue(obj)
+			},
+		})
+	s.store = store
+	go wc.Run(s.stop)
+
+	go func() {
+		if !cache.WaitForCacheSync(s.stop, wc.HasSynced) {
+			return
+		}
+		s.owners.restored()
+		if !s.owners.wait(s.stop) {
+			return
+		}
+		for {
+			item, quit := s.queue.Get()
+			if quit {
+				return
+			}
+			key := item.(string)
+			log.WithFields(serviceFields(key)).Debug("Begin processing service")
+			s.process(key)
+			log.WithFields(serviceFields(key)).Debug("Done processing service")
+			s.queue.Done(item)
+		}
+	}()
+
+	<-s.stop
+	s.queue.ShutDown()
+}
@@ -0,0 +1,245 @@
+package watch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// recordingProvider records the records set by name, the hosts of the domain must not be touched
+type recordingProvider struct {
+	rdns.Provider
+	records map[string][]string
+	ttls    map[string]uint32
+	applied int
+	sets    int
+}
+
+func newRecordingProvider() *recordingProvider {
+	return &recordingProvider{records: make(map[string][]string), ttls: make(map[string]uint32)}
+}
+
+func (p *recordingProvider) RootFqdn() string {
+	return rootFqdn
+}
+
+func (p *recordingProvider) ApplyDomain(candidates []selector.Host) error {
+	p.applied++
+	return nil
+}
+
+func (p *recordingProvider) SetRecords(name string, addresses []string, ttl uint32) error {
+	p.records[name] = addresses
+	p.ttls[name] = ttl
+	p.sets++
+	return nil
+}
+
+func (p *recordingProvider) DeleteRecords(name string) error {
+	delete(p.records, name)
+	return nil
+}
+
+// unsupportedProvider cannot publish records by name, like the rdns server
+type unsupportedProvider struct {
+	*recordingProvider
+}
+
+func (p unsupportedProvider) SetRecords(name string, addresses []string, ttl uint32) error {
+	return errors.Wrapf(rdns.ErrNotSupported, "SetRecords %s", name)
+}
+
+func (p unsupportedProvider) DeleteRecords(name string) error {
+	return errors.Wrapf(rdns.ErrNotSupported, "DeleteRecords %s", name)
+}
+
+// countEvents returns the number of events of the namespace with the reason
+func countEvents(t *testing.T, kube kubernetes.Interface, namespace, reason string) int {
+	events, err := kube.CoreV1().Events(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, e := range events.Items {
+		if e.Reason == reason {
+			count++
+		}
+	}
+	return count
+}
+
+func TestServiceSync(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", Annotations: map[string]string{annotationExpose: "true"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.1.1.1"}, {IP: "2.2.2.2"}}
+	kube := testutil.NewClientset(svc)
+
+	provider := newRecordingProvider()
+	s := NewServiceResource(kube, provider, &address.Resolver{}, NewHostnameOwners())
+	s.sync(svc)
+
+	fqdn := "db.svc.default." + rootFqdn
+	if got := provider.records[fqdn]; strings.Join(got, ",") != "1.1.1.1,2.2.2.2" {
+		t.Fatalf("records of %s = %v, want [1.1.1.1 2.2.2.2]", fqdn, got)
+	}
+	if provider.applied != 0 {
+		t.Fatalf("the hosts of the domain were replaced %d times by a service", provider.applied)
+	}
+	got, err := kube.CoreV1().Services("default").Get("db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Annotations[annotationHostname] != fqdn {
+		t.Fatalf("hostname annotation = %q, want %q", got.Annotations[annotationHostname], fqdn)
+	}
+	if !hasFinalizer(got.ObjectMeta, finalizerRecords) {
+		t.Fatalf("finalizers = %v, want %s", got.Finalizers, finalizerRecords)
+	}
+	if owner := s.owners.Owner(fqdn); owner != "service/default/db" {
+		t.Fatalf("owner of %s = %q, want service/default/db", fqdn, owner)
+	}
+
+	s.process(serviceKey(svc))
+	if _, ok := provider.records[fqdn]; ok {
+		t.Fatalf("the records of the deleted service %s are still published", fqdn)
+	}
+	if owner := s.owners.Owner(fqdn); owner != "" {
+		t.Fatalf("owner of %s = %q after the service was deleted, want none", fqdn, owner)
+	}
+}
+
+func TestServiceProcess(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	fqdn := "db.svc.default." + rootFqdn
+	now := metav1.Now()
+	tests := []struct {
+		name           string
+		exposed        bool
+		ips            []string
+		published      bool
+		deleting       bool
+		owner          string
+		wantRecords    bool
+		wantHostname   bool
+		wantFinalizer  bool
+		wantConflict   string
+		wantEventCount int
+	}{
+		{name: "exposed", exposed: true, ips: []string{"1.1.1.1"}, wantRecords: true, wantHostname: true, wantFinalizer: true},
+		{name: "no longer exposed", ips: []string{"1.1.1.1"}, published: true},
+		{name: "no addresses", exposed: true, published: true, wantHostname: true, wantFinalizer: true},
+		{name: "deleted while the controller was down", exposed: true, ips: []string{"1.1.1.1"}, published: true, deleting: true},
+		{name: "hostname owned by an ingress", exposed: true, ips: []string{"1.1.1.1"}, owner: "default/web", wantConflict: "default/web", wantEventCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", Annotations: map[string]string{}},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+			}
+			if tt.exposed {
+				svc.Annotations[annotationExpose] = "true"
+			}
+			for _, ip := range tt.ips {
+				svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+			}
+			provider := newRecordingProvider()
+			if tt.published {
+				// the records were published before the controller started, only the annotation knows them
+				svc.Annotations[annotationHostname] = fqdn
+				svc.Finalizers = []string{finalizerRecords}
+				provider.records[fqdn] = []string{"9.9.9.9"}
+			}
+			if tt.deleting {
+				svc.DeletionTimestamp = &now
+			}
+			kube := testutil.NewClientset(svc)
+			owners := NewHostnameOwners()
+			if tt.owner != "" {
+				owners.Claim(fqdn, tt.owner)
+			}
+			s := NewServiceResource(kube, provider, &address.Resolver{}, owners)
+			s.store.Add(svc)
+			s.restore(svc)
+
+			s.process(serviceKey(svc))
+
+			if _, ok := provider.records[fqdn]; ok != tt.wantRecords {
+				t.Fatalf("records of %s published = %t, want %t", fqdn, ok, tt.wantRecords)
+			}
+			got, err := kube.CoreV1().Services("default").Get("db", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got.Annotations[annotationHostname] != "") != tt.wantHostname {
+				t.Fatalf("hostname annotation = %q, want set %t", got.Annotations[annotationHostname], tt.wantHostname)
+			}
+			if hasFinalizer(got.ObjectMeta, finalizerRecords) != tt.wantFinalizer {
+				t.Fatalf("finalizers = %v, want %s %t", got.Finalizers, finalizerRecords, tt.wantFinalizer)
+			}
+			if got.Annotations[annotationConflict] != tt.wantConflict {
+				t.Fatalf("conflict annotation = %q, want %q", got.Annotations[annotationConflict], tt.wantConflict)
+			}
+			events, err := kube.CoreV1().Events("default").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events.Items) != tt.wantEventCount {
+				t.Fatalf("recorded %d events, want %d", len(events.Items), tt.wantEventCount)
+			}
+		})
+	}
+}
+
+func TestServiceTombstone(t *testing.T) {
+	s := NewServiceResource(nil, newRecordingProvider(), &address.Resolver{}, NewHostnameOwners())
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+	s.enqueue(cache.DeletedFinalStateUnknown{Key: serviceKey(svc), Obj: svc})
+	if item, _ := s.queue.Get(); item != "default/db" {
+		t.Fatalf("queued %v for a tombstone, want default/db", item)
+	}
+}
+
+func TestServiceUnsupported(t *testing.T) {
+	if err := testutil.InitSettings(nil); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", Annotations: map[string]string{annotationExpose: "true"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.1.1.1"}}
+	kube := testutil.NewClientset(svc)
+	s := NewServiceResource(kube, unsupportedProvider{newRecordingProvider()}, &address.Resolver{}, NewHostnameOwners())
+	s.store.Add(svc)
+
+	// the event is recorded once, the service is synced again on every resync
+	s.process(serviceKey(svc))
+	s.process(serviceKey(svc))
+	if got := countEvents(t, kube, "default", "RecordsNotSupported"); got != 1 {
+		t.Fatalf("recorded %d RecordsNotSupported events, want 1", got)
+	}
+	got, err := kube.CoreV1().Services("default").Get("db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Annotations[annotationHostname] != "" || len(got.Finalizers) != 0 {
+		t.Fatalf("service without records got the hostname %q and the finalizers %v", got.Annotations[annotationHostname], got.Finalizers)
+	}
+}
@@ -0,0 +1,57 @@
+package watch
+
+import (
+	"fmt"
+
+	"github.com/niusmallnan/kube-rdns/setting"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+)
+
+const (
+	annotationClusterIssuer = "cert-manager.io/cluster-issuer"
+	annotationIssuer        = "cert-manager.io/issuer"
+	issuerKindCluster       = "ClusterIssuer"
+	tlsSecretSuffix         = "-rdns-tls"
+)
+
+func tlsSecretName(ing *extensionsv1beta1.Ingress) string {
+	return fmt.Sprintf("%s%s", ing.Name, tlsSecretSuffix)
+}
+
+func hasHost(ing *extensionsv1beta1.Ingress, host string) bool {
+	for _, rule := range ing.Spec.Rules {
+		if rule.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureTLS adds a tls entry and the cert-manager issuer annotation for the generated
+// hostname, existing tls entries and issuer annotations are never touched
+func ensureTLS(ing *extensionsv1beta1.Ingress, fqdn string) bool {
+	if !setting.IsAutoTLS() || !hasHost(ing, fqdn) {
+		return false
+	}
+	for _, tls := range ing.Spec.TLS {
+		for _, host := range tls.Hosts {
+			if host == fqdn {
+				return false
+			}
+		}
+	}
+
+	ing.Spec.TLS = append(ing.Spec.TLS, extensionsv1beta1.IngressTLS{
+		Hosts:      []string{fqdn},
+		SecretName: tlsSecretName(ing),
+	})
+
+	if ing.Annotations[annotationClusterIssuer] == "" && ing.Annotations[annotationIssuer] == "" && setting.GetTLSIssuer() != "" {
+		if setting.GetTLSIssuerKind() == issuerKindCluster {
+			ing.Annotations[annotationClusterIssuer] = setting.GetTLSIssuer()
+		} else {
+			ing.Annotations[annotationIssuer] = setting.GetTLSIssuer()
+		}
+	}
+	return true
+}
@@ -1,20 +1,72 @@
 package watch
 
 import (
+	"sync"
+
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
 	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/resolver"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 )
 
+var log = logging.For("watch")
+
 const (
 	annotationHostname     = "rdns.cattle.io/hostname"
+	annotationTemplate     = "rdns.cattle.io/hostname-template"
+	annotationConflict     = "rdns.cattle.io/hostname-conflict"
+	annotationExpose       = "rdns.cattle.io/expose"
+	finalizerRecords       = "rdns.cattle.io/records"
 	annotationIngressClass = "kubernetes.io/ingress.class"
 	ingressClassNginx      = "nginx"
 )
 
+// PublishFunc publishes load balancer addresses on the domain. The watchers never write the
+// domain hosts themselves, the controller filters the addresses the same way as the nginx
+// controller hosts before they reach the provider.
+type PublishFunc func(addresses []string) error
+
 type IngressResource struct {
-	rdnsClient *rdns.Client
-	kubeClient *kubernetes.Clientset
+	rdnsClient rdns.Provider
+	kubeClient kubernetes.Interface
+	publish    PublishFunc
+	queue      *workqueue.Type
+	stop       chan struct{}
+	resolver   resolver.Resolver
+	store      cache.Store
+	selector   labels.Selector
+	excluded   []labels.Selector
+
+	lock        sync.RWMutex
+	pending     map[string]bool
+	hostnames   map[string]string
+	owners      *HostnameOwners
+	lbHostnames map[string]*extensionsv1beta1.Ingress
+}
+
+type ServiceResource struct {
+	rdnsClient rdns.Provider
+	kubeClient kubernetes.Interface
+	addresses  *address.Resolver
 	queue      *workqueue.Type
 	stop       chan struct{}
+	resolver   resolver.Resolver
+	store      cache.Store
+	owners     *HostnameOwners
+
+	unsupported unsupported
+
+	lock      sync.RWMutex
+	hostnames map[string]string
+}
+
+// IngressState is the workqueue contents and the hostname assigned to each ingress
+type IngressState struct {
+	Queue     []string          `json:"queue"`
+	Hostnames map[string]string `json:"hostnames"`
 }
@@ -0,0 +1,64 @@
+package watch
+
+import (
+	"sync"
+
+	"github.com/niusmallnan/kube-rdns/controller/k8s"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/setting"
+	"github.com/pkg/errors"
+	k8scorev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// unsupportedMessage is reported on the objects whose records the provider cannot publish, the
+// rdns server only publishes the hosts of a domain and its wildcard
+const unsupportedMessage = "provider cannot publish records, use the rfc2136 or responder provider"
+
+func isUnsupported(err error) bool {
+	return errors.Cause(err) == rdns.ErrNotSupported
+}
+
+// statusError returns the message of err for the status of an object
+func statusError(err error) string {
+	if isUnsupported(err) {
+		return unsupportedMessage
+	}
+	return err.Error()
+}
+
+// unsupported records a warning event once per object whose records the provider cannot publish,
+// the objects are synced on every resync and the event would be repeated
+type unsupported struct {
+	lock     sync.Mutex
+	notified map[string]bool
+}
+
+// notify records the event unless the object of key was already notified, it returns false if
+// err is not an unsupported operation of the provider
+func (u *unsupported) notify(client kubernetes.Interface, key string, ref k8scorev1.ObjectReference, err error) bool {
+	if !isUnsupported(err) {
+		return false
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.notified[key] {
+		return true
+	}
+	if u.notified == nil {
+		u.notified = make(map[string]bool)
+	}
+	u.notified[key] = true
+	log.Warnf("Records of %s %s are not published: %s", ref.Kind, key, unsupportedMessage)
+	if !setting.IsDryRun() {
+		k8s.RecordEvent(client, ref, k8scorev1.EventTypeWarning, "RecordsNotSupported", "The %s", unsupportedMessage)
+	}
+	return true
+}
+
+// forget drops a deleted object, it is notified again if it is created again
+func (u *unsupported) forget(key string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.notified, key)
+}
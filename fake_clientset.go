@@ -0,0 +1,17 @@
+//go:build fake
+// +build fake
+
+package main
+
+import (
+	"github.com/niusmallnan/kube-rdns/controller/testutil"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the fake clientset is only built with the fake tag, so that the test helpers are not linked
+// into the release binary
+func init() {
+	fakeClientset = func() kubernetes.Interface {
+		return testutil.NewClientset()
+	}
+}
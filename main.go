@@ -1,13 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/niusmallnan/kube-rdns/controller"
+	"github.com/niusmallnan/kube-rdns/controller/acme"
+	"github.com/niusmallnan/kube-rdns/controller/address"
+	"github.com/niusmallnan/kube-rdns/controller/dryrun"
+	"github.com/niusmallnan/kube-rdns/controller/hostname"
+	"github.com/niusmallnan/kube-rdns/controller/logging"
+	"github.com/niusmallnan/kube-rdns/controller/metrics"
+	"github.com/niusmallnan/kube-rdns/controller/prober"
+	"github.com/niusmallnan/kube-rdns/controller/rdns"
+	"github.com/niusmallnan/kube-rdns/controller/rdns/fake"
+	"github.com/niusmallnan/kube-rdns/controller/selector"
 	"github.com/niusmallnan/kube-rdns/setting"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -19,6 +33,10 @@ import (
 
 var VERSION = "v0.0.0-dev"
 
+// fakeClientset returns the clientset of --fake-apiserver, it is nil unless the binary is built
+// with the fake tag
+var fakeClientset func() kubernetes.Interface
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "kube-rdns"
@@ -29,6 +47,12 @@ func main() {
 			Name:   "debug, d",
 			EnvVar: "RANCHER_DEBUG",
 		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  logging.FormatText,
+			Usage:  "Format of the logs, text or json",
+			EnvVar: "RANCHER_LOG_FORMAT",
+		},
 		cli.StringFlag{
 			Name:   "listen",
 			Value:  ":9595",
@@ -41,9 +65,149 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "base-rdns-url",
+			Usage:  "Comma separated rdns server endpoints, in priority order",
 			Value:  setting.DefaultBaseRdnsURL,
 			EnvVar: "RANCHER_BASE_RDNS_URL",
 		},
+		cli.BoolFlag{
+			Name:   "fake-rdns",
+			Usage:  "Run against an in-process fake rdns server instead of base-rdns-url",
+			EnvVar: "RANCHER_FAKE_RDNS",
+		},
+		cli.StringFlag{
+			Name:   "fake-rdns-listen",
+			Usage:  "Address the fake rdns server listens on, a random loopback port by default",
+			EnvVar: "RANCHER_FAKE_RDNS_LISTEN",
+		},
+		cli.BoolFlag{
+			Name:   "fake-apiserver",
+			Usage:  "Run against a fake clientset instead of the cluster, with --fake-rdns the controller runs end to end without any external service. Only available in a binary built with -tags fake",
+			EnvVar: "RANCHER_FAKE_APISERVER",
+		},
+		cli.StringFlag{
+			Name:   "apiserver-host",
+			Usage:  "Address of an insecure apiserver, e.g. kubectl proxy, instead of the in-cluster config",
+			EnvVar: "RANCHER_APISERVER_HOST",
+		},
+		cli.StringFlag{
+			Name:   "rdns-ca-file",
+			Usage:  "CA bundle used to verify the rdns server certificate, the system roots by default",
+			EnvVar: "RANCHER_RDNS_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:   "rdns-cert-file",
+			Usage:  "Client certificate presented to the rdns server, requires rdns-key-file",
+			EnvVar: "RANCHER_RDNS_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "rdns-key-file",
+			Usage:  "Private key of the client certificate presented to the rdns server",
+			EnvVar: "RANCHER_RDNS_KEY_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "rdns-insecure-skip-verify",
+			Usage:  "Skip verifying the rdns server certificate, for testing only",
+			EnvVar: "RANCHER_RDNS_INSECURE_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "rdns-proxy",
+			Usage:  "Proxy url for the rdns server requests, the HTTPS_PROXY environment is used by default",
+			EnvVar: "RANCHER_RDNS_PROXY",
+		},
+		cli.DurationFlag{
+			Name:   "rdns-timeout",
+			Usage:  "Timeout of a request to the rdns server",
+			Value:  setting.DefaultRdnsTimeout,
+			EnvVar: "RANCHER_RDNS_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "allow-insecure-token",
+			Usage:  "Allow sending the domain token to rdns servers over plain http",
+			EnvVar: "RANCHER_ALLOW_INSECURE_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "backend-policy",
+			Usage:  "How the rdns server endpoints are tried when creating a domain: priority or round-robin",
+			Value:  setting.DefaultBackendPolicy,
+			EnvVar: "RANCHER_BACKEND_POLICY",
+		},
+		cli.DurationFlag{
+			Name:   "backend-retry-interval",
+			Usage:  "How long a failing rdns server endpoint is skipped before it is tried again",
+			Value:  setting.DefaultBackendRetryInterval,
+			EnvVar: "RANCHER_BACKEND_RETRY_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "provider",
+			Usage:  "Dns provider which publishes the domain: rdns, rfc2136 or responder, services, gateway routes and rdnsrecords are only published by rfc2136 and responder, with rdns they get a warning event or an error in their status",
+			Value:  setting.DefaultProvider,
+			EnvVar: "RANCHER_PROVIDER",
+		},
+		cli.StringFlag{
+			Name:   "rfc2136-server",
+			Usage:  "Address of the authoritative server accepting dynamic updates, as host:port",
+			EnvVar: "RANCHER_RFC2136_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "rfc2136-zone",
+			Usage:  "Zone which is updated, the domain fqdn must be within it",
+			EnvVar: "RANCHER_RFC2136_ZONE",
+		},
+		cli.StringFlag{
+			Name:   "rfc2136-tsig-key",
+			Usage:  "Name of the TSIG key used to sign the updates, the responses of the server must be signed with it too",
+			EnvVar: "RANCHER_RFC2136_TSIG_KEY",
+		},
+		cli.StringFlag{
+			Name:   "rfc2136-tsig-secret",
+			Usage:  "Base64 encoded secret of the TSIG key",
+			EnvVar: "RANCHER_RFC2136_TSIG_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "rfc2136-tsig-algorithm",
+			Usage:  "TSIG algorithm: hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512",
+			Value:  setting.DefaultRFC2136TSIGAlgorithm,
+			EnvVar: "RANCHER_RFC2136_TSIG_ALGORITHM",
+		},
+		cli.IntFlag{
+			Name:   "rfc2136-ttl",
+			Usage:  "Ttl of the records published with dynamic updates",
+			Value:  setting.DefaultRFC2136TTL,
+			EnvVar: "RANCHER_RFC2136_TTL",
+		},
+		cli.DurationFlag{
+			Name:   "rfc2136-timeout",
+			Usage:  "Timeout of a dynamic update exchange",
+			Value:  setting.DefaultRFC2136Timeout,
+			EnvVar: "RANCHER_RFC2136_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "dns-listen",
+			Usage:  "Address the built-in dns responder listens on with udp and tcp",
+			Value:  setting.DefaultDNSListen,
+			EnvVar: "RANCHER_DNS_LISTEN",
+		},
+		cli.IntFlag{
+			Name:   "dns-ttl",
+			Usage:  "Ttl of the records answered by the built-in dns responder",
+			Value:  setting.DefaultDNSTTL,
+			EnvVar: "RANCHER_DNS_TTL",
+		},
+		cli.StringFlag{
+			Name:   "dns-nameservers",
+			Usage:  "Comma separated NS names of the responder zones, ns.<fqdn> by default",
+			EnvVar: "RANCHER_DNS_NAMESERVERS",
+		},
+		cli.StringFlag{
+			Name:   "dns-nameserver-ips",
+			Usage:  "Comma separated glue addresses answered for the NS names within a zone, required unless every NS name is outside the zones",
+			EnvVar: "RANCHER_DNS_NAMESERVER_IPS",
+		},
+		cli.StringFlag{
+			Name:   "dns-soa-mbox",
+			Usage:  "Mailbox of the SOA records, hostmaster.<fqdn> by default",
+			EnvVar: "RANCHER_DNS_SOA_MBOX",
+		},
 		cli.DurationFlag{
 			Name:   "renew-duration",
 			Value:  setting.DefaultRnewDuration,
@@ -54,7 +218,249 @@ func main() {
 			Value:  setting.DefaultIngressResyncDuration,
 			EnvVar: "RANCHER_INGRESS_RESYNC_DURATION",
 		},
+		cli.StringFlag{
+			Name:   "domains-config",
+			Usage:  "Yaml file listing named domains, each with its own secret, node selector and ingress selector",
+			EnvVar: "RANCHER_DOMAINS_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "desired-fqdn",
+			Usage:  "Request a specific fqdn when the domain is created",
+			EnvVar: "RANCHER_DESIRED_FQDN",
+		},
+		cli.StringFlag{
+			Name:   "fqdn-prefix",
+			Usage:  "Request <prefix>.<root-domain> when the domain is created",
+			EnvVar: "RANCHER_FQDN_PREFIX",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Log the changes that would be made without calling the rdns server or updating ingresses",
+			EnvVar: "RANCHER_DRY_RUN",
+		},
+		cli.BoolFlag{
+			Name:   "enable-pprof",
+			Usage:  "Expose the pprof handlers under /debug/pprof",
+			EnvVar: "RANCHER_ENABLE_PPROF",
+		},
+		cli.BoolFlag{
+			Name:   "enable-loglevel-handler",
+			Usage:  "Expose /loglevel, which changes the log levels of the components without authentication",
+			EnvVar: "RANCHER_ENABLE_LOGLEVEL_HANDLER",
+		},
+		cli.IntFlag{
+			Name:   "max-hosts",
+			Value:  setting.DefaultMaxHosts,
+			Usage:  "Maximum number of hosts published for the domain",
+			EnvVar: "RANCHER_MAX_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "host-policy",
+			Value:  setting.DefaultHostPolicy,
+			Usage:  fmt.Sprintf("Policy to pick the published hosts, one of %s", strings.Join(selector.Policies, ", ")),
+			EnvVar: "RANCHER_HOST_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "ip-family",
+			Value:  setting.DefaultIPFamily,
+			Usage:  "Address family of the published hosts, one of ipv4, ipv6, dual",
+			EnvVar: "RANCHER_IP_FAMILY",
+		},
+		cli.StringFlag{
+			Name:   "node-address-sources",
+			Value:  address.DefaultSources,
+			Usage:  "Ordered, comma separated node address sources, each one of type:<address type>, annotation:<key> or label:<key>, the first address found is published",
+			EnvVar: "RANCHER_NODE_ADDRESS_SOURCES",
+		},
+		cli.BoolFlag{
+			Name:   "exclude-private-addresses",
+			Usage:  "Never publish RFC1918 or unique local ipv6 addresses",
+			EnvVar: "RANCHER_EXCLUDE_PRIVATE_ADDRESSES",
+		},
+		cli.DurationFlag{
+			Name:   "lb-hostname-refresh",
+			Value:  setting.DefaultLBHostnameRefresh,
+			Usage:  "How often the ips behind hostname-only ingress load balancers are resolved again",
+			EnvVar: "RANCHER_LB_HOSTNAME_REFRESH",
+		},
+		cli.DurationFlag{
+			Name:   "gateway-poll-interval",
+			Value:  setting.DefaultGatewayPollInterval,
+			Usage:  "How often the Gateway API CRDs are looked up until they are installed, the routes are watched afterwards",
+			EnvVar: "RANCHER_GATEWAY_POLL_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "record-poll-interval",
+			Value:  setting.DefaultRecordPollInterval,
+			Usage:  "How often RDNSRecord resources are reconciled when the CRD is installed",
+			EnvVar: "RANCHER_RECORD_POLL_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "probe-mode",
+			Usage:  "Probe the published hosts with tcp or http before advertising them, disabled if empty",
+			EnvVar: "RANCHER_PROBE_MODE",
+		},
+		cli.IntFlag{
+			Name:   "probe-port",
+			Value:  setting.DefaultProbePort,
+			EnvVar: "RANCHER_PROBE_PORT",
+		},
+		cli.StringFlag{
+			Name:   "probe-path",
+			Value:  setting.DefaultProbePath,
+			Usage:  "Path requested by the http probe",
+			EnvVar: "RANCHER_PROBE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "probe-host-header",
+			Usage:  "Host header sent by the http probe",
+			EnvVar: "RANCHER_PROBE_HOST_HEADER",
+		},
+		cli.DurationFlag{
+			Name:   "probe-interval",
+			Value:  setting.DefaultProbeInterval,
+			EnvVar: "RANCHER_PROBE_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "probe-timeout",
+			Value:  setting.DefaultProbeTimeout,
+			EnvVar: "RANCHER_PROBE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "probe-failure-threshold",
+			Value:  setting.DefaultProbeFailureThreshold,
+			Usage:  "Consecutive failed probes before a host is withheld",
+			EnvVar: "RANCHER_PROBE_FAILURE_THRESHOLD",
+		},
+		cli.BoolFlag{
+			Name:   "enable-acme-webhook",
+			Usage:  "Serve a cert-manager DNS-01 webhook solver for the primary domain. Only the rfc2136 and responder providers can publish its txt records, it is rejected with the default rdns provider",
+			EnvVar: "RANCHER_ENABLE_ACME_WEBHOOK",
+		},
+		cli.StringFlag{
+			Name:   "acme-webhook-listen",
+			Value:  setting.DefaultACMEWebhookListen,
+			Usage:  "Address the acme webhook is served on over tls",
+			EnvVar: "RANCHER_ACME_WEBHOOK_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "acme-webhook-cert-file",
+			Usage:  "Serving certificate of the acme webhook",
+			EnvVar: "RANCHER_ACME_WEBHOOK_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "acme-webhook-key-file",
+			Usage:  "Serving key of the acme webhook",
+			EnvVar: "RANCHER_ACME_WEBHOOK_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "acme-webhook-client-ca-file",
+			Usage:  "CA of the client certificate the kube-apiserver proxies the APIService requests with, its requestheader-client-ca-file",
+			EnvVar: "RANCHER_ACME_WEBHOOK_CLIENT_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:   "acme-webhook-group-name",
+			Value:  setting.DefaultACMEWebhookGroupName,
+			Usage:  "API group of the APIService, the groupName of the issuer webhook solver",
+			EnvVar: "RANCHER_ACME_WEBHOOK_GROUP_NAME",
+		},
+		cli.StringFlag{
+			Name:   "hostname-template",
+			Value:  hostname.DefaultTemplate,
+			Usage:  "Go template for the ingress hostname under the root fqdn, with .Name, .Namespace and .Hash. An object can override it with the rdns.cattle.io/hostname-template annotation, which has to render a name ending with its namespace",
+			EnvVar: "RANCHER_HOSTNAME_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "service-hostname-template",
+			Value:  hostname.DefaultServiceTemplate,
+			Usage:  "Go template for the hostname of an exposed service, it differs from the ingress template so that a service and an ingress of the same name do not collide",
+			EnvVar: "RANCHER_SERVICE_HOSTNAME_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "route-hostname-template",
+			Value:  hostname.DefaultRouteTemplate,
+			Usage:  "Go template for the hostname of a Gateway API HTTPRoute, it differs from the ingress and service templates so that objects of the same name do not collide",
+			EnvVar: "RANCHER_ROUTE_HOSTNAME_TEMPLATE",
+		},
+		cli.BoolFlag{
+			Name:   "auto-tls",
+			Usage:  "Add a tls entry for the generated hostname of every ingress",
+			EnvVar: "RANCHER_AUTO_TLS",
+		},
+		cli.StringFlag{
+			Name:   "tls-issuer",
+			Usage:  "cert-manager issuer annotated on ingresses when auto-tls adds a tls entry",
+			EnvVar: "RANCHER_TLS_ISSUER",
+		},
+		cli.StringFlag{
+			Name:   "tls-issuer-kind",
+			Value:  setting.DefaultTLSIssuerKind,
+			Usage:  "Kind of the tls issuer, ClusterIssuer or Issuer",
+			EnvVar: "RANCHER_TLS_ISSUER_KIND",
+		},
+	}
+	app.Before = func(ctx *cli.Context) error {
+		if err := logging.SetFormat(ctx.GlobalString("log-format")); err != nil {
+			return err
+		}
+		if ctx.GlobalBool("debug") {
+			logging.SetLevel(logrus.DebugLevel)
+		}
+		setting.Init(ctx)
+		if setting.IsFakeRdns() {
+			url, err := fake.NewServer().Start(setting.GetFakeRdnsListen())
+			if err != nil {
+				return errors.Wrap(err, "Failed to start the fake rdns server")
+			}
+			logrus.Warnf("Using the fake rdns server on %s, the domains are not published", url)
+			setting.SetBaseRdnsURL(url)
+			setting.SetAllowInsecureToken(true)
+		}
+		if setting.IsFakeApiserver() && setting.GetApiserverHost() != "" {
+			return errors.New("--fake-apiserver and --apiserver-host are mutually exclusive")
+		}
+		if setting.IsFakeApiserver() && fakeClientset == nil {
+			return errors.New("--fake-apiserver requires a binary built with -tags fake")
+		}
+		if err := setting.LoadDomains(); err != nil {
+			return err
+		}
+		for _, tmpl := range []string{setting.GetHostnameTemplate(), setting.GetServiceHostnameTemplate(), setting.GetRouteHostnameTemplate()} {
+			if err := hostname.Validate(tmpl); err != nil {
+				return err
+			}
+		}
+		for _, d := range setting.GetDomains() {
+			if _, err := address.ParseSources(d.GetAddressSources()); err != nil {
+				return errors.Wrapf(err, "domain %s", d.Name)
+			}
+			if err := controller.ValidateProvider(d); err != nil {
+				return errors.Wrapf(err, "domain %s", d.Name)
+			}
+		}
+		if setting.IsACMEWebhookEnabled() {
+			if err := acme.Validate(acme.ConfigFromSettings()); err != nil {
+				return err
+			}
+			if d := setting.GetDomains()[0]; !controller.SupportsRecords(d) {
+				return errors.Errorf("the acme webhook requires the %s or %s provider, the rdns server of domain %s cannot publish txt records", controller.ProviderRFC2136, controller.ProviderResponder, d.Name)
+			}
+		}
+		if err := selector.ValidateFamily(setting.GetIPFamily()); err != nil {
+			return err
+		}
+		if err := prober.Validate(prober.ConfigFromSettings()); err != nil {
+			return err
+		}
+		if err := rdns.ValidateBackends(setting.GetBaseRdnsURLs(), setting.GetBackendPolicy()); err != nil {
+			return err
+		}
+		if err := rdns.ValidateTransport(setting.GetBaseRdnsURLs()); err != nil {
+			return err
+		}
+		return selector.ValidatePolicy(setting.GetHostPolicy())
 	}
+	app.Commands = commands()
 	app.Action = func(ctx *cli.Context) {
 		if err := appMain(ctx); err != nil {
 			logrus.Errorf("Exiting kube-rdns with error: %v", err)
@@ -65,12 +471,6 @@ func main() {
 }
 
 func appMain(ctx *cli.Context) error {
-	if ctx.Bool("debug") {
-		logrus.SetLevel(logrus.DebugLevel)
-	}
-
-	setting.Init(ctx)
-
 	kubeClient, err := createApiserverClient()
 	if err != nil {
 		handleFatalInitError(err)
@@ -80,6 +480,10 @@ func appMain(ctx *cli.Context) error {
 	mux := http.NewServeMux()
 	go registerHandlers(ctx.String("listen"), c, mux)
 
+	if setting.IsACMEWebhookEnabled() {
+		go serveACMEWebhook(c)
+	}
+
 	go handleSigterm(c, func(code int) {
 		os.Exit(code)
 	})
@@ -89,7 +493,14 @@ func appMain(ctx *cli.Context) error {
 	return nil
 }
 
-func createApiserverClient() (*kubernetes.Clientset, error) {
+func createApiserverClient() (kubernetes.Interface, error) {
+	if setting.IsFakeApiserver() {
+		logrus.Warn("Using a fake clientset, the cluster is not watched")
+		return fakeClientset(), nil
+	}
+	if host := setting.GetApiserverHost(); host != "" {
+		return kubernetes.NewForConfig(&rest.Config{Host: host})
+	}
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -101,6 +512,13 @@ func createApiserverClient() (*kubernetes.Clientset, error) {
 	return clientset, err
 }
 
+// serveACMEWebhook serves the solver on its own listener, only the kube-apiserver is allowed
+// to call it
+func serveACMEWebhook(rc *controller.RDNSController) {
+	cfg := acme.ConfigFromSettings()
+	logrus.Fatal(acme.NewWebhook(rc.RDNSClient(), cfg.GroupName).ListenAndServe(cfg))
+}
+
 func handleFatalInitError(err error) {
 	logrus.Fatalf("Error while initializing connection to Kubernetes apiserver. "+
 		"This most likely means that the cluster is misconfigured (e.g., it has "+
@@ -132,12 +550,34 @@ func handleSigterm(rdnsc *controller.RDNSController, exit exiter) {
 
 func registerHandlers(listen string, rc *controller.RDNSController, mux *http.ServeMux) {
 	// expose health check endpoint (/healthz)
-	healthz.InstallHandler(mux,
-		healthz.PingHealthz,
-		rc,
-	)
+	checks := append([]healthz.HealthzChecker{healthz.PingHealthz, rc}, rc.HealthChecks()...)
+	healthz.InstallHandler(mux, checks...)
 
-	// TODO: enable pprof
+	if setting.IsDryRun() {
+		mux.Handle("/dryrun", dryrun.Handler())
+	}
+
+	mux.Handle("/metrics", metrics.Handler())
+
+	// levels of the components are changed with PUT /loglevel?component=rdns&level=debug
+	if setting.IsLogLevelHandlerEnabled() {
+		mux.Handle("/loglevel", logging.Handler())
+	}
+
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rc.State()); err != nil {
+			logrus.Errorf("Failed to encode state: %v", err)
+		}
+	})
+
+	if setting.IsPprofEnabled() {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
 
 	server := &http.Server{
 		Addr:              listen,
@@ -0,0 +1,130 @@
+package setting
+
+import (
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultDomainName   = "default"
+	DefaultDomainSecret = "rdns-token"
+)
+
+// DomainConfig is one named rdns domain with its own credentials and sources
+type DomainConfig struct {
+	Name string `json:"name"`
+	// Secret in kube-system which holds the token and fqdn of the domain
+	Secret      string `json:"secret"`
+	DesiredFqdn string `json:"desiredFqdn,omitempty"`
+	// NodeSelector picks the nginx controller nodes whose addresses are published
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// IngressSelector picks the ingresses which get hostnames on the domain, a domain without
+	// one gets the ingresses no other domain selects
+	IngressSelector map[string]string `json:"ingressSelector,omitempty"`
+	// AddressSources overrides --node-address-sources for the domain
+	AddressSources string `json:"addressSources,omitempty"`
+	// Provider overrides --provider for the domain
+	Provider string `json:"provider,omitempty"`
+}
+
+// GetProvider returns the dns provider which publishes the domain
+func (d DomainConfig) GetProvider() string {
+	if d.Provider != "" {
+		return d.Provider
+	}
+	return GetProvider()
+}
+
+// GetAddressSources returns the node address sources of the domain
+func (d DomainConfig) GetAddressSources() string {
+	if d.AddressSources != "" {
+		return d.AddressSources
+	}
+	return GetNodeAddressSources()
+}
+
+type domainsFile struct {
+	Domains []DomainConfig `json:"domains"`
+}
+
+var domains []DomainConfig
+
+// selectorsOverlap reports whether an ingress can have the labels of both selectors
+func selectorsOverlap(a, b map[string]string) bool {
+	for key, value := range a {
+		if other, ok := b[key]; ok && other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadDomains reads the domains config file, without one a single default domain is used.
+// The ingress selectors of the domains must not overlap, so every ingress belongs to one domain.
+func LoadDomains() error {
+	if domainsConfig == "" {
+		domains = []DomainConfig{{
+			Name:        DefaultDomainName,
+			Secret:      DefaultDomainSecret,
+			DesiredFqdn: GetDesiredFqdn(),
+		}}
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(domainsConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to read domains config")
+	}
+	var f domainsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return errors.Wrap(err, "failed to parse domains config")
+	}
+	if len(f.Domains) == 0 {
+		return errors.Errorf("domains config %s has no domains", domainsConfig)
+	}
+
+	names := map[string]bool{}
+	secrets := map[string]bool{}
+	for _, d := range f.Domains {
+		if d.Name == "" || d.Secret == "" {
+			return errors.New("every domain requires a name and a secret")
+		}
+		if names[d.Name] || secrets[d.Secret] {
+			return errors.Errorf("domain %s reuses a name or secret", d.Name)
+		}
+		names[d.Name] = true
+		secrets[d.Secret] = true
+	}
+	for i, d := range f.Domains {
+		for _, other := range f.Domains[:i] {
+			if len(d.IngressSelector) == 0 && len(other.IngressSelector) == 0 {
+				return errors.Errorf("domains %s and %s have no ingress selector, only one domain may get the unselected ingresses", other.Name, d.Name)
+			}
+			if len(d.IngressSelector) > 0 && len(other.IngressSelector) > 0 && selectorsOverlap(d.IngressSelector, other.IngressSelector) {
+				return errors.Errorf("the ingress selectors of domains %s and %s overlap", other.Name, d.Name)
+			}
+		}
+	}
+	domains = f.Domains
+	return nil
+}
+
+// GetDomains returns the configured domains, the first one is the primary domain
+func GetDomains() []DomainConfig {
+	return domains
+}
+
+// GetDomain returns the named domain, or the primary domain if name is empty
+func GetDomain(name string) (DomainConfig, error) {
+	if name == "" && len(domains) > 0 {
+		return domains[0], nil
+	}
+	for _, d := range domains {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return DomainConfig{}, errors.Errorf("domain %q is not configured", name)
+}
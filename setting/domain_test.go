@@ -0,0 +1,71 @@
+package setting
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "one domain without a selector",
+			config: `domains:
+- {name: public, secret: a}
+- {name: internal, secret: b, ingressSelector: {domain: internal}}
+- {name: lab, secret: c, ingressSelector: {domain: lab, team: x}}`,
+		},
+		{
+			name: "two domains without a selector",
+			config: `domains:
+- {name: public, secret: a}
+- {name: internal, secret: b}`,
+			wantErr: "no ingress selector",
+		},
+		{
+			name: "overlapping selectors",
+			config: `domains:
+- {name: internal, secret: a, ingressSelector: {domain: internal}}
+- {name: team, secret: b, ingressSelector: {team: x}}`,
+			wantErr: "overlap",
+		},
+		{
+			name: "same selector",
+			config: `domains:
+- {name: internal, secret: a, ingressSelector: {domain: internal}}
+- {name: lab, secret: b, ingressSelector: {domain: internal, team: x}}`,
+			wantErr: "overlap",
+		},
+		{
+			name: "reused secret",
+			config: `domains:
+- {name: public, secret: a}
+- {name: internal, secret: a, ingressSelector: {domain: internal}}`,
+			wantErr: "reuses",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domainsConfig = filepath.Join(t.TempDir(), "domains.yaml")
+			defer func() { domainsConfig = "" }()
+			if err := ioutil.WriteFile(domainsConfig, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := LoadDomains()
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("LoadDomains() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	domainsConfig = filepath.Join("..", "deploy", "domains-example.yaml")
+	defer func() { domainsConfig = "" }()
+	if err := LoadDomains(); err != nil {
+		t.Fatalf("LoadDomains() of the example = %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package setting
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli"
@@ -8,9 +10,32 @@ import (
 
 const (
 	DefaultRootDomain            = "lb.rancher.cloud"
-	DefaultBaseRdnsURL           = "http://api.rdns.rancher.cloud/v1"
+	DefaultBaseRdnsURL           = "https://api.rdns.rancher.cloud/v1"
 	DefaultRnewDuration          = 24 * time.Hour
 	DefaultIngressResyncDuration = 5 * time.Minute
+	DefaultMaxHosts              = 10
+	DefaultHostPolicy            = "ordered"
+	DefaultIPFamily              = "ipv4"
+	DefaultLBHostnameRefresh     = 5 * time.Minute
+	DefaultGatewayPollInterval   = time.Minute
+	DefaultRecordPollInterval    = time.Minute
+	DefaultTLSIssuerKind         = "ClusterIssuer"
+	DefaultProbePort             = 80
+	DefaultProbePath             = "/healthz"
+	DefaultProbeInterval         = 30 * time.Second
+	DefaultProbeTimeout          = 2 * time.Second
+	DefaultProbeFailureThreshold = 3
+	DefaultBackendPolicy         = "priority"
+	DefaultBackendRetryInterval  = time.Minute
+	DefaultProvider              = "rdns"
+	DefaultRFC2136TSIGAlgorithm  = "hmac-sha256"
+	DefaultRFC2136TTL            = 60
+	DefaultRFC2136Timeout        = 5 * time.Second
+	DefaultDNSListen             = ":53"
+	DefaultDNSTTL                = 60
+	DefaultRdnsTimeout           = 5 * time.Second
+	DefaultACMEWebhookListen     = ":8443"
+	DefaultACMEWebhookGroupName  = "acme.rdns.cattle.io"
 )
 
 var (
@@ -18,21 +43,193 @@ var (
 	baseRdnsURL           string
 	renewDuration         time.Duration
 	ingressResyncDuration time.Duration
+	desiredFqdn           string
+	fqdnPrefix            string
+	dryRun                bool
+	enablePprof           bool
+	enableLogLevel        bool
+	maxHosts              int
+	hostPolicy            string
+	ipFamily              string
+	lbHostnameRefresh     time.Duration
+	nodeAddressSources    string
+	excludePrivate        bool
+	probeMode             string
+	probePort             int
+	probePath             string
+	probeHostHeader       string
+	probeInterval         time.Duration
+	probeTimeout          time.Duration
+	probeFailureThreshold int
+	acmeWebhook           bool
+	acmeWebhookListen     string
+	acmeWebhookCertFile   string
+	acmeWebhookKeyFile    string
+	acmeWebhookClientCA   string
+	acmeWebhookGroupName  string
+	autoTLS               bool
+	tlsIssuer             string
+	tlsIssuerKind         string
+	hostnameTemplate      string
+	serviceTemplate       string
+	routeTemplate         string
+	gatewayPollInterval   time.Duration
+	recordPollInterval    time.Duration
+	domainsConfig         string
+	backendPolicy         string
+	backendRetryInterval  time.Duration
+	provider              string
+	rfc2136Server         string
+	rfc2136Zone           string
+	rfc2136TSIGKey        string
+	rfc2136TSIGSecret     string
+	rfc2136TSIGAlgorithm  string
+	rfc2136TTL            int
+	rfc2136Timeout        time.Duration
+	dnsListen             string
+	dnsTTL                int
+	dnsNameservers        string
+	dnsNameserverIPs      string
+	dnsSOAMbox            string
+	fakeRdns              bool
+	fakeRdnsListen        string
+	fakeApiserver         bool
+	apiserverHost         string
+	rdnsCAFile            string
+	rdnsCertFile          string
+	rdnsKeyFile           string
+	rdnsInsecure          bool
+	rdnsProxy             string
+	rdnsTimeout           time.Duration
+	allowInsecureToken    bool
 )
 
 func Init(ctx *cli.Context) {
-	rootDomain = ctx.String("root-domain")
-	baseRdnsURL = ctx.String("base-rdns-url")
-	renewDuration = ctx.Duration("renew-duration")
-	ingressResyncDuration = ctx.Duration("ingress-resync-duration")
+	rootDomain = ctx.GlobalString("root-domain")
+	baseRdnsURL = ctx.GlobalString("base-rdns-url")
+	renewDuration = ctx.GlobalDuration("renew-duration")
+	ingressResyncDuration = ctx.GlobalDuration("ingress-resync-duration")
+	desiredFqdn = ctx.GlobalString("desired-fqdn")
+	fqdnPrefix = ctx.GlobalString("fqdn-prefix")
+	dryRun = ctx.GlobalBool("dry-run")
+	enablePprof = ctx.GlobalBool("enable-pprof")
+	enableLogLevel = ctx.GlobalBool("enable-loglevel-handler")
+	maxHosts = ctx.GlobalInt("max-hosts")
+	hostPolicy = ctx.GlobalString("host-policy")
+	ipFamily = ctx.GlobalString("ip-family")
+	lbHostnameRefresh = ctx.GlobalDuration("lb-hostname-refresh")
+	nodeAddressSources = ctx.GlobalString("node-address-sources")
+	excludePrivate = ctx.GlobalBool("exclude-private-addresses")
+	probeMode = ctx.GlobalString("probe-mode")
+	probePort = ctx.GlobalInt("probe-port")
+	probePath = ctx.GlobalString("probe-path")
+	probeHostHeader = ctx.GlobalString("probe-host-header")
+	probeInterval = ctx.GlobalDuration("probe-interval")
+	probeTimeout = ctx.GlobalDuration("probe-timeout")
+	probeFailureThreshold = ctx.GlobalInt("probe-failure-threshold")
+	acmeWebhook = ctx.GlobalBool("enable-acme-webhook")
+	acmeWebhookListen = ctx.GlobalString("acme-webhook-listen")
+	acmeWebhookCertFile = ctx.GlobalString("acme-webhook-cert-file")
+	acmeWebhookKeyFile = ctx.GlobalString("acme-webhook-key-file")
+	acmeWebhookClientCA = ctx.GlobalString("acme-webhook-client-ca-file")
+	acmeWebhookGroupName = ctx.GlobalString("acme-webhook-group-name")
+	autoTLS = ctx.GlobalBool("auto-tls")
+	tlsIssuer = ctx.GlobalString("tls-issuer")
+	tlsIssuerKind = ctx.GlobalString("tls-issuer-kind")
+	hostnameTemplate = ctx.GlobalString("hostname-template")
+	serviceTemplate = ctx.GlobalString("service-hostname-template")
+	routeTemplate = ctx.GlobalString("route-hostname-template")
+	gatewayPollInterval = ctx.GlobalDuration("gateway-poll-interval")
+	recordPollInterval = ctx.GlobalDuration("record-poll-interval")
+	domainsConfig = ctx.GlobalString("domains-config")
+	backendPolicy = ctx.GlobalString("backend-policy")
+	backendRetryInterval = ctx.GlobalDuration("backend-retry-interval")
+	provider = ctx.GlobalString("provider")
+	rfc2136Server = ctx.GlobalString("rfc2136-server")
+	rfc2136Zone = ctx.GlobalString("rfc2136-zone")
+	rfc2136TSIGKey = ctx.GlobalString("rfc2136-tsig-key")
+	rfc2136TSIGSecret = ctx.GlobalString("rfc2136-tsig-secret")
+	rfc2136TSIGAlgorithm = ctx.GlobalString("rfc2136-tsig-algorithm")
+	rfc2136TTL = ctx.GlobalInt("rfc2136-ttl")
+	rfc2136Timeout = ctx.GlobalDuration("rfc2136-timeout")
+	dnsListen = ctx.GlobalString("dns-listen")
+	dnsTTL = ctx.GlobalInt("dns-ttl")
+	dnsNameservers = ctx.GlobalString("dns-nameservers")
+	dnsNameserverIPs = ctx.GlobalString("dns-nameserver-ips")
+	dnsSOAMbox = ctx.GlobalString("dns-soa-mbox")
+	fakeRdns = ctx.GlobalBool("fake-rdns")
+	fakeRdnsListen = ctx.GlobalString("fake-rdns-listen")
+	fakeApiserver = ctx.GlobalBool("fake-apiserver")
+	apiserverHost = ctx.GlobalString("apiserver-host")
+	rdnsCAFile = ctx.GlobalString("rdns-ca-file")
+	rdnsCertFile = ctx.GlobalString("rdns-cert-file")
+	rdnsKeyFile = ctx.GlobalString("rdns-key-file")
+	rdnsInsecure = ctx.GlobalBool("rdns-insecure-skip-verify")
+	rdnsProxy = ctx.GlobalString("rdns-proxy")
+	rdnsTimeout = ctx.GlobalDuration("rdns-timeout")
+	allowInsecureToken = ctx.GlobalBool("allow-insecure-token")
 }
 
 func GetRootDomain() string {
 	return rootDomain
 }
 
-func GetBaseRdnsURL() string {
-	return baseRdnsURL
+// GetBaseRdnsURLs returns the rdns server endpoints in priority order
+func GetBaseRdnsURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(baseRdnsURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, strings.TrimSuffix(u, "/"))
+		}
+	}
+	return urls
+}
+
+// SetBaseRdnsURL replaces the rdns server endpoints, it is used by the fake rdns mode
+func SetBaseRdnsURL(url string) {
+	baseRdnsURL = url
+}
+
+// SetAllowInsecureToken allows the token to be sent over plain http, it is used by the fake rdns mode
+func SetAllowInsecureToken(allow bool) {
+	allowInsecureToken = allow
+}
+
+func GetRdnsCAFile() string {
+	return rdnsCAFile
+}
+
+func GetRdnsCertFile() string {
+	return rdnsCertFile
+}
+
+func GetRdnsKeyFile() string {
+	return rdnsKeyFile
+}
+
+func IsRdnsInsecureSkipVerify() bool {
+	return rdnsInsecure
+}
+
+func GetRdnsProxy() string {
+	return rdnsProxy
+}
+
+func GetRdnsTimeout() time.Duration {
+	return rdnsTimeout
+}
+
+// IsAllowInsecureToken returns whether the domain token may be sent to rdns servers over plain http
+func IsAllowInsecureToken() bool {
+	return allowInsecureToken
+}
+
+func GetBackendPolicy() string {
+	return backendPolicy
+}
+
+func GetBackendRetryInterval() time.Duration {
+	return backendRetryInterval
 }
 
 func GetRenewDuration() time.Duration {
@@ -42,3 +239,203 @@ func GetRenewDuration() time.Duration {
 func GetIngressResyncDuration() time.Duration {
 	return ingressResyncDuration
 }
+
+func IsDryRun() bool {
+	return dryRun
+}
+
+func IsPprofEnabled() bool {
+	return enablePprof
+}
+
+func IsLogLevelHandlerEnabled() bool {
+	return enableLogLevel
+}
+
+func GetMaxHosts() int {
+	return maxHosts
+}
+
+func GetHostPolicy() string {
+	return hostPolicy
+}
+
+func GetIPFamily() string {
+	return ipFamily
+}
+
+func GetLoadBalancerHostnameRefresh() time.Duration {
+	return lbHostnameRefresh
+}
+
+func GetNodeAddressSources() string {
+	return nodeAddressSources
+}
+
+func IsExcludePrivateAddresses() bool {
+	return excludePrivate
+}
+
+func GetProbeMode() string {
+	return probeMode
+}
+
+func GetProbePort() int {
+	return probePort
+}
+
+func GetProbePath() string {
+	return probePath
+}
+
+func GetProbeHostHeader() string {
+	return probeHostHeader
+}
+
+func GetProbeInterval() time.Duration {
+	return probeInterval
+}
+
+func GetProbeTimeout() time.Duration {
+	return probeTimeout
+}
+
+func GetProbeFailureThreshold() int {
+	return probeFailureThreshold
+}
+
+func IsACMEWebhookEnabled() bool {
+	return acmeWebhook
+}
+
+func GetACMEWebhookListen() string {
+	return acmeWebhookListen
+}
+
+func GetACMEWebhookCertFile() string {
+	return acmeWebhookCertFile
+}
+
+func GetACMEWebhookKeyFile() string {
+	return acmeWebhookKeyFile
+}
+
+func GetACMEWebhookClientCAFile() string {
+	return acmeWebhookClientCA
+}
+
+func GetACMEWebhookGroupName() string {
+	return acmeWebhookGroupName
+}
+
+func IsAutoTLS() bool {
+	return autoTLS
+}
+
+func GetTLSIssuer() string {
+	return tlsIssuer
+}
+
+func GetTLSIssuerKind() string {
+	return tlsIssuerKind
+}
+
+func GetHostnameTemplate() string {
+	return hostnameTemplate
+}
+
+func GetServiceHostnameTemplate() string {
+	return serviceTemplate
+}
+
+func GetRouteHostnameTemplate() string {
+	return routeTemplate
+}
+
+func GetGatewayPollInterval() time.Duration {
+	return gatewayPollInterval
+}
+
+func GetRecordPollInterval() time.Duration {
+	return recordPollInterval
+}
+
+func GetProvider() string {
+	return provider
+}
+
+func GetRFC2136Server() string {
+	return rfc2136Server
+}
+
+func GetRFC2136Zone() string {
+	return rfc2136Zone
+}
+
+func GetRFC2136TSIGKey() string {
+	return rfc2136TSIGKey
+}
+
+func GetRFC2136TSIGSecret() string {
+	return rfc2136TSIGSecret
+}
+
+func GetRFC2136TSIGAlgorithm() string {
+	return rfc2136TSIGAlgorithm
+}
+
+func GetRFC2136TTL() int {
+	return rfc2136TTL
+}
+
+func GetRFC2136Timeout() time.Duration {
+	return rfc2136Timeout
+}
+
+func GetDNSListen() string {
+	return dnsListen
+}
+
+func GetDNSTTL() int {
+	return dnsTTL
+}
+
+func GetDNSNameservers() string {
+	return dnsNameservers
+}
+
+func GetDNSNameserverIPs() string {
+	return dnsNameserverIPs
+}
+
+func GetDNSSOAMbox() string {
+	return dnsSOAMbox
+}
+
+func IsFakeRdns() bool {
+	return fakeRdns
+}
+
+func GetFakeRdnsListen() string {
+	return fakeRdnsListen
+}
+
+func IsFakeApiserver() bool {
+	return fakeApiserver
+}
+
+func GetApiserverHost() string {
+	return apiserverHost
+}
+
+// GetDesiredFqdn returns the fqdn requested on domain creation, an explicit
+// desired fqdn wins over a prefix under the root domain
+func GetDesiredFqdn() string {
+	if desiredFqdn != "" {
+		return desiredFqdn
+	}
+	if fqdnPrefix != "" {
+		return fmt.Sprintf("%s.%s", fqdnPrefix, rootDomain)
+	}
+	return ""
+}